@@ -0,0 +1,178 @@
+// Package events publishes a structured event for every message the proxy
+// tries to send to a Kafka topic, so that delivery can be tracked by other
+// systems without scraping logs. Publishing is asynchronous and never blocks
+// or fails a send, events that can't be buffered are dropped and counted.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/segmentio/kafka-go"
+)
+
+// Results of a send attempt
+const (
+	ResultSent   = "sent"
+	ResultFailed = "failed"
+)
+
+// maxBatch is the most events written to Kafka in one request
+const maxBatch = 100
+
+// Event describes the outcome of sending a message
+type Event struct {
+	Time             time.Time `json:"timestamp"`
+	Result           string    `json:"result"`
+	Reason           string    `json:"reason,omitempty"`
+	MessageID        string    `json:"message_id,omitempty"`
+	From             string    `json:"from"`
+	Recipients       []string  `json:"recipients"`
+	ConfigurationSet string    `json:"configuration_set,omitempty"`
+	User             string    `json:"user,omitempty"`
+	Client           string    `json:"client"`
+	Helo             string    `json:"helo,omitempty"`
+	Size             int       `json:"size"`
+}
+
+// Publisher buffers events and writes them to a Kafka topic in the
+// background
+type Publisher struct {
+	writer *kafka.Writer
+	events chan *Event
+	done   chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+
+	published prometheus.Counter
+	dropped   *prometheus.CounterVec
+}
+
+// NewPublisher creates a publisher that writes events to topic on the Kafka
+// cluster reachable through brokers, buffering up to buffer events that
+// haven't been written yet
+func NewPublisher(brokers []string, topic string, buffer int, reg prometheus.Registerer) *Publisher {
+	f := promauto.With(reg)
+
+	p := &Publisher{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.LeastBytes{},
+			BatchSize:    maxBatch,
+			BatchTimeout: 10 * time.Millisecond,
+			RequiredAcks: kafka.RequireOne,
+		},
+		events: make(chan *Event, buffer),
+		done:   make(chan struct{}),
+		published: f.NewCounter(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "events_published_total",
+			Help:      "Total number of delivery events written to Kafka",
+		}),
+		dropped: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "events_dropped_total",
+			Help:      "Total number of delivery events dropped by reason",
+		}, []string{"reason"}),
+	}
+
+	go p.run()
+
+	return p
+}
+
+// Publish queues an event to be written, dropping it if the buffer is full
+func (p *Publisher) Publish(e *Event) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		p.dropped.With(prometheus.Labels{"reason": "closed"}).Inc()
+		return
+	}
+
+	select {
+	case p.events <- e:
+	default:
+		p.dropped.With(prometheus.Labels{"reason": "overflow"}).Inc()
+	}
+}
+
+// Close stops accepting events and waits up to timeout for the buffered
+// events to be written
+func (p *Publisher) Close(timeout time.Duration) {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.events)
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-p.done:
+	case <-time.After(timeout):
+		log.Printf("Timed out writing delivery events to Kafka")
+	}
+	p.writer.Close()
+}
+
+func (p *Publisher) run() {
+	defer close(p.done)
+
+	batch := make([]kafka.Message, 0, maxBatch)
+	for e := range p.events {
+		batch = append(batch[:0], p.message(e)...)
+
+		// Take whatever else is already buffered so that a backlog is
+		// written in as few requests as possible
+	fill:
+		for len(batch) < maxBatch {
+			select {
+			case e, ok := <-p.events:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, p.message(e)...)
+			default:
+				break fill
+			}
+		}
+
+		if len(batch) == 0 {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := p.writer.WriteMessages(ctx, batch...)
+		cancel()
+		if err != nil {
+			log.Printf("Error writing delivery events to Kafka: %s", err)
+			p.dropped.With(prometheus.Labels{"reason": "error"}).Add(float64(len(batch)))
+			continue
+		}
+		p.published.Add(float64(len(batch)))
+	}
+}
+
+// message encodes an event as a Kafka message keyed by its message ID
+func (p *Publisher) message(e *Event) []kafka.Message {
+	value, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Error encoding delivery event: %s", err)
+		p.dropped.With(prometheus.Labels{"reason": "error"}).Inc()
+		return nil
+	}
+
+	m := kafka.Message{Value: value, Time: e.Time}
+	if e.MessageID != "" {
+		m.Key = []byte(e.MessageID)
+	}
+	return []kafka.Message{m}
+}
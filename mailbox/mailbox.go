@@ -0,0 +1,122 @@
+// Package mailbox implements an in-memory store for messages accepted by the
+// proxy in test receiver mode, along with an HTTP API to inspect them. It lets
+// applications be tested against a real proxy without sending mail to SES.
+package mailbox
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Message is a message stored in a Mailbox
+type Message struct {
+	ID               string    `json:"id"`
+	Received         time.Time `json:"received"`
+	From             string    `json:"from"`
+	To               []string  `json:"to"`
+	ConfigurationSet string    `json:"configuration_set,omitempty"`
+	Size             int       `json:"size"`
+	Data             []byte    `json:"-"`
+}
+
+// Mailbox is a concurrency-safe store of received messages. Once it holds its
+// maximum number of messages the oldest are discarded.
+type Mailbox struct {
+	mu       sync.RWMutex
+	max      int
+	next     int
+	messages []*Message
+}
+
+// New creates a mailbox that holds at most max messages, zero means no limit
+func New(max int) *Mailbox {
+	return &Mailbox{max: max}
+}
+
+// Add stores a copy of a message and returns its ID
+func (m *Mailbox) Add(from string, to []string, configSet string, data []byte) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.next++
+	msg := &Message{
+		ID:               strconv.Itoa(m.next),
+		Received:         time.Now(),
+		From:             from,
+		To:               append([]string(nil), to...),
+		ConfigurationSet: configSet,
+		Size:             len(data),
+		Data:             append([]byte(nil), data...),
+	}
+
+	m.messages = append(m.messages, msg)
+	if m.max > 0 && len(m.messages) > m.max {
+		m.messages = m.messages[len(m.messages)-m.max:]
+	}
+
+	return msg.ID
+}
+
+// List returns the stored messages, oldest first
+func (m *Mailbox) List() []*Message {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return append(make([]*Message, 0, len(m.messages)), m.messages...)
+}
+
+// Get returns the message with id or nil if there is no such message
+func (m *Mailbox) Get(id string) *Message {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, msg := range m.messages {
+		if msg.ID == id {
+			return msg
+		}
+	}
+
+	return nil
+}
+
+// Clear removes all stored messages
+func (m *Mailbox) Clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = nil
+}
+
+// Handler returns an HTTP handler serving the mailbox API:
+//
+//	GET    /messages       list the stored messages as JSON
+//	GET    /messages/{id}  the raw message with id
+//	DELETE /messages       remove all stored messages
+func (m *Mailbox) Handler() http.Handler {
+	sm := http.NewServeMux()
+
+	sm.HandleFunc("GET /messages", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(m.List())
+	})
+
+	sm.HandleFunc("GET /messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+		msg := m.Get(r.PathValue("id"))
+		if msg == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Add("Content-Type", "message/rfc822")
+		w.Write(msg.Data)
+	})
+
+	sm.HandleFunc("DELETE /messages", func(w http.ResponseWriter, r *http.Request) {
+		m.Clear()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return sm
+}
@@ -2,213 +2,183 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
+	"code.crute.us/mcrute/ses-smtpd-proxy/events"
+	"code.crute.us/mcrute/ses-smtpd-proxy/mailbox"
+	"code.crute.us/mcrute/ses-smtpd-proxy/proxy"
+	"code.crute.us/mcrute/ses-smtpd-proxy/suppression"
+	"code.crute.us/mcrute/ses-smtpd-proxy/systemd"
 	"code.crute.us/mcrute/ses-smtpd-proxy/vault"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
-	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
-	"github.com/aws/aws-sdk-go-v2/service/ses"
-	"github.com/aws/aws-sdk-go-v2/service/ses/types"
-	"github.com/aws/aws-sdk-go-v2/service/sts"
-	"github.com/emersion/go-smtp"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var version string
 
-const (
-	SesSizeLimit = 10000000
-	DefaultAddr  = ":2500"
-)
-
-var (
-	emailSent = promauto.NewCounter(prometheus.CounterOpts{
-		Namespace: "smtpd",
-		Name:      "email_send_success_total",
-		Help:      "Total number of successfuly sent emails",
-	})
-	emailError = promauto.NewCounterVec(prometheus.CounterOpts{
-		Namespace: "smtpd",
-		Name:      "email_send_fail_total",
-		Help:      "Total number emails that failed to send",
-	}, []string{"type"})
-	sesError = promauto.NewCounter(prometheus.CounterOpts{
-		Namespace: "smtpd",
-		Name:      "ses_error_total",
-		Help:      "Total number errors with SES",
-	})
-)
-
-// Backend implements smtp.Backend
-type Backend struct {
-	sesClient         *ses.Client
-	configSetName     *string
-}
-
-// NewSession implements smtp.Backend
-func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	return &Session{
-		backend: b,
-		conn:    c,
-	}, nil
-}
-
-// Session implements smtp.Session
-type Session struct {
-	backend       *Backend
-	conn          *smtp.Conn
-	from          string
-	recipients    []string
-	data          []byte
-}
-
-// AuthPlain implements smtp.Session (no-op for unauthenticated server)
-func (s *Session) AuthPlain(username, password string) error {
-	return nil
-}
-
-// Mail implements smtp.Session
-func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
-	s.from = from
-	return nil
-}
-
-// Rcpt implements smtp.Session
-func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
-	s.recipients = append(s.recipients, to)
-	return nil
+// fileConfig is the format of the optional JSON configuration file which
+// holds settings that are too structured to pass as command line flags.
+type fileConfig struct {
+	// PriorityConfigSets maps a message priority ("high", "normal" or "low")
+	// to the configuration set used to send messages of that priority.
+	PriorityConfigSets map[string]string `json:"priority_configuration_sets"`
+
+	// ConfigSetRateLimits maps configuration set names to the maximum
+	// messages per second sent with them, other configuration sets are
+	// limited to DefaultConfigSetRateLimit
+	ConfigSetRateLimits       map[string]float64 `json:"configuration_set_rate_limits"`
+	DefaultConfigSetRateLimit float64            `json:"default_configuration_set_rate_limit"`
+
+	// Transforms is the ordered pipeline of transformations applied to every
+	// message before it is sent
+	Transforms []proxy.TransformConfig `json:"transforms"`
+
+	// Users maps SMTP AUTH usernames to per-user SES settings
+	Users map[string]proxy.UserConfig `json:"users"`
+
+	// SenderConfigSets maps sender domains to the configuration set used to
+	// send their messages
+	SenderConfigSets map[string]string `json:"sender_domain_configuration_sets"`
+
+	// RecipientRoutes maps recipient domains to the configuration set or SES
+	// account used to send to them
+	RecipientRoutes map[string]proxy.RecipientRouteConfig `json:"recipient_domain_routes"`
+
+	// MaxSessionsPerUser limits the concurrent sessions of each authenticated
+	// user that doesn't set its own max_sessions
+	MaxSessionsPerUser int `json:"max_sessions_per_user"`
+
+	// TLSCertificates enables STARTTLS, selecting among the certificates by
+	// the name the client asks for with SNI, the first is the default
+	TLSCertificates []proxy.TLSCertificate `json:"tls_certificates"`
+
+	// LDAP verifies SMTP AUTH passwords against a directory, after any users
+	// in the --smtp-auth-file
+	LDAP *proxy.LDAPConfig `json:"ldap"`
+
+	// OAuth enables the OAUTHBEARER and XOAUTH2 mechanisms, verifying access
+	// tokens with a JWKS or an introspection endpoint
+	OAuth *proxy.OAuthConfig `json:"oauth"`
 }
 
-// Data implements smtp.Session
-func (s *Session) Data(r io.Reader) error {
-	if len(s.recipients) == 0 {
-		emailError.With(prometheus.Labels{"type": "no valid recipients"}).Inc()
-		return &smtp.SMTPError{
-			Code:         554,
-			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
-			Message:      "Error: no valid recipients",
-		}
+func loadFileConfig(path string) (*fileConfig, error) {
+	c := &fileConfig{}
+	if path == "" {
+		return c, nil
 	}
 
-	// Read message data with size limit
-	data, err := io.ReadAll(io.LimitReader(r, SesSizeLimit+1))
+	data, err := os.ReadFile(path)
 	if err != nil {
-		emailError.With(prometheus.Labels{"type": "read error"}).Inc()
-		return &smtp.SMTPError{
-			Code:         451,
-			EnhancedCode: smtp.EnhancedCode{4, 5, 1},
-			Message:      "Temporary server error reading message",
-		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("unable to parse config file %s: %w", path, err)
 	}
 
-	if len(data) > SesSizeLimit {
-		emailError.With(prometheus.Labels{"type": "minimum message size exceed"}).Inc()
-		log.Printf("message size %d exceeds SES limit of %d", len(data), SesSizeLimit)
-		return &smtp.SMTPError{
-			Code:         554,
-			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
-			Message:      "Error: maximum message size exceeded",
+	for priority := range c.PriorityConfigSets {
+		switch priority {
+		case "high", "normal", "low":
+		default:
+			return nil, fmt.Errorf("config file %s: unknown priority %q", path, priority)
 		}
 	}
 
-	s.data = data
+	return c, nil
+}
 
-	// Send via SES
-	input := &ses.SendRawEmailInput{
-		ConfigurationSetName: s.backend.configSetName,
-		Source:               &s.from,
-		Destinations:         s.recipients,
-		RawMessage:           &types.RawMessage{Data: s.data},
-	}
+// networkList is a flag that can be repeated to list several networks
+type networkList []netip.Prefix
 
-	_, err = s.backend.sesClient.SendRawEmail(context.TODO(), input)
-	if err != nil {
-		log.Printf("ERROR: ses: %v", err)
-		emailError.With(prometheus.Labels{"type": "ses error"}).Inc()
-		sesError.Inc()
-		return &smtp.SMTPError{
-			Code:         451,
-			EnhancedCode: smtp.EnhancedCode{4, 5, 1},
-			Message:      "Temporary server error. Please try again later",
-		}
+func (n *networkList) String() string {
+	var s []string
+	for _, p := range *n {
+		s = append(s, p.String())
 	}
+	return strings.Join(s, ",")
+}
 
-	// Log successful send
-	configSetInfo := "no config set"
-	if s.backend.configSetName != nil {
-		configSetInfo = fmt.Sprintf("config set: %s", *s.backend.configSetName)
+func (n *networkList) Set(v string) error {
+	p, err := proxy.ParseNetwork(v)
+	if err != nil {
+		return err
 	}
-	log.Printf("sending message from %s to %v (%s)", s.from, s.recipients, configSetInfo)
-	emailSent.Inc()
-
+	*n = append(*n, p)
 	return nil
 }
 
-// Reset implements smtp.Session
-func (s *Session) Reset() {
-	s.from = ""
-	s.recipients = nil
-	s.data = nil
+// tagMap is a flag that can be repeated to set several name=value message
+// tags
+type tagMap map[string]string
+
+func (t tagMap) String() string {
+	var s []string
+	for name, value := range t {
+		s = append(s, name+"="+value)
+	}
+	return strings.Join(s, ",")
 }
 
-// Logout implements smtp.Session
-func (s *Session) Logout() error {
+func (t tagMap) Set(v string) error {
+	name, value, ok := strings.Cut(v, "=")
+	if !ok {
+		return fmt.Errorf("message tag %q is not of the form name=value", v)
+	}
+	t[name] = value
 	return nil
 }
 
-func makeSesClient(ctx context.Context, enableVault bool, vaultPath string, crossAccountRole string, credentialError chan<- error) (*ses.Client, error) {
-	var cfg aws.Config
-	var err error
-
-	if enableVault {
-		cred, err := vault.GetVaultSecret(ctx, vaultPath, credentialError)
-		if err != nil {
-			return nil, err
-		}
-
-		cfg, err = config.LoadDefaultConfig(ctx,
-			config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
-				cred.AccessKeyID,
-				cred.SecretAccessKey,
-				cred.SessionToken,
-			)),
-		)
+// serveHTTP serves ps on l, a socket passed by systemd, or if l is nil on
+// the server's own address
+func serveHTTP(ps *http.Server, l net.Listener) {
+	if l != nil {
+		go ps.Serve(l)
 	} else {
-		cfg, err = config.LoadDefaultConfig(ctx)
-	}
-	if err != nil {
-		return nil, err
+		go ps.ListenAndServe()
 	}
+}
 
-	// If cross-account role is specified, assume it
-	if crossAccountRole != "" {
-		log.Printf("Assuming cross-account role: %s", crossAccountRole)
-		stsClient := sts.NewFromConfig(cfg)
-		creds := stscreds.NewAssumeRoleProvider(stsClient, crossAccountRole)
-		cfg.Credentials = creds
-		log.Printf("Successfully assumed cross-account role")
-		
-		// Verify the assumed identity
-		identity, err := stsClient.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
-		if err != nil {
-			log.Printf("Warning: Could not verify assumed identity: %v", err)
-		} else {
-			log.Printf("Current identity - Account: %s, ARN: %s", *identity.Account, *identity.Arn)
+// retryStartup calls fn until it succeeds, retrying failures with
+// exponential backoff up to retries times and for no longer than timeout. A
+// zero retries retries until the timeout and a zero timeout retries until
+// the retries run out; if both are zero fn is only called once.
+func retryStartup(ctx context.Context, what string, retries int, timeout time.Duration, fn func() error) error {
+	deadline := time.Now().Add(timeout)
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if retries == 0 && timeout == 0 || retries > 0 && attempt > retries {
+			return err
+		}
+		if timeout > 0 && time.Now().Add(delay).After(deadline) {
+			return err
 		}
-	}
 
-	return ses.NewFromConfig(cfg), nil
+		log.Printf("Error %s (attempt %d), retrying in %s: %s", what, attempt, delay, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, 30*time.Second)
+	}
 }
 
 func main() {
@@ -219,11 +189,125 @@ func main() {
 	prometheusBind := flag.String("prometheus-bind", ":2501", "Address/port on which to bind Prometheus server")
 	enableVault := flag.Bool("enable-vault", false, "Enable fetching AWS IAM credentials from a Vault server")
 	vaultPath := flag.String("vault-path", "", "Full path to Vault credential (ex: \"aws/creds/my-mail-user\")")
+	credentialStartupRetries := flag.Int("credential-startup-retries", 0, "Retry fetching credentials at startup this many times before exiting, 0 for no limit within --credential-startup-timeout")
+	credentialStartupTimeout := flag.Duration("credential-startup-timeout", 0, "Keep retrying to fetch credentials at startup for up to this long before exiting, 0 for no limit")
 	showVersion := flag.Bool("version", false, "Show program version")
 	configurationSetName := flag.String("configuration-set-name", "", "Configuration set name with which SendRawEmail will be invoked")
+	allowedConfigSets := flag.String("allowed-config-sets", "", "Comma separated configuration sets messages may select with the X-SES-CONFIGURATION-SET header (default: any)")
+	disallowedConfigSet := flag.String("disallowed-config-set", "reject", "What to do with messages selecting a configuration set that isn't allowed: reject or default")
+	awsRegion := flag.String("aws-region", "", "AWS region of SES (default: the region of the AWS SDK configuration)")
+	awsEndpointURL := flag.String("aws-endpoint-url", "", "URL to send AWS requests to instead of AWS, such as a LocalStack endpoint")
+	sourceArn := flag.String("source-arn", "", "ARN of the SES identity whose sending authorization policy permits sending from the envelope sender")
+	fromArn := flag.String("from-arn", "", "ARN of the SES identity whose sending authorization policy permits sending from the From address")
+	returnPathArn := flag.String("return-path-arn", "", "ARN of the SES identity whose sending authorization policy permits using the Return-Path address")
+	arnHeaders := flag.Bool("arn-headers", false, "Let the X-SES-SOURCE-ARN, X-SES-FROM-ARN and X-SES-RETURN-PATH-ARN headers of a message override the ARNs")
+	messageTags := tagMap{}
+	flag.Var(messageTags, "message-tag", "SES message tag name=value added to every send, can be repeated")
+	httpsProxy := flag.String("https-proxy", "", "URL of an HTTP or SOCKS5 proxy through which to reach SES (default: $HTTPS_PROXY)")
 	crossAccountRole := flag.String("cross-account-role", "", "ARN of cross-account role to assume for SES access")
 	enableHealthCheck := flag.Bool("enable-health-check", false, "Enable health check server")
+	enableErrorsEndpoint := flag.Bool("enable-errors-endpoint", false, "Serve recent errors at /errors on the health check server, authenticated with $ERRORS_ENDPOINT_TOKEN")
+	recentErrors := flag.Int("recent-errors", 100, "Number of recent errors kept for the errors endpoint")
 	healthCheckBind := flag.String("health-check-bind", ":3000", "Address/port on which to bind health check server")
+	configFile := flag.String("config-file", "", "Path to JSON configuration file")
+	sendRateWindow := flag.Duration("send-rate-window", proxy.DefaultSendRateWindow, "Sliding window over which the current send rate metric is measured")
+	sesAPIVersion := flag.String("ses-api-version", proxy.SesAPIv1, "SES API to send messages with, v1 or v2 (v2 accepts messages up to 40MB)")
+	sendRetries := flag.Int("send-retries", 2, "Times to retry a send that SES throttled or failed with a service error")
+	sendRetryDelay := flag.Duration("send-retry-delay", proxy.DefaultSendRetryDelay, "Delay before the first send retry, doubling with each further one")
+	breakerErrorRate := flag.Float64("breaker-error-rate", 0, "Fraction of SES sends failing with temporary errors that opens the circuit breaker (0 to disable)")
+	breakerWindow := flag.Duration("breaker-window", time.Minute, "Window over which the SES error rate is measured")
+	breakerMinSends := flag.Int("breaker-min-sends", 10, "Sends in the window needed before the circuit breaker can open")
+	breakerCooldown := flag.Duration("breaker-cooldown", 30*time.Second, "How long the circuit breaker stays open before probing SES")
+	enableDSN := flag.Bool("dsn", false, "Advertise DSN and send delivery status notifications for recipients that SES failed for")
+	dsnFrom := flag.String("dsn-from", "", "Address delivery status notifications are sent from (default: MAILER-DAEMON at the domain of the sender)")
+	quiet := flag.Bool("quiet", false, "Don't log each successfully sent message")
+	successLogSample := flag.Int("success-log-sample", 1, "Log only one in this many successfully sent messages")
+	recipientRewriteFile := flag.String("recipient-rewrite-file", "", "JSON file of regular expression rules that rewrite recipient addresses, reloaded on SIGHUP")
+	dedupeRecipients := flag.Bool("dedupe-recipients", true, "Send only one copy to recipients listed more than once")
+	tlsCert := flag.String("tls-cert", "", "Certificate file for STARTTLS, used with --tls-key")
+	tlsKey := flag.String("tls-key", "", "Private key file for --tls-cert")
+	var allowedNetworks networkList
+	flag.Var(&allowedNetworks, "allow-cidr", "Only accept connections from clients in this network, can be repeated")
+	tlsClientCA := flag.String("tls-client-ca", "", "Require TLS clients to present a certificate signed by a CA in this PEM file and authenticate them by it")
+	smtpsBind := flag.String("smtps-bind", "", "Address of an additional listener for SMTP wrapped in TLS, such as :465")
+	requireTLS := flag.Bool("require-tls", false, "Refuse AUTH and MAIL FROM until the client has started TLS")
+	authLockoutThreshold := flag.Int("auth-lockout-threshold", 0, "Lock out client addresses and usernames after this many failed authentications in a row (0 to disable)")
+	authLockoutDelay := flag.Duration("auth-lockout-delay", time.Minute, "How long the first lockout lasts, doubling with each further failure")
+	authLockoutMaxDelay := flag.Duration("auth-lockout-max-delay", time.Hour, "Longest a lockout lasts")
+	authMechanisms := flag.String("auth-mechanisms", "", "Comma separated SASL mechanisms offered to clients, such as PLAIN,OAUTHBEARER (default all supported)")
+	requireAuth := flag.Bool("require-auth", false, "Reject mail from clients that haven't authenticated")
+	kafkaBrokers := flag.String("kafka-brokers", "", "Comma separated host:port addresses of Kafka brokers to publish delivery events to")
+	kafkaTopic := flag.String("kafka-topic", "", "Kafka topic to publish delivery events to")
+	kafkaBuffer := flag.Int("kafka-buffer", 10000, "Maximum delivery events waiting to be written to Kafka before new events are dropped")
+	smtpAuthFile := flag.String("smtp-auth-file", "", "Verify SMTP AUTH passwords against this htpasswd file of bcrypt hashes")
+	ldapURL := flag.String("ldap-url", "", "Verify SMTP AUTH passwords by binding to this LDAP directory, such as ldaps://ldap.example.com")
+	ldapBindDN := flag.String("ldap-bind-dn-template", "", "DN to bind to the LDAP directory as, with %s replaced by the username")
+	ldapGroupFilter := flag.String("ldap-group-filter", "", "LDAP filter the entry of a user must match to authenticate, such as (memberOf=cn=smtp,dc=example,dc=com)")
+	policyAuditMode := flag.Bool("policy-audit-mode", false, "Log and count policy rejections but still accept and send messages")
+	enableSuppression := flag.Bool("enable-local-suppression", false, "Reject recipients found in the local bounce suppression list")
+	suppressionTTL := flag.Duration("local-suppression-ttl", 72*time.Hour, "How long an address stays in the local suppression list")
+	suppressionPath := flag.String("local-suppression-path", "", "File in which to persist the local suppression list")
+	bounceQueueURL := flag.String("local-suppression-queue-url", "", "URL of an SQS queue of SES bounce and complaint notifications to add to the local suppression list")
+	maxMessageSize := flag.Int64("max-message-size", 0, "Largest message accepted in bytes, advertised with SIZE (0 for the SES limit of the API version)")
+	oversizeDrainLimit := flag.Int64("oversize-drain-limit", 0, "Maximum bytes of an oversized message to discard before closing the connection (0 for no limit)")
+	dataReadTimeout := flag.Duration("data-read-timeout", 0, "Maximum time a client may take to transfer a message body (0 for no limit)")
+	readTimeout := flag.Duration("read-timeout", 0, "Maximum time to wait for each command from a client (0 for no limit)")
+	writeTimeout := flag.Duration("write-timeout", 0, "Maximum time to wait for a client to read each reply (0 for no limit)")
+	maxLineLength := flag.Int("max-line-length", 2000, "Longest line accepted in commands and message data, at least 1000")
+	maxRecipients := flag.Int("max-recipients", 0, "Maximum number of recipients of one message (0 for no limit)")
+	spoolLargeToDisk := flag.Bool("spool-large-to-disk", false, "Buffer messages larger than --spool-threshold in a temporary file while they are received")
+	spoolThreshold := flag.Int64("spool-threshold", 1000000, "Message size in bytes above which messages are spooled to disk")
+	spoolDir := flag.String("spool-dir", "", "Directory for spooled messages (default: system temporary directory)")
+	spoolMinFree := flag.Uint64("spool-min-free", 0, "Defer messages that would be spooled while the spool filesystem has fewer free bytes than this (0 to disable)")
+	verifyDeclaredSize := flag.Bool("verify-declared-size", false, "Defer messages much smaller than the SIZE declared by the client")
+	maxMimeDepth := flag.Int("max-mime-depth", 0, "Reject messages with MIME structures nested deeper than this (0 to disable)")
+	bccHeader := flag.String("bcc-header", "keep", "Handling of Bcc headers left in messages by clients: keep or strip")
+	normalizeLineEndings := flag.Bool("normalize-line-endings", false, "Convert bare LF and CR line endings to CRLF before sending")
+	longLines := flag.String("long-lines", "pass", "Handling of messages with lines longer than 998 characters: pass, reject or fold")
+	declared8bit := flag.String("declared-8bit", "pass", "Handling of 8-bit messages sent with BODY=8BITMIME or SMTPUTF8: pass, encode or fallback")
+	undeclared8bit := flag.String("undeclared-8bit", "pass", "Handling of 8-bit messages sent without BODY=8BITMIME: pass, reject or encode")
+	maxDateSkew := flag.Duration("max-date-skew", 0, "Reject messages without a Date header or dated further than this from now (0 to disable)")
+	defaultFrom := flag.String("default-from", "", "From header added to messages that have none, an address or \"envelope\" for the MAIL FROM address")
+	rewriteFrom := flag.String("rewrite-from", "", "Address that replaces the From header of every message, the original is kept in X-Original-From")
+	rewriteFromKeepDomains := flag.String("rewrite-from-keep-domains", "", "Comma separated domains whose From headers --rewrite-from leaves unchanged")
+	allowedSenderDomains := flag.String("allowed-sender-domains", "", "Comma separated domains messages may be sent from, MAIL FROM in other domains is rejected (default: any)")
+	allowedRecipientDomains := flag.String("allowed-recipient-domains", "", "Comma separated domains messages may be sent to, other recipients are rejected (default: any)")
+	deniedRecipientDomains := flag.String("denied-recipient-domains", "", "Comma separated domains messages may not be sent to")
+	nullSenderRewrite := flag.String("null-sender-rewrite", "", "Address used as the sender of messages from the null sender <>, which are rejected if empty")
+	archiveBcc := flag.String("archive-bcc", "", "Address added to the destinations of every message sent, without changing its headers, for archiving")
+	onParseFailure := flag.String("on-parse-failure", "send-as-is", "Handling of messages that can't be parsed by a feature that needs to: send-as-is or reject")
+	requireAlignment := flag.Bool("require-dmarc-alignment", false, "Reject messages whose From domain doesn't align with the envelope sender")
+	alignmentMode := flag.String("dmarc-alignment-mode", "relaxed", "DMARC alignment mode for --require-dmarc-alignment: relaxed or strict")
+	misalignment := flag.String("dmarc-misalignment", "reject", "Handling of messages that fail --require-dmarc-alignment: reject or rewrite the From header to the envelope sender")
+	maxCommandRate := flag.Float64("max-commands-per-second", 0, "Delay AUTH, MAIL, RCPT and RSET commands sent faster than this within a session (0 for unlimited)")
+	maxSendRate := flag.Float64("max-send-rate", 0, "Maximum messages per second to send to SES (0 for unlimited)")
+	warmupDuration := flag.Duration("warmup-duration", 0, "Period over which the send rate ramps up to --max-send-rate after startup")
+	warmupStartRate := flag.Float64("warmup-start-rate", 1, "Send rate in messages per second at the start of the warm-up period")
+	credentialSlowStart := flag.Duration("credential-slow-start", 0, "Period over which the send rate ramps back up from --warmup-start-rate after the AWS SDK refreshes expiring credentials, such as those of --cross-account-role, with a new access key (0 to disable)")
+	contentDenylist := flag.String("content-denylist", "", "Reject messages matching any of the named regular expressions in this file")
+	contentScanLimit := flag.Int("content-scan-limit", 1000000, "Bytes at the start of each message scanned for --content-denylist patterns, 0 for the whole message")
+	sendCountPath := flag.String("send-count-path", "", "File in which to persist the rolling 24 hour send count across restarts")
+	listenBacklog := flag.Int("listen-backlog", 0, "Accept backlog of the SMTP listening socket, 0 for the system default")
+	reusePort := flag.Bool("reuse-port", false, "Set SO_REUSEPORT on the SMTP listening socket so several processes can share the port")
+	configSetFallback := flag.Bool("config-set-fallback", false, "Send messages without a configuration set when SES reports their configuration set does not exist")
+	errorDebugDir := flag.String("error-debug-dir", "", "Directory to which a trace of each message that fails is written")
+	errorDebugMaxFiles := flag.Int("error-debug-max-files", 100, "Maximum number of traces kept in --error-debug-dir, 0 for no limit")
+	errorDebugIncludeBody := flag.Bool("error-debug-include-body", false, "Include the message body in traces written to --error-debug-dir")
+	pollJitter := flag.Float64("poll-jitter", 0.1, "Randomize periodic poll intervals by up to this fraction to stagger proxies started together")
+	mirrorTarget := flag.String("mirror-target", "", "SES region to which a sample of sent messages is also sent for validation")
+	mirrorRole := flag.String("mirror-role", "", "Role to assume for sends to --mirror-target, to mirror to another account")
+	mirrorPercent := flag.Float64("mirror-percent", 0, "Percentage of sent messages also sent to --mirror-target")
+	mirrorMaxRate := flag.Float64("mirror-max-rate", 0, "Maximum messages per second sent to --mirror-target (0 for unlimited)")
+	checkSandbox := flag.Bool("check-sandbox", false, "Warn at startup if the SES account appears to be in the sandbox")
+	verifySenderInterval := flag.Duration("verify-sender-interval", 0, "How often to fetch the SES verified identities and reject senders that aren't verified (0 to disable)")
+	sendWorkers := flag.Int("send-workers", 0, "Number of messages to send to SES at the same time (default: one per message per second of the SES maximum send rate with quota polling, otherwise unbounded)")
+	sendQuotaPollInterval := flag.Duration("send-quota-poll-interval", 0, "How often to fetch the SES send quota and match the send rate limit to it and enforce the daily quota (0 to disable)")
+	testReceiver := flag.Bool("test-receiver", false, "Store messages in memory for inspection instead of sending them to SES")
+	testReceiverBind := flag.String("test-receiver-bind", ":2502", "Address/port on which to bind the test receiver HTTP API")
+	testReceiverMax := flag.Int("test-receiver-max-messages", 1000, "Maximum messages kept by the test receiver (0 for no limit)")
+	listenNetwork := flag.String("listen-network", "tcp", "Address family to listen on: tcp (dual-stack), tcp4 or tcp6")
+	drainPeriod := flag.Duration("shutdown-drain-period", 0, "Time to refuse new connections with a 421 while existing sessions finish before exiting on SIGTERM/SIGINT")
+	tcpKeepAlive := flag.Duration("tcp-keepalive", proxy.DefaultTCPKeepAlive, "TCP keepalive period for accepted connections (0 to disable)")
 
 	flag.Parse()
 
@@ -232,24 +316,268 @@ func main() {
 		return
 	}
 
+	sockets, err := systemd.Listeners()
+	if err != nil {
+		log.Fatalf("Error using systemd sockets: %s", err)
+	}
+
+	errorsToken := os.Getenv("ERRORS_ENDPOINT_TOKEN")
+	if *enableErrorsEndpoint && (!*enableHealthCheck || errorsToken == "") {
+		log.Fatalf("The errors endpoint requires --enable-health-check and ERRORS_ENDPOINT_TOKEN")
+	}
+
+	var draining atomic.Bool
+	var server atomic.Pointer[proxy.Server]
+	healthMux := http.NewServeMux()
 	if *enableHealthCheck {
-		sm := http.NewServeMux()
+		sm := healthMux
 		ps := &http.Server{Addr: *healthCheckBind, Handler: sm}
 		sm.Handle("/health", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Add("Content-Type", "application/json")
+			if draining.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte("{\"name\": \"ses-smtp-proxy\", \"status\": \"draining\", \"version\": \"" + version + "\"}"))
+				return
+			}
+			// A missing configuration set doesn't take the instance out of
+			// service, as every instance would fail the same way and only a
+			// successful send with the set clears it
+			if s := server.Load(); s != nil && len(s.MissingConfigSets()) > 0 {
+				w.Write([]byte("{\"name\": \"ses-smtp-proxy\", \"status\": \"degraded\", \"version\": \"" + version + "\"}"))
+				return
+			}
 			w.Write([]byte("{\"name\": \"ses-smtp-proxy\", \"status\": \"ok\", \"version\": \"" + version + "\"}"))
 		}))
-		go ps.ListenAndServe()
+		serveHTTP(ps, sockets["health"])
 		log.Printf("Health check server listening on %s", *healthCheckBind)
 	}
 
-	credentialError := make(chan error, 2)
-	sesClient, err := makeSesClient(ctx, *enableVault, *vaultPath, *crossAccountRole, credentialError)
+	fileCfg, err := loadFileConfig(*configFile)
 	if err != nil {
-		log.Fatalf("Error creating AWS session: %s", err)
+		log.Fatalf("Error loading config file: %s", err)
+	}
+
+	cfg := proxy.Config{
+		Network:                   *listenNetwork,
+		TCPKeepAlive:              *tcpKeepAlive,
+		ListenBacklog:             *listenBacklog,
+		ReusePort:                 *reusePort,
+		AWSRegion:                 *awsRegion,
+		AWSEndpointURL:            *awsEndpointURL,
+		HTTPSProxy:                *httpsProxy,
+		CrossAccountRole:          *crossAccountRole,
+		MessageTags:               messageTags,
+		SourceArn:                 *sourceArn,
+		FromArn:                   *fromArn,
+		ReturnPathArn:             *returnPathArn,
+		ArnHeaders:                *arnHeaders,
+		ConfigurationSetName:      *configurationSetName,
+		DisallowedConfigSet:       *disallowedConfigSet,
+		PriorityConfigSets:        fileCfg.PriorityConfigSets,
+		Users:                     fileCfg.Users,
+		MaxSessionsPerUser:        fileCfg.MaxSessionsPerUser,
+		SenderConfigSets:          fileCfg.SenderConfigSets,
+		RecipientRoutes:           fileCfg.RecipientRoutes,
+		TLSCertificates:           fileCfg.TLSCertificates,
+		Transforms:                fileCfg.Transforms,
+		ConfigSetRateLimits:       fileCfg.ConfigSetRateLimits,
+		DefaultConfigSetRateLimit: fileCfg.DefaultConfigSetRateLimit,
+		MaxMessageSize:            *maxMessageSize,
+		OversizeDrainLimit:        *oversizeDrainLimit,
+		DataReadTimeout:           *dataReadTimeout,
+		ReadTimeout:               *readTimeout,
+		WriteTimeout:              *writeTimeout,
+		MaxLineLength:             *maxLineLength,
+		MaxRecipients:             *maxRecipients,
+		VerifyDeclaredSize:        *verifyDeclaredSize,
+		MaxMimeDepth:              *maxMimeDepth,
+		SpoolDir:                  *spoolDir,
+		SpoolMinFree:              *spoolMinFree,
+		Undeclared8bit:            *undeclared8bit,
+		Declared8bit:              *declared8bit,
+		NormalizeLineEndings:      *normalizeLineEndings,
+		LongLines:                 *longLines,
+		BccHeader:                 *bccHeader,
+		DefaultFrom:               *defaultFrom,
+		RewriteFrom:               *rewriteFrom,
+		NullSenderRewrite:         *nullSenderRewrite,
+		ArchiveBcc:                *archiveBcc,
+		OnParseFailure:            *onParseFailure,
+		MaxDateSkew:               *maxDateSkew,
+		MaxCommandRate:            *maxCommandRate,
+		MaxSendRate:               *maxSendRate,
+		WarmupDuration:            *warmupDuration,
+		WarmupStartRate:           *warmupStartRate,
+		CredentialSlowStart:       *credentialSlowStart,
+		SendQuotaPollInterval:     *sendQuotaPollInterval,
+		SendWorkers:               *sendWorkers,
+		CheckSandbox:              *checkSandbox,
+		VerifySenderInterval:      *verifySenderInterval,
+		MirrorRegion:              *mirrorTarget,
+		MirrorRole:                *mirrorRole,
+		MirrorPercent:             *mirrorPercent,
+		MirrorMaxRate:             *mirrorMaxRate,
+		PollJitter:                *pollJitter,
+		ErrorDebugDir:             *errorDebugDir,
+		ErrorDebugMaxFiles:        *errorDebugMaxFiles,
+		ErrorDebugIncludeBody:     *errorDebugIncludeBody,
+		ConfigSetFallback:         *configSetFallback,
+		SendCountPath:             *sendCountPath,
+		PolicyAuditMode:           *policyAuditMode,
+		RequireAuth:               *requireAuth,
+		RequireTLS:                *requireTLS,
+		AuthLockoutThreshold:      *authLockoutThreshold,
+		AuthLockoutDelay:          *authLockoutDelay,
+		AuthLockoutMaxDelay:       *authLockoutMaxDelay,
+		SMTPSAddr:                 *smtpsBind,
+		TLSClientCAFile:           *tlsClientCA,
+		AllowedNetworks:           allowedNetworks,
+		DedupeRecipients:          *dedupeRecipients,
+		RecipientRewriteFile:      *recipientRewriteFile,
+		SendRateWindow:            *sendRateWindow,
+		SesAPIVersion:             *sesAPIVersion,
+		SendRetries:               *sendRetries,
+		SendRetryDelay:            *sendRetryDelay,
+		BreakerErrorRate:          *breakerErrorRate,
+		BreakerWindow:             *breakerWindow,
+		BreakerMinSends:           *breakerMinSends,
+		BreakerCooldown:           *breakerCooldown,
+		DSN:                       *enableDSN,
+		DSNFrom:                   *dsnFrom,
+		Quiet:                     *quiet,
+		SuccessLogSample:          *successLogSample,
+	}
+
+	if *allowedConfigSets != "" {
+		cfg.AllowedConfigSets = strings.Split(*allowedConfigSets, ",")
+	}
+
+	if *requireAlignment {
+		cfg.DMARCAlignment = *alignmentMode
+		cfg.DMARCMisalignment = *misalignment
+	}
+
+	if *spoolLargeToDisk {
+		cfg.SpoolThreshold = *spoolThreshold
 	}
 
-	addr := DefaultAddr
+	if *contentDenylist != "" {
+		cfg.ContentDenylist, err = proxy.LoadContentDenylist(*contentDenylist)
+		if err != nil {
+			log.Fatalf("Error loading content denylist: %s", err)
+		}
+		cfg.ContentScanLimit = *contentScanLimit
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatalf("--tls-cert and --tls-key must be used together")
+	}
+	if *tlsCert != "" {
+		// The certificate given on the command line is the default
+		cfg.TLSCertificates = append([]proxy.TLSCertificate{{CertFile: *tlsCert, KeyFile: *tlsKey}}, cfg.TLSCertificates...)
+	}
+
+	var authenticators proxy.ChainAuthenticator
+	if *smtpAuthFile != "" {
+		a, err := proxy.NewFileAuthenticator(*smtpAuthFile)
+		if err != nil {
+			log.Fatalf("Error loading SMTP auth file: %s", err)
+		}
+		authenticators = append(authenticators, a)
+	}
+	if *ldapURL != "" || *ldapBindDN != "" || *ldapGroupFilter != "" {
+		// The flags override the ldap section of the configuration file
+		if fileCfg.LDAP == nil {
+			fileCfg.LDAP = &proxy.LDAPConfig{}
+		}
+		if *ldapURL != "" {
+			fileCfg.LDAP.URL = *ldapURL
+		}
+		if *ldapBindDN != "" {
+			fileCfg.LDAP.BindDN = *ldapBindDN
+		}
+		if *ldapGroupFilter != "" {
+			fileCfg.LDAP.GroupFilter = *ldapGroupFilter
+		}
+	}
+	if fileCfg.LDAP != nil {
+		a, err := proxy.NewLDAPAuthenticator(*fileCfg.LDAP)
+		if err != nil {
+			log.Fatalf("Error configuring LDAP authentication: %s", err)
+		}
+		authenticators = append(authenticators, a)
+	}
+	if *authMechanisms != "" {
+		cfg.AuthMechanisms = strings.Split(*authMechanisms, ",")
+	}
+	if *rewriteFromKeepDomains != "" {
+		cfg.RewriteFromKeepDomains = strings.Split(*rewriteFromKeepDomains, ",")
+	}
+	if *allowedSenderDomains != "" {
+		cfg.AllowedSenderDomains = strings.Split(*allowedSenderDomains, ",")
+	}
+	if *allowedRecipientDomains != "" {
+		cfg.AllowedRecipientDomains = strings.Split(*allowedRecipientDomains, ",")
+	}
+	if *deniedRecipientDomains != "" {
+		cfg.DeniedRecipientDomains = strings.Split(*deniedRecipientDomains, ",")
+	}
+	if fileCfg.OAuth != nil {
+		v, err := proxy.NewTokenValidator(*fileCfg.OAuth)
+		if err != nil {
+			log.Fatalf("Error configuring OAuth authentication: %s", err)
+		}
+		cfg.TokenValidator = v
+	}
+	if len(authenticators) > 0 {
+		cfg.Authenticator = authenticators
+	} else if *requireAuth && *tlsClientCA == "" && fileCfg.OAuth == nil {
+		log.Printf("WARNING: --require-auth is set without --smtp-auth-file, LDAP, OAuth or --tls-client-ca, any password is accepted")
+	}
+
+	credentialError := make(chan error, 2)
+	if *enableVault {
+		var cred aws.Credentials
+		err := retryStartup(ctx, "fetching Vault credentials", *credentialStartupRetries, *credentialStartupTimeout, func() (err error) {
+			cred, err = vault.GetVaultSecret(ctx, *vaultPath, credentialError)
+			return err
+		})
+		if err != nil {
+			log.Fatalf("Error fetching Vault credentials: %s", err)
+		}
+		cfg.Credentials = credentials.NewStaticCredentialsProvider(
+			cred.AccessKeyID,
+			cred.SecretAccessKey,
+			cred.SessionToken,
+		)
+	}
+
+	if *enableSuppression {
+		cfg.Suppression, err = suppression.New(*suppressionTTL, *suppressionPath, prometheus.DefaultRegisterer)
+		if err != nil {
+			log.Fatalf("Error loading local suppression list: %s", err)
+		}
+		cfg.BounceQueueURL = *bounceQueueURL
+	} else if *bounceQueueURL != "" {
+		log.Fatalf("--local-suppression-queue-url requires --enable-local-suppression")
+	}
+
+	if *kafkaBrokers != "" || *kafkaTopic != "" {
+		if *kafkaBrokers == "" || *kafkaTopic == "" {
+			log.Fatalf("Publishing delivery events requires both --kafka-brokers and --kafka-topic")
+		}
+		cfg.Events = events.NewPublisher(strings.Split(*kafkaBrokers, ","), *kafkaTopic, *kafkaBuffer, prometheus.DefaultRegisterer)
+		log.Printf("Publishing delivery events to Kafka topic %s", *kafkaTopic)
+	}
+
+	if *testReceiver {
+		cfg.Mailbox = mailbox.New(*testReceiverMax)
+		ps := &http.Server{Addr: *testReceiverBind, Handler: cfg.Mailbox.Handler()}
+		serveHTTP(ps, sockets["mailbox"])
+		log.Printf("Test receiver mode, messages will NOT be sent to SES. Mailbox API listening on %s", *testReceiverBind)
+	}
+
+	addr := proxy.DefaultAddr
 	if flag.Arg(0) != "" {
 		addr = flag.Arg(0)
 	} else if flag.NArg() > 1 {
@@ -260,38 +588,75 @@ func main() {
 		sm := http.NewServeMux()
 		ps := &http.Server{Addr: *prometheusBind, Handler: sm}
 		sm.Handle("/metrics", promhttp.Handler())
-		go ps.ListenAndServe()
+		serveHTTP(ps, sockets["metrics"])
+	}
+
+	cfg.Addr = addr
+	if *enableErrorsEndpoint {
+		cfg.RecentErrors = *recentErrors
+	}
+	cfg.Listener = sockets["smtp"]
+	cfg.SMTPSListener = sockets["smtps"]
+	if l, ok := sockets["unknown"]; ok && len(sockets) == 1 {
+		cfg.Listener = l
 	}
 
-	var configSetPtr *string
-	if *configurationSetName != "" {
-		configSetPtr = configurationSetName
+	s, err := proxy.New(cfg)
+	if err != nil {
+		log.Fatalf("Error configuring proxy: %s", err)
 	}
 
-	backend := &Backend{
-		sesClient:     sesClient,
-		configSetName: configSetPtr,
+	server.Store(s)
+
+	if *enableErrorsEndpoint {
+		healthMux.Handle("/errors", s.ErrorsHandler(errorsToken))
 	}
 
-	s := smtp.NewServer(backend)
-	s.Addr = addr
-	s.Domain = "localhost"
-	s.AllowInsecureAuth = true // Allow plain auth over non-TLS (as per original design)
+	if *recipientRewriteFile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := s.ReloadRecipientRewrites(); err != nil {
+					log.Printf("ERROR: keeping the current recipient rewrite rules: %s", err)
+				} else {
+					log.Printf("Reloaded recipient rewrite rules from %s", *recipientRewriteFile)
+				}
+			}
+		}()
+	}
 
+	// The server is stopped by exiting rather than by canceling its context
+	// so that it keeps answering new connections while draining.
 	go func() {
-		log.Printf("ListenAndServe on %s", addr)
-		if err := s.ListenAndServe(); err != nil {
-			log.Printf("Error in ListenAndServe: %v", err)
+		if err := s.Run(context.Background()); err != nil {
+			log.Fatalf("Error in ListenAndServe: %v", err)
 		}
 	}()
 
 	select {
 	case <-ctx.Done():
 		log.Printf("SIGTERM/SIGINT received, shutting down")
-		s.Close()
+		if *drainPeriod > 0 {
+			log.Printf("Draining for %s", *drainPeriod)
+			draining.Store(true)
+			s.Drain()
+			time.Sleep(*drainPeriod)
+		}
+		if cfg.Events != nil {
+			cfg.Events.Close(5 * time.Second)
+		}
+		if err := s.SaveSendCount(); err != nil {
+			log.Printf("Error saving send count: %s", err)
+		}
+		s.LogSummary()
 		os.Exit(0)
 	case err := <-credentialError:
-		log.Fatalf("Error renewing credential: %s", err)
+		log.Printf("Error renewing credential: %s", err)
+		if err := s.SaveSendCount(); err != nil {
+			log.Printf("Error saving send count: %s", err)
+		}
+		s.LogSummary()
 		os.Exit(1)
 	}
 }
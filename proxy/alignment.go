@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// checkAlignment returns an error if the domain of the From header of the
+// message doesn't align with the domain of the envelope sender as DMARC
+// defines it. In strict mode the domains must be identical, in relaxed mode
+// they only need to share an organizational domain.
+func checkAlignment(data []byte, envelopeFrom string, strict bool) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("message headers are not valid")
+	}
+
+	from, err := msg.Header.AddressList("From")
+	if err != nil || len(from) != 1 {
+		return fmt.Errorf("message must have a single valid From address")
+	}
+
+	headerDomain := addressDomain(from[0].Address)
+	envelopeDomain := addressDomain(envelopeFrom)
+	if envelopeFrom == "" || envelopeDomain == "" {
+		return fmt.Errorf("envelope sender is empty")
+	}
+
+	if !strict {
+		headerDomain = organizationalDomain(headerDomain)
+		envelopeDomain = organizationalDomain(envelopeDomain)
+	}
+
+	if headerDomain != envelopeDomain {
+		return fmt.Errorf("From domain %s is not aligned with envelope sender <%s>", addressDomain(from[0].Address), envelopeFrom)
+	}
+
+	return nil
+}
+
+// organizationalDomain returns the registrable part of domain, falling back
+// to domain itself if it has none
+func organizationalDomain(domain string) string {
+	if org, err := publicsuffix.EffectiveTLDPlusOne(domain); err == nil {
+		return org
+	}
+	return domain
+}
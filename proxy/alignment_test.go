@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckAlignment(t *testing.T) {
+	tests := []struct {
+		name         string
+		headerFrom   string
+		envelopeFrom string
+		strict       bool
+		wantErr      bool
+	}{
+		{"relaxed same domain", "app@example.com", "bounce@example.com", false, false},
+		{"relaxed subdomain", "app@example.com", "bounce@mail.example.com", false, false},
+		{"relaxed sibling subdomains", "app@news.example.com", "bounce@mail.example.com", false, false},
+		{"relaxed public suffix", "app@example.co.uk", "bounce@mail.example.co.uk", false, false},
+		{"relaxed case", "app@Example.COM", "bounce@example.com", false, false},
+		{"relaxed other domain", "app@example.com", "bounce@example.net", false, true},
+		{"relaxed other registrable domain", "app@example.co.uk", "bounce@other.co.uk", false, true},
+		{"strict same domain", "app@example.com", "bounce@example.com", true, false},
+		{"strict subdomain", "app@example.com", "bounce@mail.example.com", true, true},
+		{"strict other domain", "app@example.com", "bounce@example.net", true, true},
+		{"null sender", "app@example.com", "", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := message("Hello", "From: App <"+tt.headerFrom+">", "Subject: Test")
+			err := checkAlignment([]byte(msg), tt.envelopeFrom, tt.strict)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkAlignment = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDataAlignment(t *testing.T) {
+	tests := []struct {
+		name          string
+		mode          string
+		misalignment  string
+		headerFrom    string
+		wantCode      int
+		wantRewritten bool
+	}{
+		{"relaxed aligned", "relaxed", "", "app@example.com", 250, false},
+		{"strict misaligned", "strict", "", "app@example.com", 550, false},
+		{"relaxed misaligned", "relaxed", "", "app@example.net", 550, false},
+		{"misaligned rewritten", "relaxed", "rewrite", "app@example.net", 250, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DMARCAlignment = tt.mode
+			cfg.DMARCMisalignment = tt.misalignment
+			_, addr := startServer(t, cfg)
+
+			c := dial(t, addr)
+			_, err := sendMessage(c, "bounce@mail.example.com", []string{"rcpt@example.com"}, message("Hello", "From: "+tt.headerFrom, "Subject: Test"))
+			code := 250
+			if err != nil {
+				code = replyCode(err)
+			}
+			if code != tt.wantCode {
+				t.Fatalf("DATA reply %d (%v), want %d", code, err, tt.wantCode)
+			}
+			if code != 250 {
+				return
+			}
+
+			data := string(cfg.Mailbox.List()[0].Data)
+			rewritten := strings.Contains(data, "X-Original-From: "+tt.headerFrom)
+			if rewritten != tt.wantRewritten {
+				t.Errorf("From rewritten %t, want %t:\n%s", rewritten, tt.wantRewritten, data)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// allowListener answers connections from clients outside the allowed
+// networks with a 554 greeting and closes them
+type allowListener struct {
+	net.Listener
+	server *Server
+}
+
+func (l *allowListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil || l.server.allowed(c.RemoteAddr()) {
+			return c, err
+		}
+
+		refuse(c, fmt.Sprintf("554 %s Access denied\r\n", l.server.smtp.Domain))
+		l.server.backend.metrics.refusedNetwork.Inc()
+	}
+}
+
+// allowed reports whether a client connecting from addr is in one of the
+// allowed networks. Clients whose address isn't an IP address are refused.
+func (s *Server) allowed(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	ip := tcpAddr.AddrPort().Addr().Unmap()
+	for _, n := range s.cfg.AllowedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNetwork parses a network in CIDR notation, or a single IP address
+// which is taken as a network of just that address
+func ParseNetwork(s string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid network %q, must be an IP address or CIDR", s)
+	}
+	return p.Masked(), nil
+}
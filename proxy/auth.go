@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrInvalidCredentials is returned by an Authenticator when the username or
+// password is wrong
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// Authenticator verifies the credentials a client presents with SMTP AUTH
+// and returns the identity of the user, which selects their per-user
+// settings. Wrong credentials are reported with ErrInvalidCredentials, other
+// errors are treated as temporary failures.
+type Authenticator interface {
+	Authenticate(user, pass string) (identity string, err error)
+}
+
+// ChainAuthenticator tries each authenticator in turn and returns the
+// identity from the first that accepts the credentials
+type ChainAuthenticator []Authenticator
+
+func (c ChainAuthenticator) Authenticate(user, pass string) (string, error) {
+	err := ErrInvalidCredentials
+	for _, a := range c {
+		identity, aerr := a.Authenticate(user, pass)
+		if aerr == nil {
+			return identity, nil
+		}
+		if !errors.Is(aerr, ErrInvalidCredentials) {
+			err = aerr
+		}
+	}
+	return "", err
+}
+
+// dummyHash is compared against for unknown users so that they take as long
+// to reject as a wrong password
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// FileAuthenticator authenticates users against an htpasswd style file of
+// "username:bcrypt-hash" lines, as written by "htpasswd -B". Blank lines and
+// lines starting with # are ignored.
+type FileAuthenticator struct {
+	users map[string][]byte
+}
+
+// NewFileAuthenticator loads the users from the file at path
+func NewFileAuthenticator(path string) (*FileAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &FileAuthenticator{users: map[string][]byte{}}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("%s:%d: expected username:hash", path, n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: password of %s is not a bcrypt hash", path, n, user)
+		}
+		a.users[user] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *FileAuthenticator) Authenticate(user, pass string) (string, error) {
+	hash, ok := a.users[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(pass))
+		return "", ErrInvalidCredentials
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(pass)) != nil {
+		return "", ErrInvalidCredentials
+	}
+
+	return user, nil
+}
+
+// loginServer implements the server side of the LOGIN SASL mechanism, which
+// is obsolete but still the only one some clients support
+type loginServer struct {
+	authenticate func(username, password string) error
+	username     string
+	state        int
+}
+
+func (a *loginServer) Next(response []byte) ([]byte, bool, error) {
+	switch a.state {
+	case 0:
+		a.state++
+		if response == nil {
+			return []byte("Username:"), false, nil
+		}
+		fallthrough
+	case 1:
+		a.username = string(response)
+		a.state = 2
+		return []byte("Password:"), false, nil
+	case 2:
+		a.state++
+		return nil, true, a.authenticate(a.username, string(response))
+	}
+
+	return nil, true, errors.New("unexpected client response")
+}
+
+// xoauth2 is the name of Google's XOAUTH2 SASL mechanism, the predecessor of
+// OAUTHBEARER that many clients still use
+const xoauth2 = "XOAUTH2"
+
+// tokenChallenge is sent to clients whose token is rejected, before failing
+// the exchange once they respond
+var tokenChallenge = []byte(`{"status":"invalid_token","schemes":"bearer"}`)
+
+// oauthBearerServer wraps the go-sasl OAUTHBEARER server so that a rejected
+// token fails the exchange with the SMTP error from authenticate rather than
+// a generic one
+type oauthBearerServer struct {
+	server sasl.Server
+	err    error
+}
+
+func newOAuthBearerServer(authenticate func(username, token string) error) *oauthBearerServer {
+	a := &oauthBearerServer{}
+	a.server = sasl.NewOAuthBearerServer(func(opts sasl.OAuthBearerOptions) *sasl.OAuthBearerError {
+		if a.err = authenticate(opts.Username, opts.Token); a.err != nil {
+			return &sasl.OAuthBearerError{Status: "invalid_token", Schemes: "bearer"}
+		}
+		return nil
+	})
+	return a
+}
+
+func (a *oauthBearerServer) Next(response []byte) ([]byte, bool, error) {
+	if a.err != nil {
+		return nil, true, a.err
+	}
+	return a.server.Next(response)
+}
+
+// xoauth2Server implements the server side of the XOAUTH2 SASL mechanism,
+// whose response is "user=<user>^Aauth=Bearer <token>^A^A"
+type xoauth2Server struct {
+	authenticate func(username, token string) error
+	err          error
+	state        int
+}
+
+func (a *xoauth2Server) Next(response []byte) ([]byte, bool, error) {
+	switch a.state {
+	case 0:
+		if response == nil {
+			a.state = 1
+			return []byte{}, false, nil
+		}
+		fallthrough
+	case 1:
+		a.state = 2
+		var username, token string
+		for _, field := range strings.Split(string(response), "\x01") {
+			key, value, _ := strings.Cut(field, "=")
+			switch key {
+			case "user":
+				username = value
+			case "auth":
+				scheme, t, _ := strings.Cut(value, " ")
+				if strings.EqualFold(scheme, "bearer") {
+					token = t
+				}
+			}
+		}
+		if token == "" {
+			return nil, true, errors.New("sasl: invalid XOAUTH2 response")
+		}
+		if a.err = a.authenticate(username, token); a.err != nil {
+			return tokenChallenge, false, nil
+		}
+		return nil, true, nil
+	case 2:
+		// The client acknowledges the error with an empty response
+		a.state++
+		return nil, true, a.err
+	}
+
+	return nil, true, errors.New("unexpected client response")
+}
+
+// LDAPConfig configures authentication with a simple bind against an LDAP
+// directory
+type LDAPConfig struct {
+	// URL of the directory, for example ldaps://ldap.example.com
+	URL string `json:"url"`
+
+	// StartTLS upgrades a plain ldap:// connection before binding
+	StartTLS bool `json:"start_tls"`
+
+	// BindDN is the DN to bind as with %s replaced by the escaped username,
+	// for example uid=%s,ou=people,dc=example,dc=com
+	BindDN string `json:"bind_dn"`
+
+	// GroupFilter, if set, is an LDAP filter the entry of the user must
+	// match to be allowed to authenticate, with %s replaced by the escaped
+	// username, for example
+	// (memberOf=cn=smtp,ou=groups,dc=example,dc=com)
+	GroupFilter string `json:"group_filter"`
+}
+
+// ldapTimeout bounds connecting to and each request sent to the directory
+const ldapTimeout = 10 * time.Second
+
+// LDAPAuthenticator authenticates users by binding to an LDAP directory with
+// their credentials. A new connection is made for each attempt.
+type LDAPAuthenticator struct {
+	cfg LDAPConfig
+}
+
+// NewLDAPAuthenticator validates cfg and returns an authenticator for it
+func NewLDAPAuthenticator(cfg LDAPConfig) (*LDAPAuthenticator, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("ldap: url is required")
+	}
+	if strings.Count(cfg.BindDN, "%s") != 1 {
+		return nil, errors.New("ldap: bind_dn must contain %s exactly once")
+	}
+	if strings.Count(cfg.GroupFilter, "%s") > 1 {
+		return nil, errors.New("ldap: group_filter may contain %s at most once")
+	}
+	if cfg.GroupFilter != "" {
+		if _, err := ldap.CompileFilter(strings.Replace(cfg.GroupFilter, "%s", "user", 1)); err != nil {
+			return nil, fmt.Errorf("ldap: group_filter: %w", err)
+		}
+	}
+	return &LDAPAuthenticator{cfg: cfg}, nil
+}
+
+func (a *LDAPAuthenticator) Authenticate(user, pass string) (string, error) {
+	// An empty password would be an unauthenticated bind, which servers
+	// accept for any DN
+	if user == "" || pass == "" {
+		return "", ErrInvalidCredentials
+	}
+
+	conn, err := ldap.DialURL(a.cfg.URL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}))
+	if err != nil {
+		return "", fmt.Errorf("ldap: %w", err)
+	}
+	defer conn.Close()
+	conn.SetTimeout(ldapTimeout)
+
+	if a.cfg.StartTLS {
+		u, err := url.Parse(a.cfg.URL)
+		if err != nil {
+			return "", fmt.Errorf("ldap: %w", err)
+		}
+		if err := conn.StartTLS(&tls.Config{ServerName: u.Hostname()}); err != nil {
+			return "", fmt.Errorf("ldap: %w", err)
+		}
+	}
+
+	dn := fmt.Sprintf(a.cfg.BindDN, ldap.EscapeDN(user))
+	if err := conn.Bind(dn, pass); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return "", ErrInvalidCredentials
+		}
+		return "", fmt.Errorf("ldap: %w", err)
+	}
+
+	if a.cfg.GroupFilter != "" {
+		filter := a.cfg.GroupFilter
+		if strings.Contains(filter, "%s") {
+			filter = fmt.Sprintf(filter, ldap.EscapeFilter(user))
+		}
+
+		// The entry of the user is read as the user, so it only matches
+		// if they can read the attributes the filter checks
+		res, err := conn.Search(ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases,
+			1, int(ldapTimeout/time.Second), false, filter, []string{"dn"}, nil))
+		if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return "", fmt.Errorf("ldap: %w", err)
+		}
+		if err != nil || len(res.Entries) == 0 {
+			log.Printf("LDAP user %s doesn't match the group filter", user)
+			return "", ErrInvalidCredentials
+		}
+	}
+
+	return user, nil
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// mockAuthenticator accepts the users in identities with the password
+// "secret" and returns their identity, or fails every attempt with err
+type mockAuthenticator struct {
+	identities map[string]string
+	err        error
+	calls      atomic.Int32
+}
+
+func (a *mockAuthenticator) Authenticate(user, pass string) (string, error) {
+	a.calls.Add(1)
+	if a.err != nil {
+		return "", a.err
+	}
+	if identity, ok := a.identities[user]; ok && pass == "secret" {
+		return identity, nil
+	}
+	return "", ErrInvalidCredentials
+}
+
+var errDirectoryDown = errors.New("directory unavailable")
+
+func TestChainAuthenticator(t *testing.T) {
+	tests := []struct {
+		name         string
+		firstErr     error
+		user         string
+		pass         string
+		wantIdentity string
+		wantErr      error
+		wantCalls    [2]int32
+	}{
+		{"first accepts", nil, "alice", "secret", "alice-file", nil, [2]int32{1, 0}},
+		{"second accepts", nil, "bob", "secret", "bob-ldap", nil, [2]int32{1, 1}},
+		{"first wins for shared user", nil, "carol", "secret", "carol-file", nil, [2]int32{1, 0}},
+		{"wrong password", nil, "alice", "wrong", "", ErrInvalidCredentials, [2]int32{1, 1}},
+		{"unknown user", nil, "dave", "secret", "", ErrInvalidCredentials, [2]int32{1, 1}},
+		{"first fails, second accepts", errDirectoryDown, "bob", "secret", "bob-ldap", nil, [2]int32{1, 1}},
+		{"first fails, second rejects", errDirectoryDown, "dave", "secret", "", errDirectoryDown, [2]int32{1, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := &mockAuthenticator{identities: map[string]string{"alice": "alice-file", "carol": "carol-file"}, err: tt.firstErr}
+			second := &mockAuthenticator{identities: map[string]string{"bob": "bob-ldap", "carol": "carol-ldap"}}
+
+			identity, err := ChainAuthenticator{first, second}.Authenticate(tt.user, tt.pass)
+			if identity != tt.wantIdentity || !errors.Is(err, tt.wantErr) {
+				t.Errorf("Authenticate = %q, %v, want %q, %v", identity, err, tt.wantIdentity, tt.wantErr)
+			}
+			if calls := [2]int32{first.calls.Load(), second.calls.Load()}; calls != tt.wantCalls {
+				t.Errorf("authenticators called %v times, want %v", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestFileAuthenticator(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte("# SMTP users\n\nalice:"+string(hash)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewFileAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user, pass string
+		wantErr    bool
+	}{
+		{"alice", "secret", false},
+		{"alice", "wrong", true},
+		{"bob", "secret", true},
+	}
+	for _, tt := range tests {
+		identity, err := a.Authenticate(tt.user, tt.pass)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("Authenticate(%q, %q) = %v, want invalid credentials", tt.user, tt.pass, err)
+			}
+		} else if err != nil || identity != tt.user {
+			t.Errorf("Authenticate(%q, %q) = %q, %v", tt.user, tt.pass, identity, err)
+		}
+	}
+}
+
+func TestFileAuthenticatorInvalid(t *testing.T) {
+	for _, content := range []string{"alice\n", ":hash\n", "alice:plaintext\n"} {
+		path := filepath.Join(t.TempDir(), "users")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewFileAuthenticator(path); err == nil {
+			t.Errorf("NewFileAuthenticator accepted %q", content)
+		}
+	}
+}
+
+func TestAuthMechanisms(t *testing.T) {
+	tests := []struct {
+		name          string
+		client        sasl.Client
+		authErr       error
+		wantCode      int
+		wantConfigSet string
+	}{
+		{"PLAIN", sasl.NewPlainClient("", "alice", "secret"), nil, 0, "alice-set"},
+		{"LOGIN", sasl.NewLoginClient("alice", "secret"), nil, 0, "alice-set"},
+		{"PLAIN wrong password", sasl.NewPlainClient("", "alice", "wrong"), nil, 535, ""},
+		{"LOGIN wrong password", sasl.NewLoginClient("alice", "wrong"), nil, 535, ""},
+		{"authenticator unavailable", sasl.NewPlainClient("", "alice", "secret"), errDirectoryDown, 454, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Authenticator = ChainAuthenticator{&mockAuthenticator{identities: map[string]string{"alice": "alice@corp"}, err: tt.authErr}}
+			cfg.Users = map[string]UserConfig{"alice@corp": {ConfigurationSet: "alice-set"}}
+			_, addr := startServer(t, cfg)
+
+			c := dial(t, addr)
+			err := c.Auth(tt.client)
+			if code := replyCode(err); code != tt.wantCode {
+				t.Fatalf("AUTH reply %d (%v), want %d", code, err, tt.wantCode)
+			}
+			if err != nil {
+				return
+			}
+
+			// The identity the authenticator returned selects the user's
+			// settings
+			if _, err := sendMessage(c, "sender@example.com", []string{"rcpt@example.com"}, message("Hello", "Subject: Test")); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			if got := cfg.Mailbox.List()[0].ConfigurationSet; got != tt.wantConfigSet {
+				t.Errorf("configuration set %q, want %q", got, tt.wantConfigSet)
+			}
+		})
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	tests := []struct {
+		name        string
+		requireAuth bool
+		password    string
+		wantCode    int
+	}{
+		{"optional anonymous", false, "", 250},
+		{"optional authenticated", false, "secret", 250},
+		{"required anonymous", true, "", 530},
+		{"required authenticated", true, "secret", 250},
+		{"required wrong password", true, "wrong", 530},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.RequireAuth = tt.requireAuth
+			cfg.Authenticator = staticAuthenticator{"alice": "secret"}
+			_, addr := startServer(t, cfg)
+
+			c := dial(t, addr)
+			if tt.password != "" {
+				err := login(c, "alice", tt.password)
+				if wantOK := tt.password == "secret"; (err == nil) != wantOK {
+					t.Fatalf("AUTH: %v, want success %t", err, wantOK)
+				}
+			}
+
+			_, err := sendMessage(c, "sender@example.com", []string{"rcpt@example.com"}, message("Hello", "Subject: Test"))
+			code := 250
+			if err != nil {
+				code = replyCode(err)
+			}
+			if code != tt.wantCode {
+				t.Errorf("send reply %d (%v), want %d", code, err, tt.wantCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// authLockout slows down password guessing by locking out client addresses
+// and usernames after repeated failed authentications. Once a client or
+// user has failed threshold times in a row they are locked out for delay,
+// doubling with each further failure up to maxDelay. While locked out
+// attempts are refused without checking the credentials, so guesses made
+// then can't succeed.
+type authLockout struct {
+	mu        sync.Mutex
+	threshold int
+	delay     time.Duration
+	maxDelay  time.Duration
+	entries   map[string]*lockoutEntry
+	lastSweep time.Time
+
+	lockouts *prometheus.CounterVec
+	refused  *prometheus.CounterVec
+}
+
+// lockoutEntry is the failure history of a client address or username
+type lockoutEntry struct {
+	failures    int
+	lastFailure time.Time
+	until       time.Time
+}
+
+func newAuthLockout(threshold int, delay, maxDelay time.Duration, lockouts, refused *prometheus.CounterVec) *authLockout {
+	return &authLockout{
+		threshold: threshold,
+		delay:     delay,
+		maxDelay:  max(delay, maxDelay),
+		entries:   map[string]*lockoutEntry{},
+		lockouts:  lockouts,
+		refused:   refused,
+	}
+}
+
+// lockoutKeys returns the keys under which failures from the client at
+// addr, authenticating as user, are tracked. The user is empty when it isn't
+// known yet.
+func lockoutKeys(addr net.Addr, user string) map[string]string {
+	client := addr.String()
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		client = tcpAddr.AddrPort().Addr().Unmap().String()
+	}
+
+	keys := map[string]string{"client": "client:" + client}
+	if user != "" {
+		keys["user"] = "user:" + user
+	}
+	return keys
+}
+
+// locked reports how much longer the client at addr or user is locked out
+// for, zero if neither is
+func (l *authLockout) locked(addr net.Addr, user string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var remaining time.Duration
+	for scope, key := range lockoutKeys(addr, user) {
+		if e, ok := l.entries[key]; ok {
+			if d := time.Until(e.until); d > 0 {
+				l.refused.With(prometheus.Labels{"scope": scope}).Inc()
+				remaining = max(remaining, d)
+			}
+		}
+	}
+	return remaining
+}
+
+// fail records a failed authentication of user by the client at addr
+func (l *authLockout) fail(addr net.Addr, user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	for scope, key := range lockoutKeys(addr, user) {
+		e, ok := l.entries[key]
+		if !ok || now.Sub(e.lastFailure) >= l.maxDelay {
+			e = &lockoutEntry{}
+			l.entries[key] = e
+		}
+		e.failures++
+		e.lastFailure = now
+
+		if e.failures >= l.threshold {
+			delay := l.delay
+			for i := l.threshold; i < e.failures && delay < l.maxDelay; i++ {
+				delay *= 2
+			}
+			e.until = now.Add(min(delay, l.maxDelay))
+			l.lockouts.With(prometheus.Labels{"scope": scope}).Inc()
+		}
+	}
+}
+
+// succeed clears the failures of user and of the client at addr once they
+// authenticate, so that one misconfigured client behind a shared address
+// doesn't keep locking out the others once they log in
+func (l *authLockout) succeed(addr net.Addr, user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range lockoutKeys(addr, user) {
+		delete(l.entries, key)
+	}
+}
+
+// sweep forgets the entries that haven't failed for maxDelay, at most once
+// per maxDelay. Older failures are no longer counted either way.
+func (l *authLockout) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.maxDelay {
+		return
+	}
+	l.lastSweep = now
+
+	for key, e := range l.entries {
+		if now.Sub(e.lastFailure) >= l.maxDelay && now.After(e.until) {
+			delete(l.entries, key)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"bytes"
+	"net/mail"
+	"strings"
+)
+
+// sendingArns are the ARNs of the SES identities whose sending authorization
+// policies permit a send from an identity owned by another account. Unset
+// ARNs are nil.
+type sendingArns struct {
+	source     *string
+	from       *string
+	returnPath *string
+}
+
+// override returns a with the ARNs set in o replacing its own
+func (a sendingArns) override(o sendingArns) sendingArns {
+	if o.source != nil {
+		a.source = o.source
+	}
+	if o.from != nil {
+		a.from = o.from
+	}
+	if o.returnPath != nil {
+		a.returnPath = o.returnPath
+	}
+	return a
+}
+
+// Header fields that set the sending authorization ARNs of a message, the
+// same ones the SES SMTP interface understands
+const (
+	sourceArnHeader     = "X-SES-SOURCE-ARN"
+	fromArnHeader       = "X-SES-FROM-ARN"
+	returnPathArnHeader = "X-SES-RETURN-PATH-ARN"
+)
+
+// messageArns returns the sending authorization ARNs set by the header of
+// data and data with those header fields removed, so that they aren't sent
+// on to the recipients
+func messageArns(data []byte) (sendingArns, []byte, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return sendingArns{}, data, err
+	}
+
+	arns := sendingArns{
+		source:     optionalString(strings.TrimSpace(msg.Header.Get(sourceArnHeader))),
+		from:       optionalString(strings.TrimSpace(msg.Header.Get(fromArnHeader))),
+		returnPath: optionalString(strings.TrimSpace(msg.Header.Get(returnPathArnHeader))),
+	}
+	if arns == (sendingArns{}) {
+		return arns, data, nil
+	}
+
+	rawHeader, body, _ := splitEntity(data)
+	for _, name := range []string{sourceArnHeader, fromArnHeader, returnPathArnHeader} {
+		rawHeader = removeHeader(rawHeader, name)
+	}
+	return arns, append(rawHeader, body...), nil
+}
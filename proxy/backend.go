@@ -0,0 +1,1592 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/mail"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code.crute.us/mcrute/ses-smtpd-proxy/events"
+	"code.crute.us/mcrute/ses-smtpd-proxy/mailbox"
+	"code.crute.us/mcrute/ses-smtpd-proxy/suppression"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// Backend implements smtp.Backend
+type Backend struct {
+	sesClient          *ses.Client
+	configSetName      *string
+	priorityConfigSets map[string]string
+	allowedConfigSets  map[string]bool
+	disallowedSet      string
+	maxMessageSize     int64
+	oversizeDrainLimit int64
+	dataReadTimeout    time.Duration
+	readTimeout        time.Duration
+	sendRetries        int
+	sendRetryDelay     time.Duration
+	sesV2              bool
+	arns               sendingArns
+	arnHeaders         bool
+	messageTags        map[string]string
+	breaker            *sesBreaker
+	maxMimeDepth       int
+	verifyDeclaredSize bool
+	undeclared8bit     string
+	declared8bit       string
+	normalizeLines     bool
+	longLines          string
+	stripBcc           bool
+	defaultFrom        string
+	rewriteFrom        string
+	keepFromDomains    map[string]bool
+	nullSenderRewrite  string
+	archiveBcc         string
+	allowedSenders     map[string]bool
+	verifiedSenders    map[*ses.Client]*verifiedIdentities
+	allowedRcpts       map[string]bool
+	deniedRcpts        map[string]bool
+	rejectUnparseable  bool
+	maxDateSkew        time.Duration
+	dmarcAlignment     string
+	rewriteMisaligned  bool
+	contentDenylist    []ContentPattern
+	contentScanLimit   int
+	transforms         []Transform
+	spoolThreshold     int64
+	spoolDir           string
+	spoolMinFree       uint64
+	sendLimiter        *sendLimiter
+	sendPool           *sendPool
+	dailyQuota         *dailyQuota
+	configSetLimiters  *configSetLimiters
+	policyAuditMode    bool
+	requireAuth        bool
+	requireTLS         bool
+	authenticator      Authenticator
+	tokenValidator     TokenValidator
+	authMechanisms     map[string]bool
+	authLockout        *authLockout
+	dedupeRecipients   bool
+	rcptRewriter       *recipientRewriter
+	maxCommandRate     float64
+	quiet              bool
+	dsn                bool
+	dsnFrom            string
+	hostname           string
+	successLogSample   uint64
+	successes          atomic.Uint64
+	suppression        *suppression.List
+	bounceQueue        *sqs.Client
+	mailbox            *mailbox.Mailbox
+	events             *events.Publisher
+	users              map[string]*tenant
+	recipientRoutes    map[string]*recipientRoute
+	senderConfigSets   map[string]string
+	missingConfigSets  *missingConfigSets
+	debugDumper        *debugDumper
+	mirror             *mirror
+	configSetFallback  bool
+	userSessions       *userSessions
+	metrics            *metrics
+	recentErrors       *recentErrors
+	throughput         *rateTracker
+	dailyCount         *dailyCounter
+	stats              *stats
+}
+
+// authMechs returns the SASL mechanisms offered to clients. Password
+// mechanisms aren't offered when only tokens can be verified, since any
+// password would be accepted, and only the permitted mechanisms are offered.
+func (b *Backend) authMechs() []string {
+	var mechs []string
+	if b.authenticator != nil || b.tokenValidator == nil {
+		mechs = append(mechs, sasl.Plain, sasl.Login)
+	}
+	if b.tokenValidator != nil {
+		mechs = append(mechs, sasl.OAuthBearer, xoauth2)
+	}
+	if b.authMechanisms != nil {
+		mechs = slices.DeleteFunc(mechs, func(mech string) bool {
+			return !b.authMechanisms[mech]
+		})
+	}
+	return mechs
+}
+
+// countError records a failure to send a message
+func (b *Backend) countError(typ string) {
+	b.metrics.emailError.With(prometheus.Labels{"type": typ}).Inc()
+	b.stats.error(typ)
+}
+
+// logSuccess reports whether a successful send should be logged. In quiet mode
+// none are, otherwise one in every successLogSample sends is logged.
+func (b *Backend) logSuccess() bool {
+	if b.quiet {
+		return false
+	}
+	if b.successLogSample <= 1 {
+		return true
+	}
+	return (b.successes.Add(1)-1)%b.successLogSample == 0
+}
+
+// messagePriority returns "high", "normal" or "low" based on the X-Priority
+// or Importance header of the message, or an empty string if the message
+// doesn't indicate a priority.
+func messagePriority(h mail.Header) string {
+	if p := strings.TrimSpace(h.Get("X-Priority")); p != "" {
+		switch p[0] {
+		case '1', '2':
+			return "high"
+		case '3':
+			return "normal"
+		case '4', '5':
+			return "low"
+		}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(h.Get("Importance"))) {
+	case "high":
+		return "high"
+	case "normal":
+		return "normal"
+	case "low":
+		return "low"
+	}
+
+	return ""
+}
+
+// configSetFor returns the configuration set a message should be sent with
+// along with its priority, if it has one. defaultSet is used for messages
+// whose priority isn't routed.
+func (b *Backend) configSetFor(data []byte, defaultSet *string) (*string, string) {
+	if len(b.priorityConfigSets) == 0 {
+		return defaultSet, ""
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return defaultSet, ""
+	}
+
+	priority := messagePriority(msg.Header)
+	if cs, ok := b.priorityConfigSets[priority]; ok {
+		return &cs, priority
+	}
+
+	return defaultSet, priority
+}
+
+// NewSession implements smtp.Backend
+func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	b.stats.sessionStarted()
+	s := &Session{
+		backend: b,
+		conn:    c,
+	}
+	if b.maxCommandRate > 0 {
+		s.cmdLimiter = rate.NewLimiter(rate.Limit(b.maxCommandRate), burstFor(b.maxCommandRate))
+	}
+	return s, nil
+}
+
+// maxReusedBuffer is the largest message buffer a session keeps to reuse for
+// its next message, larger buffers are released after each message
+const maxReusedBuffer = 1 << 20
+
+// Session implements smtp.Session
+type Session struct {
+	backend    *Backend
+	conn       *smtp.Conn
+	username   string
+	tenant     *tenant
+	helo       string
+	body       smtp.BodyType
+	utf8       bool
+	size       int64
+	from       string
+	nullSender bool
+	envID      string
+	dsnReturn  smtp.DSNReturn
+	recipients []string
+	rcptDSN    map[string]*smtp.RcptOptions
+	data       []byte
+	buf        bytes.Buffer
+	trace      debugTrace
+	errDetail  string
+	dataDone   bool
+	certAuth   bool
+	cmdLimiter *rate.Limiter
+
+	// dataMu is held while a message is read and sent. With BDAT go-smtp
+	// reads the message in another goroutine, and if the client aborts the
+	// transfer the session is reset while that goroutine may still run.
+	dataMu sync.Mutex
+}
+
+// AuthMechanisms implements smtp.AuthSession
+func (s *Session) AuthMechanisms() []string {
+	return s.backend.authMechs()
+}
+
+// Auth implements smtp.AuthSession
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	s.throttle()
+	if err := s.certificateLogin(); err != nil {
+		return nil, err
+	}
+	if s.certAuth {
+		return nil, &smtp.SMTPError{
+			Code:         503,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+			Message:      "Already authenticated with a client certificate",
+		}
+	}
+	if !slices.Contains(s.AuthMechanisms(), mech) {
+		return nil, smtp.ErrAuthUnknownMechanism
+	}
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			return s.AuthPlain(username, password)
+		}), nil
+	case sasl.Login:
+		return &loginServer{authenticate: s.AuthLogin}, nil
+	case sasl.OAuthBearer:
+		return newOAuthBearerServer(s.authenticateToken), nil
+	case xoauth2:
+		return &xoauth2Server{authenticate: s.authenticateToken}, nil
+	}
+
+	return nil, smtp.ErrAuthUnknownMechanism
+}
+
+// AuthPlain verifies the credentials with the configured authenticator, if
+// any, and records the user for the session so that their settings apply to
+// the messages they send
+func (s *Session) AuthPlain(username, password string) error {
+	return s.authenticate(username, password)
+}
+
+// AuthLogin is AuthPlain for the LOGIN mechanism
+func (s *Session) AuthLogin(username, password string) error {
+	return s.authenticate(username, password)
+}
+
+func (s *Session) authenticate(username, password string) error {
+	if s.backend.authenticator == nil {
+		return s.login(username, false)
+	}
+
+	return s.verify(username, func() (string, error) {
+		return s.backend.authenticator.Authenticate(username, password)
+	})
+}
+
+// authenticateToken verifies an OAuth access token with the configured
+// validator. The user named by the client, if any, must be the identity the
+// token was issued to.
+func (s *Session) authenticateToken(username, token string) error {
+	return s.verify(username, func() (string, error) {
+		identity, err := s.backend.tokenValidator.Validate(token)
+		if err == nil && username != "" && !strings.EqualFold(username, identity) {
+			err = ErrInvalidCredentials
+		}
+		return identity, err
+	})
+}
+
+// verify logs the session in as the identity returned by check, which
+// verifies the credentials of username, unless the client or user is locked
+// out after too many failures
+func (s *Session) verify(username string, check func() (string, error)) error {
+	addr := s.conn.Conn().RemoteAddr()
+	if s.backend.authLockout != nil {
+		if d := s.backend.authLockout.locked(addr, username); d > 0 {
+			log.Printf("Refusing authentication of user %s from %s, locked out for %s after failed attempts", username, addr, d.Round(time.Second))
+			authErr := &smtp.SMTPError{
+				Code:         454,
+				EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+				Message:      "Too many failed authentication attempts, please try again later",
+			}
+			s.recordError("AUTH", authErr.Code, authErr.Message)
+			return authErr
+		}
+	}
+
+	identity, err := check()
+	switch {
+	case err == nil:
+		s.backend.metrics.authAttempts.With(prometheus.Labels{"result": "success"}).Inc()
+		if s.backend.authLockout != nil {
+			s.backend.authLockout.succeed(addr, username)
+		}
+		return s.login(identity, true)
+	case errors.Is(err, ErrInvalidCredentials):
+		s.backend.metrics.authAttempts.With(prometheus.Labels{"result": "invalid"}).Inc()
+		if s.backend.authLockout != nil {
+			s.backend.authLockout.fail(addr, username)
+		}
+		log.Printf("Authentication failed for user %s from %s", username, addr)
+		s.recordError("AUTH", smtp.ErrAuthFailed.Code, smtp.ErrAuthFailed.Message)
+		return smtp.ErrAuthFailed
+	default:
+		s.backend.metrics.authAttempts.With(prometheus.Labels{"result": "error"}).Inc()
+		log.Printf("Error authenticating user %s: %s", username, err)
+		authErr := &smtp.SMTPError{
+			Code:         454,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Temporary authentication failure",
+		}
+		s.errDetail = err.Error()
+		s.recordError("AUTH", authErr.Code, authErr.Message)
+		s.errDetail = ""
+		return authErr
+	}
+}
+
+// certificateLogin authenticates the session as the identity of the client
+// certificate, if the client presented a verified one when starting TLS and
+// the session isn't authenticated yet
+func (s *Session) certificateLogin() error {
+	if s.username != "" {
+		return nil
+	}
+
+	state, ok := s.conn.TLSConnectionState()
+	if !ok || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+
+	identity := certIdentity(state.VerifiedChains[0][0])
+	if identity == "" {
+		return nil
+	}
+	if err := s.login(identity, true); err != nil {
+		return err
+	}
+	s.certAuth = true
+	s.backend.metrics.certLogins.With(prometheus.Labels{"identity": s.backend.userSessions.label(identity)}).Inc()
+	log.Printf("Authenticated %s from %s with a client certificate", identity, s.conn.Conn().RemoteAddr())
+	return nil
+}
+
+// login makes the session authenticated as user if the user hasn't reached
+// their limit of concurrent sessions. Only users whose credentials were
+// verified get their per-user settings, so that clients can't claim the
+// settings of another user when no authenticator checks passwords.
+func (s *Session) login(user string, verified bool) error {
+	if !s.backend.userSessions.acquire(user) {
+		log.Printf("Rejecting authentication of user %s from %s: too many concurrent sessions", user, s.conn.Conn().RemoteAddr())
+		s.backend.metrics.userSessionsRejected.Inc()
+		authErr := &smtp.SMTPError{
+			Code:         454,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Too many concurrent sessions for user, please try again later",
+		}
+		s.recordError("AUTH", authErr.Code, authErr.Message)
+		return authErr
+	}
+
+	s.username = user
+	s.tenant = nil
+	if verified {
+		s.tenant = s.backend.users[user]
+	}
+	return nil
+}
+
+// Mail implements smtp.Session
+func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
+	s.throttle()
+	return s.recordResponse("MAIL", s.handleMail(from, opts), 451)
+}
+
+// Rcpt implements smtp.Session
+func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.throttle()
+	return s.recordResponse("RCPT", s.handleRcpt(to, opts), 451)
+}
+
+// Data implements smtp.Session
+func (s *Session) Data(r io.Reader) error {
+	s.dataMu.Lock()
+	defer s.dataMu.Unlock()
+
+	s.dataDone = true
+	s.trace = debugTrace{start: time.Now()}
+	err := s.handleData(r)
+	if errors.Is(err, smtp.ErrDataReset) {
+		// The client aborted a BDAT transfer, which go-smtp has already
+		// answered, so there is no reply to record
+		s.dataDone = false
+		return err
+	}
+	if d := s.backend.debugDumper; d != nil && err != nil {
+		if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code >= 400 {
+			d.dump(s, err)
+		}
+	}
+	return s.recordResponse("DATA", err, 554)
+}
+
+// throttle delays the current command if the client is sending commands
+// faster than the configured command rate, which slows down clients stuck in
+// a loop of RSET or RCPT commands without affecting well behaved ones
+func (s *Session) throttle() {
+	if s.cmdLimiter == nil {
+		return
+	}
+
+	if d := s.cmdLimiter.Reserve().Delay(); d > 0 {
+		s.backend.metrics.commandsThrottled.Inc()
+		time.Sleep(d)
+	}
+}
+
+// recordResponse counts the reply code the client receives for the result of
+// a command and, if enabled, records failures in the recent errors. Errors
+// that aren't an *smtp.SMTPError are reported by go-smtp with defaultCode.
+func (s *Session) recordResponse(cmd string, err error, defaultCode int) error {
+	code := 250
+	reply := ""
+	if err != nil {
+		code = defaultCode
+		reply = err.Error()
+		if smtpErr, ok := err.(*smtp.SMTPError); ok {
+			code = smtpErr.Code
+			reply = smtpErr.Message
+		}
+	}
+
+	s.backend.metrics.smtpResponse.With(prometheus.Labels{"code": strconv.Itoa(code)}).Inc()
+
+	if code >= 400 {
+		s.recordError(cmd, code, reply)
+	}
+	s.errDetail = ""
+
+	return err
+}
+
+// recordError adds a failed command to the recent errors, if enabled
+func (s *Session) recordError(cmd string, code int, reply string) {
+	if s.backend.recentErrors != nil {
+		s.backend.recentErrors.add(ErrorRecord{
+			Time:       time.Now(),
+			Command:    cmd,
+			Code:       code,
+			Reply:      redactAddresses(reply),
+			Detail:     redactAddresses(s.errDetail),
+			Client:     s.conn.Conn().RemoteAddr().String(),
+			Helo:       s.helo,
+			User:       s.username,
+			From:       redactAddresses(s.from),
+			Recipients: len(s.recipients),
+		})
+	}
+}
+
+func (s *Session) handleMail(from string, opts *smtp.MailOptions) error {
+	if s.helo == "" {
+		s.helo = s.conn.Hostname()
+		s.backend.metrics.clientHelo.With(prometheus.Labels{"kind": heloKind(s.helo)}).Inc()
+	}
+
+	if _, isTLS := s.conn.TLSConnectionState(); s.backend.requireTLS && !isTLS {
+		return &smtp.SMTPError{
+			Code:         530,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+			Message:      "Must issue a STARTTLS command first",
+		}
+	}
+
+	if err := s.certificateLogin(); err != nil {
+		return err
+	}
+
+	if s.backend.requireAuth && s.username == "" {
+		return &smtp.SMTPError{
+			Code:         530,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+			Message:      "Authentication required",
+		}
+	}
+
+	from, err := asciiAddress(from, opts != nil && opts.UTF8, smtp.EnhancedCode{5, 1, 7})
+	if err != nil {
+		return err
+	}
+
+	// SES needs a sender, so the null sender used for bounces is either
+	// replaced or rejected
+	if from == "" {
+		if s.backend.nullSenderRewrite == "" {
+			s.backend.countError("null sender")
+			return &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      "Error: the null sender <> is not accepted, SES requires a sender address",
+			}
+		}
+		from = s.backend.nullSenderRewrite
+		s.nullSender = true
+	}
+
+	if s.backend.allowedSenders != nil && !s.backend.allowedSenders[addressDomain(from)] {
+		err := s.enforcePolicy("sender-domain", &smtp.SMTPError{
+			Code:         553,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("Error: sending from <%s> is not allowed", from),
+		})
+		if err != nil {
+			s.backend.countError("sender domain not allowed")
+			return err
+		}
+	}
+
+	client := s.sesClient()
+	if v := s.backend.verifiedSenders[client]; v != nil && (s.tenant == nil || !s.tenant.hasArns()) && !v.allows(from) {
+		err := s.enforcePolicy("verified-sender", &smtp.SMTPError{
+			Code:         553,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message: fmt.Sprintf("Error: sender <%s> is not a verified identity in SES region %s",
+				from, client.Options().Region),
+		})
+		if err != nil {
+			s.backend.countError("sender not verified")
+			return err
+		}
+	}
+
+	if s.tenant != nil && !s.tenant.allowsFrom(from) {
+		err := s.enforcePolicy("user-from-domain", &smtp.SMTPError{
+			Code:         553,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("Error: user %s may not send from <%s>", s.username, from),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	s.from = from
+	if opts != nil {
+		s.body = opts.Body
+		s.size = opts.Size
+		s.utf8 = opts.UTF8
+		s.envID = opts.EnvelopeID
+		s.dsnReturn = opts.Return
+	}
+	return nil
+}
+
+func (s *Session) handleRcpt(to string, opts *smtp.RcptOptions) error {
+	to, err := asciiAddress(to, s.utf8, smtp.EnhancedCode{5, 1, 3})
+	if err != nil {
+		return err
+	}
+
+	if s.backend.rcptRewriter != nil {
+		rewritten, err := s.backend.rcptRewriter.rewrite(to)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			s.backend.countError("recipient rewrite failed")
+			return &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+				Message:      fmt.Sprintf("Error: recipient <%s> is rewritten to an invalid address", to),
+			}
+		}
+		if rewritten != to {
+			log.Printf("rewriting recipient %s of message from %s to %s", to, s.from, rewritten)
+			s.backend.metrics.recipientsRewritten.Inc()
+			to = rewritten
+		}
+	}
+
+	if err := s.checkRecipientDomain(to); err != nil {
+		return err
+	}
+
+	if err := s.checkRoutedSender(to); err != nil {
+		return err
+	}
+
+	if s.backend.suppression != nil && s.backend.suppression.Contains(to) {
+		err := s.enforcePolicy("suppressed-recipient", &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      fmt.Sprintf("Error: recipient <%s> is suppressed due to a recent bounce", to),
+		})
+		if err != nil {
+			log.Printf("rejecting locally suppressed recipient %s", to)
+			s.backend.suppression.Dropped()
+			return err
+		}
+	}
+
+	if s.backend.dedupeRecipients {
+		for _, r := range s.recipients {
+			if strings.EqualFold(strings.TrimSpace(r), strings.TrimSpace(to)) {
+				s.backend.metrics.duplicateRecipients.Inc()
+				return nil
+			}
+		}
+	}
+
+	s.recipients = append(s.recipients, to)
+	if opts != nil && (len(opts.Notify) > 0 || opts.OriginalRecipient != "") {
+		if s.rcptDSN == nil {
+			s.rcptDSN = map[string]*smtp.RcptOptions{}
+		}
+		s.rcptDSN[to] = opts
+	}
+	return nil
+}
+
+// checkRecipientDomain rejects recipients in denied domains or, if only
+// some domains are allowed, outside of them
+func (s *Session) checkRecipientDomain(to string) error {
+	if s.backend.allowedRcpts == nil && s.backend.deniedRcpts == nil {
+		return nil
+	}
+
+	domain := addressDomain(to)
+	policy, decision := "", "allowed"
+	if s.backend.deniedRcpts[domain] {
+		policy, decision = "recipient-denylist", "denied"
+	} else if s.backend.allowedRcpts != nil && !s.backend.allowedRcpts[domain] {
+		policy, decision = "recipient-allowlist", "not-allowed"
+	}
+	s.backend.metrics.recipientDomain.With(prometheus.Labels{"decision": decision}).Inc()
+	if policy == "" {
+		return nil
+	}
+
+	err := s.enforcePolicy(policy, &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      fmt.Sprintf("Error: sending to <%s> is not allowed", to),
+	})
+	if err != nil {
+		log.Printf("rejecting recipient %s of message from %s: domain %s", to, s.from, decision)
+		s.backend.countError("recipient domain " + decision)
+	}
+	return err
+}
+
+// checkRoutedSender rejects recipients routed through another SES account in
+// which the sender isn't a verified identity. The sender was only checked
+// against the account of the session's own client at MAIL FROM.
+func (s *Session) checkRoutedSender(to string) error {
+	route := s.backend.recipientRoutes[addressDomain(to)]
+	if route == nil || route.sesClient == nil || s.tenant != nil && s.tenant.hasArns() {
+		return nil
+	}
+	if v := s.backend.verifiedSenders[route.sesClient]; v == nil || v.allows(s.from) {
+		return nil
+	}
+
+	err := s.enforcePolicy("verified-sender", &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message: fmt.Sprintf("Error: sender <%s> is not a verified identity in SES region %s of the route for <%s>",
+			s.from, route.sesClient.Options().Region, to),
+	})
+	if err != nil {
+		log.Printf("rejecting recipient %s of message from %s: sender not verified for route %s", to, s.from, route.name)
+		s.backend.countError("sender not verified")
+	}
+	return err
+}
+
+// sesClient returns the client the session's messages are sent with, unless
+// a recipient route has one of its own: the user's, if it has its own role,
+// otherwise the proxy's
+func (s *Session) sesClient() *ses.Client {
+	if s.tenant != nil && s.tenant.sesClient != nil {
+		return s.tenant.sesClient
+	}
+	return s.backend.sesClient
+}
+
+// destinations returns the addresses the message is sent to: the recipients
+// and the archive address, unless it is one of them already
+func (s *Session) destinations() []string {
+	archive := s.backend.archiveBcc
+	if archive == "" || slices.ContainsFunc(s.recipients, func(r string) bool { return strings.EqualFold(r, archive) }) {
+		return s.recipients
+	}
+	return append(slices.Clone(s.recipients), archive)
+}
+
+func (s *Session) handleData(r io.Reader) error {
+	if len(s.recipients) == 0 {
+		s.backend.countError("no valid recipients")
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+			Message:      "Error: no valid recipients",
+		}
+	}
+
+	if s.backend.breaker != nil && !s.backend.breaker.allow() {
+		s.backend.countError("circuit open")
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "SES is failing, sending is suspended. Please try again later",
+		}
+	}
+
+	if s.backend.dailyQuota != nil && !s.backend.dailyQuota.allow(len(s.destinations())) {
+		s.backend.countError("daily quota exhausted")
+		return &smtp.SMTPError{
+			Code:         452,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+			Message:      "Insufficient system storage, the SES daily sending quota is used up. Please try again later",
+		}
+	}
+
+	if s.backend.sendLimiter != nil && !s.backend.sendLimiter.Allow() {
+		s.backend.countError("rate limited")
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 4, 5},
+			Message:      "Send rate limit exceeded. Please try again later",
+		}
+	}
+
+	if s.tenant != nil && s.tenant.sendLimiter != nil && !s.tenant.sendLimiter.Allow() {
+		s.backend.countError("user rate limited")
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 4, 5},
+			Message:      "User send rate limit exceeded. Please try again later",
+		}
+	}
+
+	// Bound the time the whole DATA phase may take so that clients trickling
+	// the body can't hold the connection open indefinitely. The deadline is
+	// left in place if it expires so the connection is dropped.
+	if d := s.backend.dataReadTimeout; d > 0 {
+		s.conn.Conn().SetReadDeadline(time.Now().Add(d))
+	} else if s.backend.readTimeout > 0 {
+		// go-smtp leaves the deadline of the DATA command in place, which
+		// would limit the whole body to the command read timeout
+		s.conn.Conn().SetReadDeadline(time.Time{})
+	}
+
+	// Read message data with size limit
+	data, err := s.backend.readMessage(r, &s.buf)
+	s.trace.raw = data
+	s.trace.received = time.Since(s.trace.start)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		log.Printf("timed out reading message data from %s after %s", s.conn.Conn().RemoteAddr(), s.backend.dataReadTimeout)
+		s.backend.countError("data timeout")
+		s.backend.metrics.dataTimeout.Inc()
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 4, 2},
+			Message:      "Timeout reading message data",
+		}
+	}
+	if s.backend.dataReadTimeout > 0 {
+		s.conn.Conn().SetReadDeadline(time.Time{})
+	}
+	if errors.Is(err, smtp.ErrDataTooLarge) || err == nil && int64(len(data)) > s.backend.maxMessageSize {
+		s.backend.countError("minimum message size exceed")
+		log.Printf("message size exceeds limit of %d", s.backend.maxMessageSize)
+		s.drainOversize()
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+			Message:      "Error: maximum message size exceeded",
+		}
+	}
+	if errors.Is(err, smtp.ErrDataReset) {
+		return err
+	}
+	if errors.Is(err, smtp.ErrTooLongLine) {
+		// go-smtp closes the connection after this reply
+		s.backend.countError("line too long")
+		return &smtp.SMTPError{
+			Code:         500,
+			EnhancedCode: smtp.EnhancedCode{5, 4, 0},
+			Message:      fmt.Sprintf("Error: message contains a line longer than %d characters", s.conn.Server().MaxLineLength),
+		}
+	}
+	if errors.Is(err, errSpoolFull) {
+		log.Printf("ERROR: spool directory has less than %d bytes free, deferring message from %s", s.backend.spoolMinFree, s.from)
+		s.backend.countError("spool full")
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+			Message:      "Insufficient system storage. Please try again later",
+		}
+	}
+	if errors.Is(err, errSpool) {
+		log.Printf("ERROR: unable to spool message from %s: %v", s.from, err)
+		s.backend.countError("spool error")
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Temporary local problem. Please try again later",
+		}
+	}
+	if err != nil {
+		s.backend.countError("read error")
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 4, 2},
+			Message:      "Temporary server error reading message",
+		}
+	}
+
+	// SIZE is an estimate that counts dot-stuffing, so allow the message to
+	// be slightly smaller. Much less than declared means the transfer was
+	// cut short without the reader reporting an error.
+	if s.backend.verifyDeclaredSize && s.size > 0 && int64(len(data)) < s.size-s.size/100 {
+		log.Printf("message from %s is %d bytes but %d were declared, it may have been truncated", s.from, len(data), s.size)
+		s.backend.countError("size mismatch")
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 4, 2},
+			Message:      "Message is shorter than its declared SIZE. Please try again",
+		}
+	}
+
+	// go-smtp passes BDAT transfers, which aren't dot-stuffed, through a pipe
+	if s.backend.normalizeLines {
+		_, chunked := r.(*io.PipeReader)
+		if normalized, fixed := normalizeLineEndings(data, !chunked); fixed {
+			log.Printf("message from %s has bare line endings, converting them to CRLF", s.from)
+			s.backend.metrics.lineEndingsFixed.Inc()
+			data = normalized
+		}
+	}
+
+	// Add the From header before the policy checks so that they see the
+	// message as it will be sent
+	if from := s.backend.defaultFrom; from != "" {
+		if from == "envelope" {
+			from = s.from
+		}
+		if from != "" {
+			withFrom, added, parseErr := addMissingFrom(data, from)
+			if parseErr != nil {
+				if err := s.parseFailed("default-from", parseErr); err != nil {
+					return err
+				}
+			} else if added {
+				log.Printf("message from %s has no From header, adding %s", s.from, from)
+				s.backend.metrics.fromHeadersAdded.Inc()
+				data = withFrom
+			}
+		}
+	}
+
+	if addr := s.backend.rewriteFrom; addr != "" {
+		rewritten, replaced, parseErr := forceFrom(data, addr, s.backend.keepFromDomains)
+		if parseErr != nil {
+			if err := s.parseFailed("rewrite-from", parseErr); err != nil {
+				return err
+			}
+		} else if replaced {
+			log.Printf("message from %s has a From header outside the kept domains, rewriting it to %s", s.from, addr)
+			s.backend.metrics.fromHeadersRewritten.Inc()
+			data = rewritten
+		}
+	}
+
+	if max := s.backend.maxMimeDepth; max > 0 {
+		err := checkMimeDepth(data, max)
+		if errors.Is(err, errMimeTooDeep) {
+			err := s.enforcePolicy("mime-depth", &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+				Message:      fmt.Sprintf("Error: MIME structure nested deeper than %d levels", max),
+			})
+			if err != nil {
+				s.backend.countError("mime too deep")
+				return err
+			}
+		} else if err != nil {
+			if err := s.parseFailed("mime-depth", err); err != nil {
+				return err
+			}
+		}
+	}
+
+	if skew := s.backend.maxDateSkew; skew > 0 {
+		if dateErr := checkDate(data, skew, time.Now()); dateErr != nil {
+			err := s.enforcePolicy("date", &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+				Message:      "Error: " + dateErr.Error(),
+			})
+			if err != nil {
+				s.backend.countError("bad date")
+				return err
+			}
+		}
+	}
+
+	if mode := s.backend.dmarcAlignment; mode != "" {
+		alignErr := checkAlignment(data, s.from, mode == "strict")
+		if alignErr != nil && s.backend.rewriteMisaligned {
+			// Messages without a From header to replace are still rejected
+			if rewritten, replaced, _ := forceFrom(data, s.from, nil); replaced {
+				log.Printf("message from %s is not aligned, rewriting its From header: %v", s.from, alignErr)
+				s.backend.metrics.policyDecision.With(prometheus.Labels{"policy": "dmarc-alignment", "decision": "rewrite"}).Inc()
+				data, alignErr = rewritten, nil
+			}
+		}
+		if alignErr != nil {
+			err := s.enforcePolicy("dmarc-alignment", &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      "Error: " + alignErr.Error(),
+			})
+			if err != nil {
+				s.backend.countError("not aligned")
+				return err
+			}
+		}
+	}
+
+	if len(s.backend.contentDenylist) > 0 {
+		if p := matchContent(s.backend.contentDenylist, data, s.backend.contentScanLimit); p != nil {
+			s.backend.metrics.contentDenied.With(prometheus.Labels{"pattern": p.Name}).Inc()
+			err := s.enforcePolicy("content-denylist", &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message:      "Error: message content rejected by policy",
+			})
+			if err != nil {
+				log.Printf("rejecting message from %s: matched content pattern %s", s.from, p.Name)
+				s.errDetail = "matched content pattern " + p.Name
+				s.backend.countError("content denied")
+				return err
+			}
+		}
+	}
+
+	// SMTPUTF8 declares UTF-8 headers, and implies 8BITMIME for the body
+	declared8bit := s.body == smtp.Body8BitMIME || s.body == smtp.BodyBinaryMIME || s.utf8
+	if s.backend.undeclared8bit != "pass" && !declared8bit && has8bit(data) {
+		switch s.backend.undeclared8bit {
+		case "reject":
+			err := s.enforcePolicy("undeclared-8bit", &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 6, 3},
+				Message:      "Error: message contains 8-bit data but BODY=8BITMIME was not declared",
+			})
+			if err != nil {
+				s.backend.countError("undeclared 8bit")
+				return err
+			}
+		case "encode":
+			encoded, err := encode8bit(data)
+			if err != nil {
+				if err := s.parseFailed("encode-8bit", err); err != nil {
+					return err
+				}
+			} else {
+				data = encoded
+				s.backend.metrics.reencoded8bit.With(prometheus.Labels{"reason": "undeclared"}).Inc()
+			}
+		}
+	}
+	if s.backend.declared8bit == "encode" && declared8bit && has8bit(data) {
+		encoded, err := encode8bit(data)
+		if err != nil {
+			if err := s.parseFailed("encode-8bit", err); err != nil {
+				return err
+			}
+		} else {
+			data = encoded
+			s.backend.metrics.reencoded8bit.With(prometheus.Labels{"reason": "declared"}).Inc()
+		}
+	}
+
+	if s.backend.longLines != "pass" && hasLongLine(data) {
+		switch s.backend.longLines {
+		case "reject":
+			err := s.enforcePolicy("long-lines", &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+				Message:      fmt.Sprintf("Error: message contains lines longer than %d characters", maxLineLength),
+			})
+			if err != nil {
+				s.backend.countError("long lines")
+				return err
+			}
+		case "fold":
+			folded, err := foldLongLines(data)
+			if err != nil {
+				if err := s.parseFailed("fold-long-lines", err); err != nil {
+					return err
+				}
+			} else {
+				data = folded
+				s.backend.metrics.longLinesFolded.Inc()
+			}
+		}
+	}
+
+	// Bcc recipients are already in the envelope so the header is only
+	// needed by the client, sent on it would show them to every recipient
+	if s.backend.stripBcc {
+		rawHeader, body, _ := splitEntity(data)
+		if stripped := removeHeader(rawHeader, "Bcc"); len(stripped) != len(rawHeader) {
+			data = append(stripped, body...)
+			s.backend.metrics.bccHeadersStripped.Inc()
+		}
+	}
+
+	for _, t := range s.backend.transforms {
+		data, err = t.Transform(data)
+		if err != nil {
+			log.Printf("ERROR: unable to transform message from %s: %v", s.from, err)
+			s.backend.countError("transform error")
+			return &smtp.SMTPError{
+				Code:         451,
+				EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+				Message:      "Temporary local problem. Please try again later",
+			}
+		}
+	}
+
+	arns := s.backend.arns
+	if s.tenant != nil {
+		arns = arns.override(s.tenant.arns)
+	}
+	if s.backend.arnHeaders {
+		msgArns, stripped, parseErr := messageArns(data)
+		if parseErr != nil {
+			if err := s.parseFailed("arn-headers", parseErr); err != nil {
+				return err
+			}
+		} else {
+			arns = arns.override(msgArns)
+			data = stripped
+		}
+	}
+
+	tags := s.backend.messageTags
+	msgTags, untagged, tagErr := messageTags(data)
+	switch {
+	case errors.Is(tagErr, errInvalidTag):
+		s.errDetail = tagErr.Error()
+		s.backend.countError("invalid message tags")
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      fmt.Sprintf("Error: %s header: %v", messageTagsHeader, tagErr),
+		}
+	case tagErr != nil:
+		if err := s.parseFailed("message-tags", tagErr); err != nil {
+			return err
+		}
+	case msgTags != nil:
+		tags = maps.Clone(tags)
+		if tags == nil {
+			tags = map[string]string{}
+		}
+		maps.Copy(tags, msgTags)
+		data = untagged
+	}
+	if len(tags) > maxMessageTags {
+		s.backend.countError("invalid message tags")
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      fmt.Sprintf("Error: message has more than %d message tags", maxMessageTags),
+		}
+	}
+
+	// A configuration set selected by the message replaces the one the
+	// proxy would choose for every recipient
+	var headerSet *string
+	name, unset, csErr := messageConfigSet(data)
+	switch {
+	case csErr != nil:
+		if err := s.parseFailed("config-set-header", csErr); err != nil {
+			return err
+		}
+	case name == "":
+		data = unset
+	case s.backend.allowedConfigSets != nil && !s.backend.allowedConfigSets[name]:
+		data = unset
+		if s.backend.disallowedSet == "default" {
+			log.Printf("configuration set %s selected by message from %s is not allowed, using the default", name, s.from)
+			break
+		}
+		err := s.enforcePolicy("config-set-allowlist", &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("Error: configuration set %s is not allowed", name),
+		})
+		if err != nil {
+			s.backend.countError("config set not allowed")
+			return err
+		}
+		headerSet = &name
+	default:
+		data = unset
+		headerSet = &name
+	}
+
+	s.data = data
+
+	defaultSet := s.backend.configSetName
+	defaultClient := s.sesClient()
+	if s.tenant != nil && s.tenant.configSet != nil {
+		defaultSet = s.tenant.configSet
+	}
+	if cs, ok := s.backend.senderConfigSets[addressDomain(s.from)]; ok {
+		defaultSet = &cs
+	}
+
+	// Recipients whose domains are routed differently are sent separately,
+	// as are groups of more recipients than SES accepts in one send. All of
+	// the sends are prepared, and rate limited, before any is made so that a
+	// message is only partly sent if SES itself fails.
+	type preparedSend struct {
+		route     string
+		client    *ses.Client
+		configSet *string
+		priority  string
+		input     *ses.SendRawEmailInput
+
+		// headerSet is set if the configuration set was selected by
+		// the message
+		headerSet bool
+	}
+	var sends []preparedSend
+	for _, g := range s.backend.groupRecipients(s.destinations()) {
+		p := preparedSend{route: "default", client: defaultClient}
+		groupSet := defaultSet
+		if g.route != nil {
+			p.route = g.route.name
+			if g.route.configSet != nil {
+				groupSet = g.route.configSet
+			}
+			if g.route.sesClient != nil {
+				p.client = g.route.sesClient
+			}
+		}
+		if headerSet != nil {
+			p.configSet, p.headerSet = headerSet, true
+		} else {
+			p.configSet, p.priority = s.backend.configSetFor(s.data, groupSet)
+		}
+
+		for chunk := range slices.Chunk(g.recipients, SesMaxDestinations) {
+			if s.backend.configSetLimiters != nil {
+				name := ""
+				if p.configSet != nil {
+					name = *p.configSet
+				}
+				name, ok := s.backend.configSetLimiters.Allow(name)
+				if !ok {
+					s.backend.countError("configuration set rate limited")
+					s.backend.metrics.configSetRateLimited.With(prometheus.Labels{"configuration_set": name}).Inc()
+					return &smtp.SMTPError{
+						Code:         451,
+						EnhancedCode: smtp.EnhancedCode{4, 4, 5},
+						Message:      "Configuration set send rate limit exceeded. Please try again later",
+					}
+				}
+			}
+
+			p.input = &ses.SendRawEmailInput{
+				ConfigurationSetName: p.configSet,
+				Source:               &s.from,
+				Destinations:         chunk,
+				RawMessage:           &types.RawMessage{Data: s.data},
+				SourceArn:            arns.source,
+				FromArn:              arns.from,
+				ReturnPathArn:        arns.returnPath,
+				Tags:                 sesTags(tags),
+			}
+			sends = append(sends, p)
+		}
+	}
+
+	// A failed send doesn't stop the others, so that as many recipients as
+	// possible get the message
+	var messageIDs, failed []string
+	var failure error
+	var reports []dsnReport
+	for _, p := range sends {
+		messageID, err := s.send(p.client, p.input)
+		// A configuration set selected by a message that doesn't exist
+		// is the client's mistake, not a problem with the proxy
+		if p.configSet != nil && !p.headerSet && s.backend.missingConfigSets.observe(*p.configSet, err) {
+			s.backend.metrics.configSetMissing.With(prometheus.Labels{"configuration_set": *p.configSet}).Inc()
+			if s.backend.configSetFallback {
+				log.Printf("configuration set %s is missing, sending message from %s without a configuration set", *p.configSet, s.from)
+				p.configSet = nil
+				p.input.ConfigurationSetName = nil
+				messageID, err = s.send(p.client, p.input)
+			}
+		}
+		if s.backend.declared8bit == "fallback" && isMessageRejected(err) && has8bit(s.data) {
+			// The rest of the sends use the encoded message too
+			if encoded, eerr := encode8bit(s.data); eerr == nil && !bytes.Equal(encoded, s.data) {
+				log.Printf("SES rejected 8-bit message from %s, retrying with 8-bit parts encoded: %v", s.from, err)
+				s.backend.metrics.reencoded8bit.With(prometheus.Labels{"reason": "rejected"}).Inc()
+				s.data = encoded
+				for _, q := range sends {
+					q.input.RawMessage.Data = encoded
+				}
+				messageID, err = s.send(p.client, p.input)
+			}
+		}
+		if err != nil {
+			reason, reply := classifySesError(err, s.from, p.input.Destinations, p.client.Options().Region)
+			if p.headerSet && reason == "configuration set missing" {
+				reply = &smtp.SMTPError{
+					Code:         550,
+					EnhancedCode: smtp.EnhancedCode{5, 3, 5},
+					Message:      fmt.Sprintf("Error: configuration set %s selected by the %s header does not exist", *p.configSet, configSetHeader),
+				}
+			}
+			if reason == reasonSandbox {
+				s.backend.metrics.sandboxRejected.Inc()
+			}
+			log.Printf("ERROR: ses: message from %s to %v failed (%s): %v", s.from, p.input.Destinations, reason, err)
+			if failure == nil {
+				failure = reply
+				s.errDetail = err.Error()
+			}
+			failed = append(failed, p.input.Destinations...)
+			if s.backend.dsn {
+				reports = s.addDSNReports(reports, p.input.Destinations, reply)
+			}
+			s.backend.countError(reason)
+			s.backend.metrics.sesError.Inc()
+			s.publishEvent(p.input, events.ResultFailed, reason, "")
+			continue
+		}
+		messageIDs = append(messageIDs, messageID)
+
+		// Log successful send
+		configSetInfo := "no config set"
+		if p.configSet != nil {
+			configSetInfo = fmt.Sprintf("config set: %s", *p.configSet)
+		}
+		if p.priority != "" {
+			configSetInfo += fmt.Sprintf(", priority: %s", p.priority)
+		}
+		if len(s.backend.recipientRoutes) > 0 {
+			configSetInfo += fmt.Sprintf(", route: %s", p.route)
+		}
+		if s.username != "" {
+			configSetInfo += fmt.Sprintf(", user: %s", s.username)
+		}
+		configSetInfo += fmt.Sprintf(", helo: %s, message id: %s", s.helo, messageID)
+		if s.backend.logSuccess() {
+			log.Printf("sending message from %s to %v (%s)", s.from, p.input.Destinations, configSetInfo)
+		}
+		s.backend.metrics.emailSent.Inc()
+		now := time.Now()
+		s.backend.throughput.record(now)
+		s.backend.dailyCount.record(now)
+		// Only the quota of the main client's account and region is polled,
+		// sends made with other clients count against their own quotas
+		if q := s.backend.dailyQuota; q != nil && p.client == s.backend.sesClient {
+			q.record(len(p.input.Destinations))
+		}
+		s.backend.stats.sent.Add(1)
+		s.publishEvent(p.input, events.ResultSent, "", messageID)
+		if s.backend.dsn {
+			reports = s.addDSNReports(reports, p.input.Destinations, nil)
+		}
+	}
+
+	if failure != nil {
+		if len(messageIDs) == 0 {
+			return failure
+		}
+
+		// Retrying would send the message again to the recipients it was
+		// sent to, so the failure is reported as permanent, or with DSN the
+		// message is accepted and the failures are reported to the sender
+		log.Printf("ERROR: message from %s was only partly sent, sent as %s but failed for %v", s.from, strings.Join(messageIDs, ", "), failed)
+		if !s.backend.dsn {
+			return &smtp.SMTPError{
+				Code:         554,
+				EnhancedCode: smtp.EnhancedCode{5, 0, 0},
+				Message:      fmt.Sprintf("Error: message was only partly sent, failed for %d of %d recipients", len(failed), len(s.recipients)),
+			}
+		}
+	}
+
+	s.sendDSN(defaultClient, defaultSet, reports)
+
+	if m := s.backend.mirror; m != nil && m.sample() && failure == nil {
+		inputs := make([]*ses.SendRawEmailInput, len(sends))
+		for i, p := range sends {
+			inputs[i] = p.input
+		}
+		m.send(inputs)
+	}
+
+	return &smtp.SMTPError{
+		Code:         250,
+		EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+		Message:      "OK: queued as " + strings.Join(messageIDs, ", "),
+	}
+}
+
+// sendOnce makes a single attempt to send input with SES, once a send worker
+// is free
+func (s *Session) sendOnce(client *ses.Client, input *ses.SendRawEmailInput) (*ses.SendRawEmailOutput, error) {
+	if p := s.backend.sendPool; p != nil {
+		p.acquire(s.sendPriority())
+		defer p.release()
+	}
+	return sendRawEmail(context.TODO(), client, input, s.backend.sesV2)
+}
+
+// sendPriority returns the priority with which the sends of the current
+// message wait for a send worker: the user's, if one is configured, otherwise
+// the one its header indicates or "normal"
+func (s *Session) sendPriority() string {
+	if s.tenant != nil && s.tenant.sendPriority != "" {
+		return s.tenant.sendPriority
+	}
+	if msg, err := mail.ReadMessage(bytes.NewReader(s.data)); err == nil {
+		if priority := messagePriority(msg.Header); priority != "" {
+			return priority
+		}
+	}
+	return "normal"
+}
+
+// send sends a message with SES or, in test receiver mode, stores it in the
+// mailbox instead, and returns the ID of the message
+func (s *Session) send(client *ses.Client, input *ses.SendRawEmailInput) (string, error) {
+	if s.backend.mailbox != nil {
+		return s.backend.mailbox.Add(*input.Source, input.Destinations, aws.ToString(input.ConfigurationSetName), input.RawMessage.Data), nil
+	}
+
+	start := time.Now()
+	out, err := s.sendOnce(client, input)
+	for attempt := 1; err != nil && attempt <= s.backend.sendRetries; attempt++ {
+		reason := retryableSesError(err)
+		if reason == "" {
+			break
+		}
+		delay := retryDelay(s.backend.sendRetryDelay, attempt)
+		log.Printf("SES send from %s failed (%s, attempt %d), retrying in %s: %v", s.from, reason, attempt, delay, err)
+		s.backend.metrics.sendRetries.With(prometheus.Labels{"reason": reason}).Inc()
+		time.Sleep(delay)
+		out, err = s.sendOnce(client, input)
+	}
+	if b := s.backend.breaker; b != nil {
+		b.record(err != nil && isTemporarySesError(err))
+	}
+
+	if s.backend.debugDumper != nil {
+		sent := debugSend{
+			ConfigurationSet: aws.ToString(input.ConfigurationSetName),
+			Recipients:       input.Destinations,
+			Duration:         time.Since(start).String(),
+		}
+		if err != nil {
+			sent.Error = err.Error()
+		} else {
+			sent.MessageID = aws.ToString(out.MessageId)
+		}
+		s.trace.sends = append(s.trace.sends, sent)
+	}
+
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(out.MessageId), nil
+}
+
+// publishEvent publishes the outcome of sending input, if delivery events are
+// enabled
+func (s *Session) publishEvent(input *ses.SendRawEmailInput, result, reason, messageID string) {
+	if s.backend.events == nil {
+		return
+	}
+
+	s.backend.events.Publish(&events.Event{
+		Time:             time.Now(),
+		Result:           result,
+		Reason:           reason,
+		MessageID:        messageID,
+		From:             s.from,
+		Recipients:       append([]string(nil), input.Destinations...),
+		ConfigurationSet: aws.ToString(input.ConfigurationSetName),
+		User:             s.username,
+		Client:           s.conn.Conn().RemoteAddr().String(),
+		Helo:             s.helo,
+		Size:             len(input.RawMessage.Data),
+	})
+}
+
+// heloKind classifies the name a client gave in HELO/EHLO into a small set of
+// buckets so it can be used as a metric label without unbounded cardinality
+func heloKind(helo string) string {
+	switch {
+	case helo == "":
+		return "none"
+	case strings.HasPrefix(helo, "["):
+		return "address-literal"
+	case net.ParseIP(helo) != nil:
+		return "bare-ip"
+	case strings.EqualFold(helo, "localhost") || strings.EqualFold(helo, "localhost.localdomain"):
+		return "localhost"
+	case !strings.Contains(helo, "."):
+		return "single-label"
+	default:
+		return "fqdn"
+	}
+}
+
+// drainOversize limits how much of the rest of an oversized message is read.
+// go-smtp discards the rest once the message is rejected so the client gets
+// a clean error response after it finishes sending rather than a reset
+// connection. If more than the configured drain limit remains the client is
+// most likely malicious and the connection is closed instead.
+func (s *Session) drainOversize() {
+	if s.backend.oversizeDrainLimit <= 0 {
+		return
+	}
+	if c := s.limitedConn(); c != nil {
+		c.limitReads(s.backend.oversizeDrainLimit)
+	}
+}
+
+// limitedConn returns the connection of the session as accepted from the
+// listener, beneath any TLS
+func (s *Session) limitedConn() *limitedConn {
+	c := s.conn.Conn()
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	lc, _ := c.(*limitedConn)
+	return lc
+}
+
+// enforcePolicy is called by policy checks that want to reject a message. In
+// audit mode the rejection is logged and counted as "would-reject" but nil is
+// returned so the message is still accepted and sent.
+func (s *Session) enforcePolicy(policy string, err *smtp.SMTPError) error {
+	if s.backend.policyAuditMode {
+		log.Printf("policy audit: %s would reject message from %s to %v (helo: %s): %s", policy, s.from, s.recipients, s.helo, err.Message)
+		s.backend.metrics.policyDecision.With(prometheus.Labels{"policy": policy, "decision": "would-reject"}).Inc()
+		return nil
+	}
+
+	s.backend.metrics.policyDecision.With(prometheus.Labels{"policy": policy, "decision": "reject"}).Inc()
+	return err
+}
+
+// parseFailed handles a message that feature needed to parse but couldn't.
+// The message is sent as it is unless the proxy is configured to reject
+// messages that fail to parse.
+func (s *Session) parseFailed(feature string, parseErr error) error {
+	s.backend.metrics.parseFailures.With(prometheus.Labels{"feature": feature}).Inc()
+	if !s.backend.rejectUnparseable {
+		log.Printf("unable to parse message from %s for %s, sending as is: %v", s.from, feature, parseErr)
+		return nil
+	}
+
+	err := s.enforcePolicy("parse-failure", &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+		Message:      "Error: message could not be parsed",
+	})
+	if err != nil {
+		log.Printf("rejecting message from %s: unable to parse it for %s: %v", s.from, feature, parseErr)
+		s.errDetail = fmt.Sprintf("%s: %v", feature, parseErr)
+		s.backend.countError("parse failure")
+	}
+	return err
+}
+
+// Reset implements smtp.Session
+//
+// The server resets the session after every message, when the client sends
+// RSET and when it greets the server again. Everything that describes the
+// current message must be cleared here so that it can't leak into the next
+// one; what the session learned about the client (HELO name, user) is kept.
+func (s *Session) Reset() {
+	s.throttle()
+
+	s.dataMu.Lock()
+	defer s.dataMu.Unlock()
+
+	kind := "idle"
+	if s.dataDone {
+		kind = "message"
+	} else if s.from != "" || len(s.recipients) > 0 {
+		kind = "aborted"
+	}
+	s.backend.metrics.resets.With(prometheus.Labels{"kind": kind}).Inc()
+
+	s.from = ""
+	s.nullSender = false
+	s.body = ""
+	s.utf8 = false
+	s.envID = ""
+	s.dsnReturn = ""
+	s.size = 0
+	s.data = nil
+	s.trace = debugTrace{}
+	s.errDetail = ""
+	s.dataDone = false
+	if c := s.limitedConn(); c != nil {
+		c.unlimitReads()
+	}
+
+	// Keep the memory of the recipients and message buffer for the next
+	// message in the session, unless the buffer grew too large to hold on to
+	clear(s.recipients)
+	s.recipients = s.recipients[:0]
+	clear(s.rcptDSN)
+	if s.buf.Cap() > maxReusedBuffer {
+		s.buf = bytes.Buffer{}
+	}
+}
+
+// Logout implements smtp.Session
+func (s *Session) Logout() error {
+	if s.username != "" {
+		s.backend.userSessions.release(s.username)
+	}
+	s.backend.stats.sessionEnded()
+	return nil
+}
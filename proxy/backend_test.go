@@ -0,0 +1,477 @@
+package proxy
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"code.crute.us/mcrute/ses-smtpd-proxy/mailbox"
+	"code.crute.us/mcrute/ses-smtpd-proxy/suppression"
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// countingReader is an endless reader of "x" that counts the bytes read
+type countingReader struct {
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	r.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestReadMessageStopsAtLimit(t *testing.T) {
+	b := &Backend{maxMessageSize: 1000}
+	r := &countingReader{}
+
+	var buf bytes.Buffer
+	data, err := b.readMessage(r, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 1001 {
+		t.Errorf("read %d bytes of message, want the limit plus one", len(data))
+	}
+	if r.n > 1001 {
+		t.Errorf("read %d bytes from the stream, want at most the limit plus one", r.n)
+	}
+}
+
+func TestDataOversize(t *testing.T) {
+	tests := []struct {
+		name     string
+		bodySize int
+		wantCode int
+	}{
+		{"within limit", 1000, 250},
+		{"just over limit", 4096, 554},
+		{"well over limit", 4 << 20, 554},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MaxMessageSize = 4096
+			_, addr := startServer(t, cfg)
+
+			c := dial(t, addr)
+			msg := message(strings.Repeat("x", 76)+"\r\n", "Subject: Big")
+			msg += strings.Repeat(strings.Repeat("x", 76)+"\r\n", tt.bodySize/78)
+			_, err := sendMessage(c, "sender@example.com", []string{"rcpt@example.com"}, msg)
+
+			code := 250
+			if err != nil {
+				code = replyCode(err)
+			}
+			if code != tt.wantCode {
+				t.Fatalf("DATA reply %d (%v), want %d", code, err, tt.wantCode)
+			}
+
+			// The rest of the message is drained, so the session goes
+			// on rather than being reset
+			if err := c.Noop(); err != nil {
+				t.Errorf("NOOP after DATA: %v", err)
+			}
+		})
+	}
+}
+
+func TestDataDeclaredSize(t *testing.T) {
+	msg := message(strings.Repeat(strings.Repeat("x", 98)+"\r\n", 100), "Subject: Sized")
+
+	tests := []struct {
+		name     string
+		verify   bool
+		declared int64
+		wantCode int
+	}{
+		{"not declared", true, 0, 250},
+		{"exact", true, int64(len(msg)), 250},
+		{"within tolerance", true, int64(len(msg)) * 100 / 99, 250},
+		{"truncated", true, int64(len(msg)) * 2, 451},
+		{"truncated without verification", false, int64(len(msg)) * 2, 250},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.VerifyDeclaredSize = tt.verify
+			_, addr := startServer(t, cfg)
+
+			c := dial(t, addr)
+			if err := c.Mail("sender@example.com", &smtp.MailOptions{Size: tt.declared}); err != nil {
+				t.Fatalf("MAIL: %v", err)
+			}
+			if err := c.Rcpt("rcpt@example.com", nil); err != nil {
+				t.Fatalf("RCPT: %v", err)
+			}
+			w, err := c.Data()
+			if err != nil {
+				t.Fatalf("DATA: %v", err)
+			}
+			w.Write([]byte(msg))
+			_, err = w.CloseWithResponse()
+
+			code := 250
+			if err != nil {
+				code = replyCode(err)
+			}
+			if code != tt.wantCode {
+				t.Errorf("DATA reply %d (%v), want %d", code, err, tt.wantCode)
+			}
+			if n := len(cfg.Mailbox.List()); (n == 1) != (tt.wantCode == 250) {
+				t.Errorf("delivered %d messages", n)
+			}
+		})
+	}
+}
+
+func TestDuplicateRecipients(t *testing.T) {
+	tests := []struct {
+		name           string
+		dedupe         bool
+		rcpts          []string
+		wantTo         []string
+		wantDuplicates float64
+	}{
+		{"distinct", true, []string{"a@example.com", "b@example.com"}, []string{"a@example.com", "b@example.com"}, 0},
+		{"repeated", true, []string{"a@example.com", "a@example.com"}, []string{"a@example.com"}, 1},
+		{
+			"varying case",
+			true,
+			[]string{"Alice@Example.com", "alice@example.com", "b@example.com", "ALICE@EXAMPLE.COM"},
+			[]string{"Alice@Example.com", "b@example.com"},
+			2,
+		},
+		{"disabled", false, []string{"a@example.com", "A@example.com"}, []string{"a@example.com", "A@example.com"}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DedupeRecipients = tt.dedupe
+			_, addr := startServer(t, cfg)
+
+			c := dial(t, addr)
+			if _, err := sendMessage(c, "sender@example.com", tt.rcpts, message("Hello", "Subject: Test")); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+
+			msgs := cfg.Mailbox.List()
+			if len(msgs) != 1 {
+				t.Fatalf("delivered %d messages, want 1", len(msgs))
+			}
+			if got := strings.Join(msgs[0].To, ","); got != strings.Join(tt.wantTo, ",") {
+				t.Errorf("sent to %s, want %s", got, strings.Join(tt.wantTo, ","))
+			}
+			if v := metricValue(t, cfg.Registerer, "smtpd_duplicate_recipients_total", nil); v != tt.wantDuplicates {
+				t.Errorf("counted %g duplicate recipients, want %g", v, tt.wantDuplicates)
+			}
+		})
+	}
+}
+
+func TestBccRecipients(t *testing.T) {
+	tests := []struct {
+		name       string
+		bccHeader  string
+		wantHeader bool
+	}{
+		{"kept", "keep", true},
+		{"stripped", "strip", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DedupeRecipients = true
+			cfg.BccHeader = tt.bccHeader
+			_, addr := startServer(t, cfg)
+
+			// alice is both a visible and a Bcc recipient, so the client
+			// lists her twice, carol is only a Bcc recipient
+			msg := message("Hello\r\n", "From: sender@example.com", "To: alice@example.com, bob@example.com",
+				"Bcc: Alice@example.com, carol@example.com", "Subject: Test")
+			rcpts := []string{"alice@example.com", "bob@example.com", "Alice@example.com", "carol@example.com"}
+
+			c := dial(t, addr)
+			if _, err := sendMessage(c, "sender@example.com", rcpts, msg); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+
+			sent := cfg.Mailbox.List()
+			if len(sent) != 1 {
+				t.Fatalf("delivered %d messages, want 1", len(sent))
+			}
+			if got, want := strings.Join(sent[0].To, ","), "alice@example.com,bob@example.com,carol@example.com"; got != want {
+				t.Errorf("sent to %s, want %s", got, want)
+			}
+
+			data := string(sent[0].Data)
+			if hasBcc := strings.Contains(data, "\r\nBcc:"); hasBcc != tt.wantHeader {
+				t.Errorf("sent message has Bcc header %t, want %t:\n%s", hasBcc, tt.wantHeader, data)
+			}
+			if !tt.wantHeader && strings.Contains(data, "carol@example.com") {
+				t.Errorf("sent message shows the Bcc recipient:\n%s", data)
+			}
+		})
+	}
+}
+
+func TestSuppressedRecipient(t *testing.T) {
+	tests := []struct {
+		name         string
+		auditMode    bool
+		wantRcptCode int
+		wantTo       string
+		wantDecision string
+		wantDropped  float64
+	}{
+		{"enforced", false, 550, "kept@example.com", "reject", 1},
+		{"audit mode", true, 0, "kept@example.com,bounced@example.com", "would-reject", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listReg := prometheus.NewRegistry()
+			list, err := suppression.New(time.Hour, "", listReg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := list.Add("Bounced@example.com"); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := testConfig()
+			cfg.Suppression = list
+			cfg.PolicyAuditMode = tt.auditMode
+			_, addr := startServer(t, cfg)
+
+			c := dial(t, addr)
+			if err := c.Mail("sender@example.com", nil); err != nil {
+				t.Fatalf("MAIL: %v", err)
+			}
+			if err := c.Rcpt("kept@example.com", nil); err != nil {
+				t.Fatalf("RCPT: %v", err)
+			}
+			if code := replyCode(c.Rcpt("bounced@example.com", nil)); code != tt.wantRcptCode {
+				t.Errorf("RCPT of a suppressed recipient got code %d, want %d", code, tt.wantRcptCode)
+			}
+			w, err := c.Data()
+			if err != nil {
+				t.Fatalf("DATA: %v", err)
+			}
+			if _, err := w.Write([]byte(message("Hello", "Subject: Test"))); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("DATA: %v", err)
+			}
+
+			msgs := cfg.Mailbox.List()
+			if len(msgs) != 1 {
+				t.Fatalf("delivered %d messages, want 1", len(msgs))
+			}
+			if got := strings.Join(msgs[0].To, ","); got != tt.wantTo {
+				t.Errorf("sent to %s, want %s", got, tt.wantTo)
+			}
+			labels := map[string]string{"policy": "suppressed-recipient", "decision": tt.wantDecision}
+			if v := metricValue(t, cfg.Registerer, "smtpd_policy_decision_total", labels); v != 1 {
+				t.Errorf("counted %g %s decisions, want 1", v, tt.wantDecision)
+			}
+			if v := metricValue(t, listReg, "smtpd_local_suppression_drop_total", nil); v != tt.wantDropped {
+				t.Errorf("counted %g dropped recipients, want %g", v, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestResetBetweenMessages(t *testing.T) {
+	cfg := testConfig()
+	cfg.ConfigurationSetName = "default"
+	cfg.AllowedConfigSets = []string{"marketing", "transactional"}
+	_, addr := startServer(t, cfg)
+
+	c := dial(t, addr)
+	steps := []struct {
+		configSet string
+		abort     bool
+	}{
+		{"marketing", false},
+		{"", false},
+		{"", true},
+		{"transactional", false},
+		{"", false},
+	}
+
+	var want []string
+	for _, step := range steps {
+		if step.abort {
+			// An aborted transaction leaves nothing behind either
+			if err := c.Mail("other@example.com", nil); err != nil {
+				t.Fatalf("MAIL: %v", err)
+			}
+			if err := c.Rcpt("stale@example.com", nil); err != nil {
+				t.Fatalf("RCPT: %v", err)
+			}
+		} else {
+			fields := []string{"Subject: Test"}
+			if step.configSet != "" {
+				fields = append(fields, configSetHeader+": "+step.configSet)
+			}
+			if _, err := sendMessage(c, "sender@example.com", []string{"rcpt@example.com"}, message("Hello", fields...)); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+			want = append(want, cmp.Or(step.configSet, "default"))
+		}
+		if err := c.Reset(); err != nil {
+			t.Fatalf("RSET: %v", err)
+		}
+	}
+
+	sent := cfg.Mailbox.List()
+	if len(sent) != len(want) {
+		t.Fatalf("delivered %d messages, want %d", len(sent), len(want))
+	}
+	for i, m := range sent {
+		if m.ConfigurationSet != want[i] {
+			t.Errorf("message %d sent with configuration set %q, want %q", i+1, m.ConfigurationSet, want[i])
+		}
+		if m.From != "sender@example.com" || strings.Join(m.To, ",") != "rcpt@example.com" {
+			t.Errorf("message %d sent from %s to %v, want the envelope of its own transaction", i+1, m.From, m.To)
+		}
+		if strings.Contains(string(m.Data), configSetHeader) {
+			t.Errorf("message %d was sent with the %s header", i+1, configSetHeader)
+		}
+	}
+
+	resets := []struct {
+		kind string
+		want float64
+	}{
+		{"message", 4},
+		{"aborted", 1},
+	}
+	for _, r := range resets {
+		if v := metricValue(t, cfg.Registerer, "smtpd_reset_total", map[string]string{"kind": r.kind}); v != r.want {
+			t.Errorf("counted %g %s resets, want %g", v, r.kind, r.want)
+		}
+	}
+}
+
+func TestDataReadTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		wantCode string
+	}{
+		{"prompt", 0, "250"},
+		{"trickle", 50 * time.Millisecond, "451"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DataReadTimeout = 300 * time.Millisecond
+			_, addr := startServer(t, cfg)
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+			tc := textproto.NewConn(conn)
+			for _, cmd := range []string{"", "EHLO client.example.com", "MAIL FROM:<sender@example.com>", "RCPT TO:<rcpt@example.com>", "DATA"} {
+				if cmd != "" {
+					tc.PrintfLine("%s", cmd)
+				}
+				if _, _, err := tc.ReadResponse(0); err != nil {
+					t.Fatalf("%s: %v", cmd, err)
+				}
+			}
+
+			// The body is written a byte at a time, which takes far
+			// longer than the timeout when trickled
+			go func() {
+				for _, b := range []byte("Subject: Slow\r\n\r\nHello, world\r\n.\r\n") {
+					if _, err := conn.Write([]byte{b}); err != nil {
+						return
+					}
+					time.Sleep(tt.interval)
+				}
+			}()
+
+			line, err := tc.ReadLine()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(line, tt.wantCode) {
+				t.Errorf("DATA reply %q, want %s", line, tt.wantCode)
+			}
+
+			want := 0.0
+			if tt.wantCode == "451" {
+				want = 1
+			}
+			if v := metricValue(t, cfg.Registerer, "smtpd_data_timeout_total", nil); v != want {
+				t.Errorf("counted %g DATA timeouts, want %g", v, want)
+			}
+		})
+	}
+}
+
+// BenchmarkSession compares the allocations per message of sessions that
+// send one message with those that send many, which reuse the recipients
+// and message buffers of the session
+func BenchmarkSession(b *testing.B) {
+	rcpts := make([]string, 20)
+	for i := range rcpts {
+		rcpts[i] = fmt.Sprintf("rcpt%d@example.com", i)
+	}
+	msg := message(strings.Repeat(strings.Repeat("x", 76)+"\r\n", 1000), "Subject: Benchmark")
+
+	benchmarks := []struct {
+		name       string
+		perSession int
+	}{
+		{"one message per session", 1},
+		{"many messages per session", 100},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			cfg := testConfig()
+			cfg.Mailbox = mailbox.New(1)
+			cfg.Quiet = true
+			_, addr := startServer(b, cfg)
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(msg)))
+			b.ResetTimer()
+
+			var c *smtp.Client
+			for i := 0; i < b.N; i++ {
+				if i%bm.perSession == 0 {
+					if c != nil {
+						c.Quit()
+					}
+					c = dial(b, addr)
+				}
+				if _, err := sendMessage(c, "sender@example.com", rcpts, msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
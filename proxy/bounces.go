@@ -0,0 +1,181 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sesNotification is the part of an SES bounce or complaint notification, or
+// of the corresponding event of a configuration set event destination, that
+// the suppression list is fed from
+type sesNotification struct {
+	NotificationType string `json:"notificationType"`
+	EventType        string `json:"eventType"`
+	Bounce           struct {
+		BounceType        string `json:"bounceType"`
+		BouncedRecipients []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Complaint struct {
+		ComplainedRecipients []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"complainedRecipients"`
+	} `json:"complaint"`
+}
+
+// suppressedByNotification returns the recipients that body, an SES
+// notification delivered through SNS or with raw message delivery, says
+// should no longer be sent to, and why: those that bounced permanently and
+// those that complained. Transient bounces are ignored as the address may
+// work again.
+func suppressedByNotification(body []byte) ([]string, string, error) {
+	var envelope struct {
+		Type    string `json:"Type"`
+		Message string `json:"Message"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, "", err
+	}
+	if envelope.Type == "Notification" {
+		body = []byte(envelope.Message)
+	}
+
+	var n sesNotification
+	if err := json.Unmarshal(body, &n); err != nil {
+		return nil, "", err
+	}
+
+	var addrs []string
+	kind := n.NotificationType
+	if kind == "" {
+		kind = n.EventType
+	}
+	switch kind {
+	case "Bounce":
+		if n.Bounce.BounceType != "Permanent" {
+			return nil, "", nil
+		}
+		for _, r := range n.Bounce.BouncedRecipients {
+			addrs = append(addrs, r.EmailAddress)
+		}
+		return addrs, "bounce", nil
+	case "Complaint":
+		for _, r := range n.Complaint.ComplainedRecipients {
+			addrs = append(addrs, r.EmailAddress)
+		}
+		return addrs, "complaint", nil
+	case "":
+		return nil, "", fmt.Errorf("not an SES notification")
+	}
+	return nil, "", nil
+}
+
+// consumeBounces receives the SES notifications delivered to the SQS queue
+// at BounceQueueURL until ctx is canceled and adds the recipients that
+// bounced permanently or complained to the local suppression list. A
+// notification is only deleted from the queue once it has been handled, so
+// that one the list couldn't be saved for is received again when its
+// visibility timeout expires. Those that can't be parsed are deleted too as
+// they would otherwise be received again forever. Failed receives, such as
+// network errors or throttling, are retried with a backoff starting at
+// minRetryDelay for as long as ctx isn't canceled.
+func (s *Server) consumeBounces(ctx context.Context, client *sqs.Client, minRetryDelay time.Duration) {
+	queueURL := aws.String(s.cfg.BounceQueueURL)
+	m := s.backend.metrics
+	log.Printf("Adding bounced and complaining recipients from %s to the local suppression list", s.cfg.BounceQueueURL)
+	defer m.bounceConsumerUp.Set(0)
+
+	failures := 0
+	for ctx.Err() == nil {
+		out, err := client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            queueURL,
+			MaxNumberOfMessages: 10,
+			WaitTimeSeconds:     20,
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			m.bounceConsumerUp.Set(0)
+			delay := bounceQueueRetryDelay(minRetryDelay, failures)
+			log.Printf("ERROR: unable to receive SES notifications from %s, retrying in %s: %v", s.cfg.BounceQueueURL, delay.Round(time.Millisecond), err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+			continue
+		}
+		if failures > 0 {
+			log.Printf("Receiving SES notifications from %s again after %d failures", s.cfg.BounceQueueURL, failures)
+			failures = 0
+		}
+		m.bounceConsumerUp.Set(1)
+
+		for _, msg := range out.Messages {
+			result := "processed"
+			addrs, reason, err := suppressedByNotification([]byte(aws.ToString(msg.Body)))
+			if err != nil {
+				log.Printf("ERROR: unable to parse SES notification %s, deleting it: %v", aws.ToString(msg.MessageId), err)
+				result = "failed"
+			} else if err := s.suppress(addrs, reason); err != nil {
+				log.Printf("ERROR: unable to save local suppression list, leaving SES notification %s in the queue: %v", aws.ToString(msg.MessageId), err)
+				m.bounceNotifications.With(prometheus.Labels{"result": "failed"}).Inc()
+				continue
+			}
+
+			if _, err := client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      queueURL,
+				ReceiptHandle: msg.ReceiptHandle,
+			}); err != nil && ctx.Err() == nil {
+				log.Printf("ERROR: unable to delete SES notification %s from %s: %v", aws.ToString(msg.MessageId), s.cfg.BounceQueueURL, err)
+			}
+			m.bounceNotifications.With(prometheus.Labels{"result": result}).Inc()
+		}
+	}
+}
+
+// suppress adds addrs to the local suppression list, stopping at the first
+// one that can't be saved
+func (s *Server) suppress(addrs []string, reason string) error {
+	for _, addr := range addrs {
+		if err := s.backend.suppression.Add(addr); err != nil {
+			return err
+		}
+		log.Printf("Suppressing %s after a %s", addr, reason)
+		s.backend.metrics.suppressionAdded.With(prometheus.Labels{"reason": reason}).Inc()
+	}
+	return nil
+}
+
+// bounceQueueRetryDelay returns the delay before receiving from the bounce
+// queue again after the given number of consecutive failures, doubling from
+// base with each failure up to maxBounceQueueRetryDelay and jittered down by
+// up to half so that proxies sharing a queue don't retry together
+func bounceQueueRetryDelay(base time.Duration, failures int) time.Duration {
+	d := base
+	for i := 1; i < failures && d < maxBounceQueueRetryDelay; i++ {
+		d *= 2
+	}
+	d = min(d, maxBounceQueueRetryDelay)
+	return d/2 + rand.N(d/2+1)
+}
+
+const (
+	// minBounceQueueRetryDelay is the delay before receiving from the bounce
+	// queue again after the first failure
+	minBounceQueueRetryDelay = time.Second
+
+	// maxBounceQueueRetryDelay caps the delay between receives from a
+	// failing bounce queue
+	maxBounceQueueRetryDelay = 5 * time.Minute
+)
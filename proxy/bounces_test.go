@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"code.crute.us/mcrute/ses-smtpd-proxy/suppression"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeSQS is an SQS JSON protocol endpoint that hands out queued message
+// bodies to ReceiveMessage, once each, and records the receipt handles
+// deleted with DeleteMessage. The first failures receives fail.
+type fakeSQS struct {
+	mu       sync.Mutex
+	failures int
+	queued   []string
+	received int
+	deleted  []string
+}
+
+// startFakeSQS starts a fake SQS endpoint with bodies queued, it is stopped
+// when the test ends
+func startFakeSQS(t testing.TB, failures int, bodies ...string) (*fakeSQS, string) {
+	t.Helper()
+
+	f := &fakeSQS{failures: failures, queued: bodies}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv.URL
+}
+
+func (f *fakeSQS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	switch r.Header.Get("X-Amz-Target") {
+	case "AmazonSQS.ReceiveMessage":
+		if f.failures > 0 {
+			f.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"__type":"com.amazonaws.sqs#ServiceUnavailable","message":"try again"}`)
+			return
+		}
+		if len(f.queued) == 0 {
+			// Stands in for the long poll of an empty queue
+			f.mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			f.mu.Lock()
+		}
+
+		var messages []map[string]string
+		for _, body := range f.queued {
+			sum := md5.Sum([]byte(body))
+			messages = append(messages, map[string]string{
+				"MessageId":     fmt.Sprintf("message-%d", f.received),
+				"ReceiptHandle": fmt.Sprintf("handle-%d", f.received),
+				"MD5OfBody":     hex.EncodeToString(sum[:]),
+				"Body":          body,
+			})
+			f.received++
+		}
+		f.queued = nil
+		json.NewEncoder(w).Encode(map[string]any{"Messages": messages})
+	case "AmazonSQS.DeleteMessage":
+		var in struct{ ReceiptHandle string }
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.deleted = append(f.deleted, in.ReceiptHandle)
+		fmt.Fprint(w, "{}")
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"__type":"com.amazonaws.sqs#UnsupportedOperation","message":"unexpected request"}`)
+	}
+}
+
+// snsNotification wraps an SES notification in the SNS envelope it is
+// delivered to SQS in without raw message delivery
+func snsNotification(t testing.TB, message string) string {
+	t.Helper()
+
+	body, err := json.Marshal(map[string]string{"Type": "Notification", "Message": message})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+// startBounceConsumer starts consuming the bounce queue at url into list
+// and returns a function that stops it and waits for it to return
+func startBounceConsumer(t testing.TB, list *suppression.List, url string) (*Server, func()) {
+	t.Helper()
+
+	cfg := testConfig()
+	cfg.Suppression = list
+	cfg.BounceQueueURL = url + "/123456789012/bounces"
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := sqs.New(sqs.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(url),
+		Credentials:  credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+		Retryer:      aws.NopRetryer{},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.consumeBounces(ctx, client, time.Millisecond)
+		close(done)
+	}()
+
+	stop := func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+	return s, stop
+}
+
+// waitFor fails the test if cond doesn't become true within a few seconds
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConsumeBounces(t *testing.T) {
+	list, err := suppression.New(time.Hour, "", prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake, url := startFakeSQS(t, 2,
+		snsNotification(t, `{"notificationType":"Bounce","bounce":{"bounceType":"Permanent","bouncedRecipients":[{"emailAddress":"bounced@example.com"}]}}`),
+		`{"eventType":"Complaint","complaint":{"complainedRecipients":[{"emailAddress":"complained@example.com"}]}}`,
+		`{"notificationType":"Bounce","bounce":{"bounceType":"Transient","bouncedRecipients":[{"emailAddress":"transient@example.com"}]}}`,
+		"not a notification",
+	)
+	s, stop := startBounceConsumer(t, list, url)
+	reg := s.cfg.Registerer
+
+	waitFor(t, "the notifications to be deleted", func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return len(fake.deleted) == 4
+	})
+	if v := metricValue(t, reg, "smtpd_bounce_consumer_up", nil); v != 1 {
+		t.Errorf("consumer up gauge is %g after a successful receive, want 1", v)
+	}
+	stop()
+
+	for addr, want := range map[string]bool{
+		"bounced@example.com":    true,
+		"complained@example.com": true,
+		"transient@example.com":  false,
+	} {
+		if got := list.Contains(addr); got != want {
+			t.Errorf("%s suppressed %t, want %t", addr, got, want)
+		}
+	}
+
+	slices.Sort(fake.deleted)
+	if want := []string{"handle-0", "handle-1", "handle-2", "handle-3"}; !slices.Equal(fake.deleted, want) {
+		t.Errorf("deleted %v, want %v", fake.deleted, want)
+	}
+	for labels, want := range map[string]float64{"processed": 3, "failed": 1} {
+		if v := metricValue(t, reg, "smtpd_bounce_notifications_total", map[string]string{"result": labels}); v != want {
+			t.Errorf("%g %s notifications, want %g", v, labels, want)
+		}
+	}
+	for reason, want := range map[string]float64{"bounce": 1, "complaint": 1} {
+		if v := metricValue(t, reg, "smtpd_local_suppression_added_total", map[string]string{"reason": reason}); v != want {
+			t.Errorf("%g recipients suppressed after a %s, want %g", v, reason, want)
+		}
+	}
+	if v := metricValue(t, reg, "smtpd_bounce_consumer_up", nil); v != 0 {
+		t.Errorf("consumer up gauge is %g once stopped, want 0", v)
+	}
+}
+
+func TestConsumeBouncesSaveFailure(t *testing.T) {
+	// The list can't be saved in a directory that doesn't exist
+	path := filepath.Join(t.TempDir(), "missing", "suppression.json")
+	list, err := suppression.New(time.Hour, path, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake, url := startFakeSQS(t, 0,
+		`{"notificationType":"Bounce","bounce":{"bounceType":"Permanent","bouncedRecipients":[{"emailAddress":"bounced@example.com"}]}}`,
+	)
+	s, stop := startBounceConsumer(t, list, url)
+	reg := s.cfg.Registerer
+
+	waitFor(t, "the notification to fail", func() bool {
+		return metricValue(t, reg, "smtpd_bounce_notifications_total", map[string]string{"result": "failed"}) == 1
+	})
+	stop()
+
+	if len(fake.deleted) != 0 {
+		t.Errorf("deleted %v, want the notification left in the queue", fake.deleted)
+	}
+	if v := metricValue(t, reg, "smtpd_bounce_notifications_total", map[string]string{"result": "processed"}); v != 0 {
+		t.Errorf("%g notifications processed, want 0", v)
+	}
+	if v := metricValue(t, reg, "smtpd_local_suppression_added_total", nil); v != 0 {
+		t.Errorf("%g recipients counted as suppressed, want 0", v)
+	}
+}
+
+func TestBounceQueueRetryDelay(t *testing.T) {
+	for failures, want := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		4:  8 * time.Second,
+		20: maxBounceQueueRetryDelay,
+	} {
+		for range 20 {
+			if d := bounceQueueRetryDelay(minBounceQueueRetryDelay, failures); d < want/2 || d > want {
+				t.Errorf("delay after %d failures %s, want between %s and %s", failures, d, want/2, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Circuit breaker states, the values of the breaker state gauge
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// sesBreaker stops sending to SES for a while when too many sends fail with
+// temporary errors, so that clients are deferred straight away instead of
+// each waiting for SES to fail and SES isn't hammered while it struggles.
+// Once the cooldown has passed one message is let through to probe SES:
+// success closes the breaker again and failure opens it for another cooldown.
+type sesBreaker struct {
+	mu        sync.Mutex
+	errorRate float64
+	window    time.Duration
+	minSends  int
+	cooldown  time.Duration
+
+	state       int
+	windowStart time.Time
+	sends       int
+	failures    int
+	openedAt    time.Time
+	probeAt     time.Time
+
+	stateGauge prometheus.Gauge
+	trips      prometheus.Counter
+}
+
+func newSesBreaker(errorRate float64, window time.Duration, minSends int, cooldown time.Duration, stateGauge prometheus.Gauge, trips prometheus.Counter) *sesBreaker {
+	return &sesBreaker{
+		errorRate:  errorRate,
+		window:     window,
+		minSends:   minSends,
+		cooldown:   cooldown,
+		stateGauge: stateGauge,
+		trips:      trips,
+	}
+}
+
+// allow reports whether a message may be sent to SES now. While the breaker
+// is half open only one probe is allowed at a time, and another once the
+// probe has been out for a cooldown without a result, as the message may not
+// have reached SES.
+func (b *sesBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+	case breakerHalfOpen:
+		if now.Sub(b.probeAt) < b.cooldown {
+			return false
+		}
+	default:
+		return true
+	}
+
+	b.probeAt = now
+	return true
+}
+
+// record records the result of a send to SES, failed being set if it failed
+// with a temporary error
+func (b *sesBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.state == breakerHalfOpen {
+		if failed {
+			b.open(now, "the probe send failed")
+		} else {
+			log.Printf("SES circuit breaker closed, the probe send succeeded")
+			b.setState(breakerClosed)
+			b.windowStart, b.sends, b.failures = now, 0, 0
+		}
+		return
+	}
+	if b.state == breakerOpen {
+		return
+	}
+
+	if now.Sub(b.windowStart) >= b.window {
+		b.windowStart, b.sends, b.failures = now, 0, 0
+	}
+	b.sends++
+	if failed {
+		b.failures++
+	}
+	if b.sends >= b.minSends && float64(b.failures) >= b.errorRate*float64(b.sends) {
+		b.open(now, fmt.Sprintf("%d of %d sends failed", b.failures, b.sends))
+	}
+}
+
+func (b *sesBreaker) open(now time.Time, why string) {
+	log.Printf("SES circuit breaker open, deferring messages for %s as %s", b.cooldown, why)
+	b.setState(breakerOpen)
+	b.openedAt = now
+	b.trips.Inc()
+}
+
+func (b *sesBreaker) setState(state int) {
+	b.state = state
+	b.stateGauge.Set(float64(state))
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/mail"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// missingConfigSets tracks the configuration sets SES has reported don't
+// exist, until a message is sent with them again
+type missingConfigSets struct {
+	mu      sync.Mutex
+	missing map[string]bool
+	gauge   *prometheus.GaugeVec
+}
+
+func newMissingConfigSets(gauge *prometheus.GaugeVec) *missingConfigSets {
+	return &missingConfigSets{missing: map[string]bool{}, gauge: gauge}
+}
+
+// observe records the outcome of a send with configuration set name and
+// reports whether it failed because the configuration set doesn't exist
+func (m *missingConfigSets) observe(name string, err error) bool {
+	var notExist *types.ConfigurationSetDoesNotExistException
+	missing := errors.As(err, &notExist)
+	if err != nil && !missing {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if missing && !m.missing[name] {
+		log.Printf("ERROR: SES configuration set %s does not exist, messages using it can't be sent until it is recreated or the configuration is changed", name)
+		m.missing[name] = true
+		m.gauge.With(prometheus.Labels{"configuration_set": name}).Set(1)
+	} else if !missing && m.missing[name] {
+		log.Printf("SES configuration set %s exists again", name)
+		delete(m.missing, name)
+		m.gauge.With(prometheus.Labels{"configuration_set": name}).Set(0)
+	}
+
+	return missing
+}
+
+// list returns the names of the missing configuration sets in sorted order
+func (m *missingConfigSets) list() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.missing))
+	for name := range m.missing {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// MissingConfigSets returns the configuration sets that SES reported don't
+// exist the last time a message was sent with them
+func (s *Server) MissingConfigSets() []string {
+	return s.backend.missingConfigSets.list()
+}
+
+// configuredConfigSets returns the names of the configuration sets named
+// anywhere in cfg, including "" for messages sent without one
+func configuredConfigSets(cfg Config) map[string]bool {
+	names := map[string]bool{"": true, cfg.ConfigurationSetName: true}
+	for _, name := range cfg.PriorityConfigSets {
+		names[name] = true
+	}
+	for _, name := range cfg.SenderConfigSets {
+		names[name] = true
+	}
+	for _, name := range cfg.AllowedConfigSets {
+		names[name] = true
+	}
+	for _, u := range cfg.Users {
+		names[u.ConfigurationSet] = true
+	}
+	for _, r := range cfg.RecipientRoutes {
+		names[r.ConfigurationSet] = true
+	}
+	return names
+}
+
+// configSetHeader is the header field with which a message selects its
+// configuration set, as accepted by the SES SMTP interface
+const configSetHeader = "X-SES-CONFIGURATION-SET"
+
+// messageConfigSet returns the configuration set selected by the header of
+// data, or "" if there is none, and data with that header field removed.
+// Messages without the field are returned as they are without being parsed.
+func messageConfigSet(data []byte) (string, []byte, error) {
+	rawHeader, body, _ := splitEntity(data)
+	if !hasHeaderField(rawHeader, configSetHeader) {
+		return "", data, nil
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "", data, err
+	}
+	name := strings.TrimSpace(msg.Header.Get(configSetHeader))
+	return name, append(removeHeader(rawHeader, configSetHeader), body...), nil
+}
+
+// hasHeaderField reports whether rawHeader contains a field called name
+func hasHeaderField(rawHeader []byte, name string) bool {
+	for _, line := range bytes.Split(rawHeader, []byte("\n")) {
+		if colon := bytes.IndexByte(line, ':'); colon > 0 && strings.EqualFold(string(line[:colon]), name) {
+			return true
+		}
+	}
+	return false
+}
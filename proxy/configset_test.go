@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestMissingConfigSet(t *testing.T) {
+	tests := []struct {
+		name         string
+		fallback     bool
+		wantCode     int
+		wantEnhanced smtp.EnhancedCode
+	}{
+		{"deferred", false, 451, smtp.EnhancedCode{4, 3, 5}},
+		{"fallback", true, 250, smtp.EnhancedCode{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var deleted atomic.Bool
+			deleted.Store(true)
+			fake, endpoint := startFakeSES(t, func(form url.Values) *fakeSESError {
+				if deleted.Load() && form.Get("ConfigurationSetName") != "" {
+					return &fakeSESError{400, "ConfigurationSetDoesNotExist", "Configuration set <tracking> does not exist."}
+				}
+				return nil
+			})
+			cfg := sesConfig(endpoint)
+			cfg.ConfigurationSetName = "tracking"
+			cfg.ConfigSetFallback = tt.fallback
+			s, addr := startServer(t, cfg)
+
+			c := dial(t, addr)
+			_, err := sendMessage(c, "sender@example.com", []string{"rcpt@example.com"}, message("Hello", "Subject: Test"))
+			if tt.wantCode == 250 {
+				if err != nil {
+					t.Fatalf("send: %v", err)
+				}
+			} else if e, ok := err.(*smtp.SMTPError); !ok || e.Code != tt.wantCode || e.EnhancedCode != tt.wantEnhanced {
+				t.Fatalf("send: %v, want %d %v", err, tt.wantCode, tt.wantEnhanced)
+			}
+
+			if got := s.MissingConfigSets(); !slices.Equal(got, []string{"tracking"}) {
+				t.Errorf("missing configuration sets %v, want [tracking]", got)
+			}
+			labels := map[string]string{"configuration_set": "tracking"}
+			if v := metricValue(t, cfg.Registerer, "smtpd_config_set_missing_total", labels); v != 1 {
+				t.Errorf("counted %g sends with a missing configuration set, want 1", v)
+			}
+			if v := metricValue(t, cfg.Registerer, "smtpd_config_set_missing", labels); v != 1 {
+				t.Errorf("missing configuration set gauge is %g, want 1", v)
+			}
+
+			sends := fake.Sends()
+			if tt.fallback {
+				if len(sends) != 1 || sends[0].Get("ConfigurationSetName") != "" {
+					t.Errorf("sent %v, want one message without a configuration set", sends)
+				}
+			} else if len(sends) != 0 {
+				t.Errorf("sent %d messages, want none", len(sends))
+			}
+
+			// Once the configuration set is recreated it is used again
+			deleted.Store(false)
+			if _, err := sendMessage(c, "sender@example.com", []string{"rcpt@example.com"}, message("Hello", "Subject: Test")); err != nil {
+				t.Fatalf("send after recreating the configuration set: %v", err)
+			}
+			if got := s.MissingConfigSets(); len(got) != 0 {
+				t.Errorf("missing configuration sets %v after it was recreated", got)
+			}
+			if v := metricValue(t, cfg.Registerer, "smtpd_config_set_missing", labels); v != 0 {
+				t.Errorf("missing configuration set gauge is %g after it was recreated", v)
+			}
+			if sends := fake.Sends(); sends[len(sends)-1].Get("ConfigurationSetName") != "tracking" {
+				t.Errorf("sent without the recreated configuration set")
+			}
+		})
+	}
+}
+
+func TestAllowedConfigSets(t *testing.T) {
+	tests := []struct {
+		name          string
+		allowed       []string
+		disallowed    string
+		header        string
+		wantCode      int
+		wantConfigSet string
+	}{
+		{"no allowlist", nil, "", "anything", 250, "anything"},
+		{"no header", []string{"marketing"}, "reject", "", 250, "default"},
+		{"allowed", []string{"marketing", "transactional"}, "reject", "transactional", 250, "transactional"},
+		{"disallowed rejected", []string{"marketing"}, "reject", "untracked", 550, ""},
+		{"disallowed rejected by default", []string{"marketing"}, "", "untracked", 550, ""},
+		{"disallowed falls back", []string{"marketing"}, "default", "untracked", 250, "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.ConfigurationSetName = "default"
+			cfg.AllowedConfigSets = tt.allowed
+			cfg.DisallowedConfigSet = tt.disallowed
+			_, addr := startServer(t, cfg)
+
+			fields := []string{"Subject: Test"}
+			if tt.header != "" {
+				fields = append(fields, configSetHeader+": "+tt.header)
+			}
+
+			c := dial(t, addr)
+			_, err := sendMessage(c, "sender@example.com", []string{"rcpt@example.com"}, message("Hello", fields...))
+			code := 250
+			if err != nil {
+				code = replyCode(err)
+			}
+			if code != tt.wantCode {
+				t.Fatalf("DATA reply %d (%v), want %d", code, err, tt.wantCode)
+			}
+
+			sent := cfg.Mailbox.List()
+			if code != 250 {
+				if len(sent) != 0 {
+					t.Errorf("delivered %d messages with a disallowed configuration set", len(sent))
+				}
+				if v := metricValue(t, cfg.Registerer, "smtpd_email_send_fail_total", map[string]string{"type": "config set not allowed"}); v != 1 {
+					t.Errorf("counted %g disallowed configuration sets, want 1", v)
+				}
+				return
+			}
+
+			if len(sent) != 1 {
+				t.Fatalf("delivered %d messages, want 1", len(sent))
+			}
+			if sent[0].ConfigurationSet != tt.wantConfigSet {
+				t.Errorf("configuration set %q, want %q", sent[0].ConfigurationSet, tt.wantConfigSet)
+			}
+			if strings.Contains(string(sent[0].Data), configSetHeader) {
+				t.Errorf("message was sent with the %s header", configSetHeader)
+			}
+		})
+	}
+}
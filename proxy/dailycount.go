@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// dailyMinutes is the number of minute buckets in the rolling count
+const dailyMinutes = 24 * 60
+
+// dailyCounter keeps a rolling count of the messages sent over the last 24
+// hours in one bucket per minute. If a path is configured the count is
+// persisted there so that it survives restarts.
+type dailyCounter struct {
+	mu      sync.Mutex
+	path    string
+	dirty   bool
+	minutes [dailyMinutes]int64
+	counts  [dailyMinutes]uint64
+}
+
+// newDailyCounter creates a counter, loading the count persisted at path if
+// there is one, and registers its gauge with reg
+func newDailyCounter(path string, reg prometheus.Registerer) (*dailyCounter, error) {
+	c := &dailyCounter{path: path}
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			if err := c.load(data, time.Now()); err != nil {
+				return nil, fmt.Errorf("unable to parse send count %s: %w", path, err)
+			}
+		}
+	}
+
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "smtpd",
+		Name:      "local_sent_last_24_hours",
+		Help:      "Messages sent by this proxy over the last 24 hours, including before restarts if persisted",
+	}, func() float64 {
+		return float64(c.count(time.Now()))
+	})
+
+	return c, nil
+}
+
+// load restores the buckets from their JSON form, a map of Unix minutes to
+// counts, dropping those more than 24 hours old
+func (c *dailyCounter) load(data []byte, now time.Time) error {
+	var saved map[string]uint64
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+
+	oldest := now.Unix()/60 - dailyMinutes
+	for k, n := range saved {
+		minute, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			return err
+		}
+		if minute <= oldest {
+			continue
+		}
+		i := minute % dailyMinutes
+		c.minutes[i] = minute
+		c.counts[i] = n
+	}
+
+	return nil
+}
+
+// record counts a message sent at now
+func (c *dailyCounter) record(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	minute := now.Unix() / 60
+	i := minute % dailyMinutes
+	if c.minutes[i] != minute {
+		c.minutes[i] = minute
+		c.counts[i] = 0
+	}
+	c.counts[i]++
+	c.dirty = true
+}
+
+// count returns the messages sent in the 24 hours before now
+func (c *dailyCounter) count(now time.Time) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	oldest := now.Unix()/60 - dailyMinutes
+	var total uint64
+	for i, minute := range c.minutes {
+		if minute > oldest {
+			total += c.counts[i]
+		}
+	}
+	return total
+}
+
+// save writes the count to disk if it changed since it was last saved. The
+// file is written to a temporary file first and renamed so a crash can't
+// leave a partially written count behind.
+func (c *dailyCounter) save(now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.path == "" || !c.dirty {
+		return nil
+	}
+
+	oldest := now.Unix()/60 - dailyMinutes
+	saved := map[string]uint64{}
+	for i, minute := range c.minutes {
+		if minute > oldest && c.counts[i] > 0 {
+			saved[strconv.FormatInt(minute, 10)] = c.counts[i]
+		}
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.path), ".send-count-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// persist saves the count every minute until ctx is canceled
+func (c *dailyCounter) persist(ctx context.Context) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			if err := c.save(now); err != nil {
+				log.Printf("ERROR: unable to save send count: %v", err)
+			}
+		}
+	}
+}
+
+// SaveSendCount writes the rolling 24 hour send count to disk, if it is
+// persisted. Call it before exiting so that no sends are forgotten.
+func (s *Server) SaveSendCount() error {
+	return s.backend.dailyCount.save(time.Now())
+}
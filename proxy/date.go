@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/mail"
+	"time"
+)
+
+// checkDate returns an error describing the problem if the message has no
+// Date header, a Date header that can't be parsed or a date more than maxSkew
+// away from now.
+func checkDate(data []byte, maxSkew time.Duration, now time.Time) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("message headers are not valid")
+	}
+
+	date, err := msg.Header.Date()
+	if errors.Is(err, mail.ErrHeaderNotPresent) {
+		return fmt.Errorf("message has no Date header")
+	} else if err != nil {
+		return fmt.Errorf("message Date header is not valid")
+	}
+
+	if skew := now.Sub(date).Abs(); skew > maxSkew {
+		return fmt.Errorf("message Date is more than %s from the current time", maxSkew)
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckDate(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		fields  []string
+		wantErr bool
+	}{
+		{"current", []string{"Date: Fri, 01 Mar 2024 12:00:00 +0000"}, false},
+		{"other time zone", []string{"Date: Fri, 01 Mar 2024 07:30:00 -0500"}, false},
+		{"within skew", []string{"Date: Fri, 01 Mar 2024 11:01:00 +0000"}, false},
+		{"past", []string{"Date: Fri, 01 Mar 2024 10:59:00 +0000"}, true},
+		{"future", []string{"Date: Fri, 01 Mar 2024 13:01:00 +0000"}, true},
+		{"missing", []string{"Subject: No date"}, true},
+		{"invalid", []string{"Date: yesterday"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDate([]byte(message("Hello", tt.fields...)), time.Hour, now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkDate = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDataDate(t *testing.T) {
+	tests := []struct {
+		name     string
+		date     time.Time
+		wantCode int
+	}{
+		{"valid", time.Now(), 250},
+		{"skewed", time.Now().Add(-48 * time.Hour), 550},
+		{"missing", time.Time{}, 550},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MaxDateSkew = 24 * time.Hour
+			_, addr := startServer(t, cfg)
+
+			fields := []string{"Subject: Test"}
+			if !tt.date.IsZero() {
+				fields = append(fields, "Date: "+tt.date.Format(time.RFC1123Z))
+			}
+
+			c := dial(t, addr)
+			_, err := sendMessage(c, "sender@example.com", []string{"rcpt@example.com"}, message("Hello", fields...))
+			code := 250
+			if err != nil {
+				code = replyCode(err)
+			}
+			if code != tt.wantCode {
+				t.Errorf("DATA reply %d (%v), want %d", code, err, tt.wantCode)
+			}
+		})
+	}
+}
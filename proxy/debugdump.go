@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// debugTrace collects what happened to the message in the current DATA
+// command so that it can be written out if the message fails
+type debugTrace struct {
+	start    time.Time
+	received time.Duration
+	raw      []byte
+	sends    []debugSend
+}
+
+// debugSend is one request to send the message with SES
+type debugSend struct {
+	ConfigurationSet string   `json:"configuration_set,omitempty"`
+	Recipients       []string `json:"recipients"`
+	Duration         string   `json:"duration"`
+	MessageID        string   `json:"message_id,omitempty"`
+	Error            string   `json:"error,omitempty"`
+}
+
+// debugDump is the content of a debug file written for a failed message
+type debugDump struct {
+	Time         time.Time   `json:"time"`
+	Client       string      `json:"client"`
+	Helo         string      `json:"helo"`
+	User         string      `json:"user,omitempty"`
+	From         string      `json:"from"`
+	Recipients   []string    `json:"recipients"`
+	DeclaredSize int64       `json:"declared_size,omitempty"`
+	BodyType     string      `json:"body_type,omitempty"`
+	Size         int         `json:"size"`
+	ReceivedIn   string      `json:"received_in"`
+	Duration     string      `json:"duration"`
+	Code         int         `json:"code"`
+	EnhancedCode string      `json:"enhanced_code,omitempty"`
+	Reply        string      `json:"reply"`
+	Detail       string      `json:"detail,omitempty"`
+	SESRequests  []debugSend `json:"ses_requests,omitempty"`
+	Headers      string      `json:"headers"`
+	Body         *string     `json:"body,omitempty"`
+}
+
+// debugDumper writes debug files for failed messages to a directory,
+// keeping only the newest max files
+type debugDumper struct {
+	dir         string
+	max         int
+	includeBody bool
+
+	mu sync.Mutex
+}
+
+// dump writes the trace of a message that failed with err
+func (d *debugDumper) dump(s *Session, err error) {
+	smtpErr, ok := err.(*smtp.SMTPError)
+	if !ok {
+		smtpErr = &smtp.SMTPError{Code: 554, Message: err.Error()}
+	}
+
+	header, body, _ := splitEntity(s.trace.raw)
+	dump := debugDump{
+		Time:         s.trace.start,
+		Client:       s.conn.Conn().RemoteAddr().String(),
+		Helo:         s.helo,
+		User:         s.username,
+		From:         s.from,
+		Recipients:   s.recipients,
+		DeclaredSize: s.size,
+		BodyType:     string(s.body),
+		Size:         len(s.trace.raw),
+		ReceivedIn:   s.trace.received.String(),
+		Duration:     time.Since(s.trace.start).String(),
+		Code:         smtpErr.Code,
+		Reply:        smtpErr.Message,
+		Detail:       s.errDetail,
+		SESRequests:  s.trace.sends,
+		Headers:      string(header),
+	}
+	if smtpErr.EnhancedCode != (smtp.EnhancedCode{}) && smtpErr.EnhancedCode != smtp.NoEnhancedCode {
+		c := smtpErr.EnhancedCode
+		dump.EnhancedCode = fmt.Sprintf("%d.%d.%d", c[0], c[1], c[2])
+	}
+	if d.includeBody {
+		b := string(body)
+		dump.Body = &b
+	}
+
+	data, jerr := json.MarshalIndent(dump, "", "  ")
+	if jerr != nil {
+		log.Printf("ERROR: unable to encode debug trace: %v", jerr)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.write(data); err != nil {
+		log.Printf("ERROR: unable to write debug trace to %s: %v", d.dir, err)
+		return
+	}
+	d.prune()
+}
+
+func (d *debugDumper) write(data []byte) error {
+	f, err := os.CreateTemp(d.dir, "message-"+time.Now().UTC().Format("20060102T150405.000000000")+"-*.json")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	return f.Close()
+}
+
+// prune removes the oldest debug files beyond the maximum, the caller must
+// hold the lock. The file names start with the time they were written so
+// they sort oldest first.
+func (d *debugDumper) prune() {
+	if d.max <= 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return
+	}
+
+	var names []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "message-") && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names)
+
+	for len(names) > d.max {
+		os.Remove(filepath.Join(d.dir, names[0]))
+		names = names[1:]
+	}
+}
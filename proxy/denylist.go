@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ContentPattern is a named regular expression that messages are rejected
+// for matching
+type ContentPattern struct {
+	Name   string
+	Regexp *regexp.Regexp
+}
+
+// LoadContentDenylist reads content patterns from the file at path. Each line
+// is a name followed by whitespace and a regular expression, blank lines and
+// lines starting with # are ignored.
+func LoadContentDenylist(path string) ([]ContentPattern, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []ContentPattern
+	names := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected a name and a regular expression", path, n)
+		}
+		name, expr := line[:i], strings.TrimSpace(line[i+1:])
+		if expr == "" {
+			return nil, fmt.Errorf("%s:%d: expected a name and a regular expression", path, n)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("%s:%d: duplicate pattern name %s", path, n, name)
+		}
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		names[name] = true
+		patterns = append(patterns, ContentPattern{Name: name, Regexp: re})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return patterns, nil
+}
+
+// matchContent returns the first pattern that matches the first limit bytes
+// of data, or nil if none do. A limit of zero scans the whole message.
+func matchContent(patterns []ContentPattern, data []byte, limit int) *ContentPattern {
+	if limit > 0 && len(data) > limit {
+		data = data[:limit]
+	}
+	for i := range patterns {
+		if patterns[i].Regexp.Match(data) {
+			return &patterns[i]
+		}
+	}
+	return nil
+}
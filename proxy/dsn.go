@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/textproto"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dsnReport is the outcome for one recipient reported in a delivery status
+// notification
+type dsnReport struct {
+	recipient  string
+	action     string
+	status     smtp.EnhancedCode
+	diagnostic string
+}
+
+// wantsDSN reports whether the client asked for a notification of the
+// outcome n for rcpt. Without NOTIFY only failures are reported.
+func (s *Session) wantsDSN(rcpt string, n smtp.DSNNotify) bool {
+	opts := s.rcptDSN[rcpt]
+	if opts == nil || len(opts.Notify) == 0 {
+		return n == smtp.DSNNotifyFailure
+	}
+	return slices.Contains(opts.Notify, n)
+}
+
+// addDSNReports adds the recipients that asked to be told about the outcome
+// of a send to them to reports. A nil reply means the send succeeded, which
+// is reported as relayed as SES doesn't confirm delivery.
+func (s *Session) addDSNReports(reports []dsnReport, recipients []string, reply *smtp.SMTPError) []dsnReport {
+	for _, rcpt := range recipients {
+		// The sender isn't told about the archive address
+		if rcpt == s.backend.archiveBcc {
+			continue
+		}
+		if reply == nil {
+			if s.wantsDSN(rcpt, smtp.DSNNotifySuccess) {
+				reports = append(reports, dsnReport{
+					recipient: rcpt,
+					action:    "relayed",
+					status:    smtp.EnhancedCode{2, 0, 0},
+				})
+			}
+		} else if s.wantsDSN(rcpt, smtp.DSNNotifyFailure) {
+			reports = append(reports, dsnReport{
+				recipient: rcpt,
+				action:    "failed",
+				status:    reply.EnhancedCode,
+				diagnostic: fmt.Sprintf("smtp; %d %d.%d.%d %s", reply.Code,
+					reply.EnhancedCode[0], reply.EnhancedCode[1], reply.EnhancedCode[2], reply.Message),
+			})
+		}
+	}
+	return reports
+}
+
+// sendDSN sends a delivery status notification for reports to the sender of
+// the message. Nothing is sent for messages from the null sender, which is
+// used by notifications themselves, even if it was rewritten.
+func (s *Session) sendDSN(client *ses.Client, configSet *string, reports []dsnReport) {
+	if len(reports) == 0 || s.from == "" || s.nullSender {
+		return
+	}
+
+	from := s.backend.dsnFrom
+	if from == "" {
+		from = "MAILER-DAEMON@" + addressDomain(s.from)
+	}
+
+	input := &ses.SendRawEmailInput{
+		ConfigurationSetName: configSet,
+		Source:               &from,
+		Destinations:         []string{s.from},
+		RawMessage:           &types.RawMessage{Data: s.buildDSN(from, reports, time.Now())},
+	}
+	if _, err := s.send(client, input); err != nil {
+		log.Printf("ERROR: unable to send delivery status notification to %s: %v", s.from, err)
+		s.backend.metrics.dsnSent.With(prometheus.Labels{"result": "failed"}).Inc()
+		return
+	}
+	log.Printf("sent delivery status notification to %s for %d recipients", s.from, len(reports))
+	s.backend.metrics.dsnSent.With(prometheus.Labels{"result": "sent"}).Inc()
+}
+
+// buildDSN formats an RFC 3464 delivery status notification for reports,
+// returning the headers of the message, or all of it with RET=FULL
+func (s *Session) buildDSN(from string, reports []dsnReport, now time.Time) []byte {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	var text strings.Builder
+	failed := false
+	for _, r := range reports {
+		if r.action == "failed" {
+			failed = true
+		}
+	}
+	if failed {
+		text.WriteString("Your message could not be delivered to some of its recipients.\r\n\r\n")
+	} else {
+		text.WriteString("Your message was relayed to the recipients below, which may not send\r\nfurther notifications.\r\n\r\n")
+	}
+	for _, r := range reports {
+		if r.action == "failed" {
+			fmt.Fprintf(&text, "<%s>: %s\r\n", r.recipient, strings.TrimPrefix(r.diagnostic, "smtp; "))
+		} else {
+			fmt.Fprintf(&text, "<%s>: %s\r\n", r.recipient, r.action)
+		}
+	}
+	part, _ := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	part.Write([]byte(text.String()))
+
+	var status strings.Builder
+	fmt.Fprintf(&status, "Reporting-MTA: dns; %s\r\n", s.backend.hostname)
+	if s.envID != "" {
+		fmt.Fprintf(&status, "Original-Envelope-Id: %s\r\n", s.envID)
+	}
+	fmt.Fprintf(&status, "Arrival-Date: %s\r\n", s.trace.start.Format(time.RFC1123Z))
+	for _, r := range reports {
+		status.WriteString("\r\n")
+		if opts := s.rcptDSN[r.recipient]; opts != nil && opts.OriginalRecipient != "" {
+			fmt.Fprintf(&status, "Original-Recipient: %s; %s\r\n", opts.OriginalRecipientType, opts.OriginalRecipient)
+		}
+		fmt.Fprintf(&status, "Final-Recipient: rfc822; %s\r\n", r.recipient)
+		fmt.Fprintf(&status, "Action: %s\r\n", r.action)
+		fmt.Fprintf(&status, "Status: %d.%d.%d\r\n", r.status[0], r.status[1], r.status[2])
+		if r.diagnostic != "" {
+			fmt.Fprintf(&status, "Diagnostic-Code: %s\r\n", r.diagnostic)
+		}
+	}
+	part, _ = w.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	part.Write([]byte(status.String()))
+
+	// The whole message is only returned if the notification stays well
+	// within the size SES accepts
+	if s.dsnReturn == smtp.DSNReturnFull && len(s.data) < SesSizeLimit-64*1024 {
+		part, _ = w.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/rfc822"}})
+		part.Write(s.data)
+	} else {
+		header, _, _ := splitEntity(s.data)
+		part, _ = w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/rfc822-headers"}})
+		part.Write(header)
+	}
+	w.Close()
+
+	subject := "Delivery Status Notification (Relayed)"
+	if failed {
+		subject = "Delivery Status Notification (Failure)"
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: Mail Delivery System <%s>\r\n", from)
+	fmt.Fprintf(&msg, "To: <%s>\r\n", s.from)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	msg.WriteString("Auto-Submitted: auto-replied\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/report; report-type=delivery-status; boundary=%q\r\n", w.Boundary())
+	msg.WriteString("\r\n")
+	msg.Write(body.Bytes())
+	return msg.Bytes()
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// has8bit reports whether data contains any bytes with the high bit set
+func has8bit(data []byte) bool {
+	for _, c := range data {
+		if c >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+// encode8bit re-encodes every part of a message that contains 8-bit data as
+// quoted-printable, for text, or base64 so that the body of the message is
+// 7-bit clean. Headers are left as they are and parts that are already
+// encoded are not touched.
+func encode8bit(data []byte) ([]byte, error) {
+	return encodeEntity(data, true, has8bit)
+}
+
+// splitEntity splits a MIME entity into its header, including the blank line
+// that terminates it, and its body. It also returns the line ending used.
+func splitEntity(data []byte) ([]byte, []byte, string) {
+	if bytes.HasPrefix(data, []byte("\r\n")) {
+		return data[:2], data[2:], "\r\n"
+	} else if bytes.HasPrefix(data, []byte("\n")) {
+		return data[:1], data[1:], "\n"
+	}
+
+	crlf := bytes.Index(data, []byte("\r\n\r\n"))
+	lf := bytes.Index(data, []byte("\n\n"))
+	switch {
+	case crlf >= 0 && (lf < 0 || crlf < lf):
+		return data[:crlf+4], data[crlf+4:], "\r\n"
+	case lf >= 0:
+		return data[:lf+2], data[lf+2:], "\n"
+	case bytes.Contains(data, []byte("\r\n")):
+		return data, nil, "\r\n"
+	default:
+		return data, nil, "\n"
+	}
+}
+
+// encodeEntity re-encodes the parts of a MIME entity whose bodies need
+// encoding, as reported by needs
+func encodeEntity(data []byte, top bool, needs func([]byte) bool) ([]byte, error) {
+	rawHeader, body, eol := splitEntity(data)
+	if !needs(body) {
+		return data, nil
+	}
+
+	h, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(rawHeader))).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	switch cte := strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))); cte {
+	case "", "7bit", "8bit", "binary":
+	default:
+		return data, nil
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "":
+		body, err = encodeMultipart(body, params["boundary"], needs)
+		if err != nil {
+			return nil, err
+		}
+	case mediaType == "message/rfc822":
+		// Embedded messages may not themselves be encoded, only their parts
+		body, err = encodeEntity(body, false, needs)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		var buf bytes.Buffer
+		cte := "base64"
+		if strings.HasPrefix(mediaType, "text/") {
+			cte = "quoted-printable"
+			w := quotedprintable.NewWriter(&buf)
+			w.Write(body)
+			w.Close()
+		} else {
+			encodeBase64(&buf, body, eol)
+		}
+		body = buf.Bytes()
+		rawHeader = setHeader(rawHeader, "Content-Transfer-Encoding", cte, eol)
+	}
+
+	if top && h.Get("MIME-Version") == "" {
+		rawHeader = setHeader(rawHeader, "MIME-Version", "1.0", eol)
+	}
+
+	return append(rawHeader, body...), nil
+}
+
+// encodeMultipart re-encodes each part of a multipart body, keeping the
+// preamble, delimiters and epilogue as they are
+func encodeMultipart(body []byte, boundary string, needs func([]byte) bool) ([]byte, error) {
+	delim := "--" + boundary
+	var out, part bytes.Buffer
+	inPart, done := false, false
+
+	flush := func() error {
+		if !inPart {
+			out.Write(part.Bytes())
+			part.Reset()
+			return nil
+		}
+
+		// The line ending before a delimiter belongs to the delimiter
+		raw := part.Bytes()
+		end := len(raw)
+		if bytes.HasSuffix(raw, []byte("\r\n")) {
+			end -= 2
+		} else if bytes.HasSuffix(raw, []byte("\n")) {
+			end--
+		}
+
+		encoded, err := encodeEntity(raw[:end], false, needs)
+		if err != nil {
+			return err
+		}
+		out.Write(encoded)
+		out.Write(raw[end:])
+		part.Reset()
+		return nil
+	}
+
+	for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+		if done {
+			out.Write(line)
+			continue
+		}
+
+		trimmed := strings.TrimRight(string(line), " \t\r\n")
+		switch trimmed {
+		case delim, delim + "--":
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			out.Write(line)
+			inPart = true
+			done = trimmed != delim
+		default:
+			part.Write(line)
+		}
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// encodeBase64 writes data to buf as base64 broken into 76 character lines
+func encodeBase64(buf *bytes.Buffer, data []byte, eol string) {
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 76 {
+		buf.WriteString(enc[:76] + eol)
+		enc = enc[76:]
+	}
+	buf.WriteString(enc + eol)
+}
+
+// setHeader replaces any occurrences of the header field name in rawHeader,
+// including continuation lines, with a single field set to value
+func setHeader(rawHeader []byte, name, value, eol string) []byte {
+	return addHeader(removeHeader(rawHeader, name), name, value, eol)
+}
+
+// removeHeader removes every occurrence of the header field name from
+// rawHeader, including continuation lines
+func removeHeader(rawHeader []byte, name string) []byte {
+	var out bytes.Buffer
+	skipping := false
+	for _, line := range bytes.SplitAfter(rawHeader, []byte("\n")) {
+		if skipping && (bytes.HasPrefix(line, []byte(" ")) || bytes.HasPrefix(line, []byte("\t"))) {
+			continue
+		}
+		skipping = false
+		if colon := bytes.IndexByte(line, ':'); colon > 0 && strings.EqualFold(string(line[:colon]), name) {
+			skipping = true
+			continue
+		}
+		out.Write(line)
+	}
+	return out.Bytes()
+}
+
+// addHeader adds a header field to the end of rawHeader, before the blank
+// line that terminates it
+func addHeader(rawHeader []byte, name, value, eol string) []byte {
+	end := len(rawHeader)
+	if bytes.HasSuffix(rawHeader, []byte("\r\n\r\n")) || bytes.HasSuffix(rawHeader, []byte("\r\n")) && end == 2 {
+		end -= 2
+	} else if bytes.HasSuffix(rawHeader, []byte("\n\n")) || bytes.HasSuffix(rawHeader, []byte("\n")) && end == 1 {
+		end--
+	}
+
+	out := make([]byte, 0, len(rawHeader)+len(name)+len(value)+6)
+	out = append(out, rawHeader[:end]...)
+	if end > 0 && out[end-1] != '\n' {
+		out = append(out, eol...)
+	}
+	out = append(out, name+": "+value+eol...)
+	return append(out, rawHeader[end:]...)
+}
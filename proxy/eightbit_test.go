@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestEncode8bit(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      string
+		wantCTEs []string
+	}{
+		{"7-bit", message("Hello\r\n", "Subject: Plain"), nil},
+		{"8-bit text", message("Héllo wörld\r\n", "Subject: Text", "Content-Type: text/plain; charset=utf-8"), []string{"quoted-printable"}},
+		{"8-bit without content type", message("Héllo\r\n", "Subject: Text"), []string{"quoted-printable"}},
+		{
+			"multipart",
+			message("--b\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nHéllo\r\n--b\r\nContent-Type: application/octet-stream\r\n\r\n\xff\xfe\x00\x01\r\n--b--\r\n",
+				"Subject: Mixed", "MIME-Version: 1.0", "Content-Type: multipart/mixed; boundary=b"),
+			[]string{"quoted-printable", "base64"},
+		},
+		{
+			"already encoded",
+			message("--b\r\nContent-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n\r\nSGVsbG8=\r\n--b\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nHéllo\r\n--b--\r\n",
+				"Subject: Mixed", "MIME-Version: 1.0", "Content-Type: multipart/mixed; boundary=b"),
+			[]string{"base64", "quoted-printable"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := encode8bit([]byte(tt.msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if has8bit(encoded) {
+				t.Errorf("encoded message still contains 8-bit data:\n%s", encoded)
+			}
+
+			var ctes []string
+			for _, line := range strings.Split(string(encoded), "\r\n") {
+				if v, ok := strings.CutPrefix(line, "Content-Transfer-Encoding: "); ok {
+					ctes = append(ctes, v)
+				}
+			}
+			if strings.Join(ctes, ",") != strings.Join(tt.wantCTEs, ",") {
+				t.Errorf("content transfer encodings %v, want %v", ctes, tt.wantCTEs)
+			}
+		})
+	}
+}
+
+func TestEncode8bitRoundTrip(t *testing.T) {
+	body := "Héllo wörld, a line with ümlauts and = signs\r\n"
+	encoded, err := encode8bit([]byte(message(body, "Subject: Text", "Content-Type: text/plain; charset=utf-8")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := msg.Header.Get("MIME-Version"); v != "1.0" {
+		t.Errorf("MIME-Version %q, want 1.0", v)
+	}
+	decoded, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded) != body {
+		t.Errorf("decoded body %q, want %q", decoded, body)
+	}
+}
+
+func TestData8bit(t *testing.T) {
+	tests := []struct {
+		name         string
+		undeclared   string
+		declared     string
+		body         smtp.BodyType
+		msgBody      string
+		wantCode     int
+		wantSent8bit bool
+	}{
+		{"7-bit", "reject", "encode", "", "Hello", 250, false},
+		{"declared passed", "reject", "pass", smtp.Body8BitMIME, "Héllo", 250, true},
+		{"declared encoded", "reject", "encode", smtp.Body8BitMIME, "Héllo", 250, false},
+		{"undeclared passed", "pass", "pass", "", "Héllo", 250, true},
+		{"undeclared rejected", "reject", "pass", "", "Héllo", 550, false},
+		{"undeclared encoded", "encode", "pass", "", "Héllo", 250, false},
+		{"declared 7-bit", "reject", "encode", smtp.Body7Bit, "Héllo", 550, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Undeclared8bit = tt.undeclared
+			cfg.Declared8bit = tt.declared
+			_, addr := startServer(t, cfg)
+
+			tc := rawDial(t, addr)
+			mail := "MAIL FROM:<sender@example.com>"
+			if tt.body != "" {
+				mail += " BODY=" + string(tt.body)
+			}
+			if code, msg := rawCmd(tc, mail); code != 250 {
+				t.Fatalf("MAIL: %d %s", code, msg)
+			}
+			if code, msg := rawCmd(tc, "RCPT TO:<rcpt@example.com>"); code != 250 {
+				t.Fatalf("RCPT: %d %s", code, msg)
+			}
+
+			code, msg := rawData(tc, message(tt.msgBody+"\r\n", "Subject: Test", "Content-Type: text/plain; charset=utf-8"))
+			if code != tt.wantCode {
+				t.Fatalf("DATA reply %d %s, want %d", code, msg, tt.wantCode)
+			}
+			if code != 250 {
+				return
+			}
+
+			if sent := cfg.Mailbox.List()[0].Data; has8bit(sent) != tt.wantSent8bit {
+				t.Errorf("sent message has 8-bit data %t, want %t:\n%s", has8bit(sent), tt.wantSent8bit, sent)
+			}
+		})
+	}
+}
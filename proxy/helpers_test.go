@@ -0,0 +1,293 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"code.crute.us/mcrute/ses-smtpd-proxy/mailbox"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// testConfig returns the configuration of a proxy in test receiver mode,
+// with its own metrics registry and static credentials so that nothing is
+// fetched from the environment
+func testConfig() Config {
+	return Config{
+		Mailbox:     mailbox.New(0),
+		Registerer:  prometheus.NewRegistry(),
+		Credentials: credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+		AWSRegion:   "us-east-1",
+	}
+}
+
+// fakeSES is an SES query API endpoint that records the messages sent with
+// SendRawEmail and answers with the error returned by respond, or success.
+// The identities in verified are listed as verified in the account.
+type fakeSES struct {
+	mu       sync.Mutex
+	sends    []url.Values
+	respond  func(form url.Values) *fakeSESError
+	verified []string
+}
+
+// fakeSESError is an error returned by a fakeSES
+type fakeSESError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+// startFakeSES starts a fake SES endpoint, respond may be nil to accept every
+// message. The endpoint is stopped when the test ends.
+func startFakeSES(t testing.TB, respond func(form url.Values) *fakeSESError) (*fakeSES, string) {
+	t.Helper()
+
+	f := &fakeSES{respond: respond}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv.URL
+}
+
+func (f *fakeSES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := r.PostForm.Get("Action")
+
+	var sesErr *fakeSESError
+	if action == "SendRawEmail" && f.respond != nil {
+		sesErr = f.respond(r.PostForm)
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	if sesErr != nil {
+		w.WriteHeader(sesErr.Status)
+		fmt.Fprintf(w, `<ErrorResponse><Error><Type>Sender</Type><Code>%s</Code><Message>%s</Message></Error><RequestId>req</RequestId></ErrorResponse>`, sesErr.Code, html.EscapeString(sesErr.Message))
+		return
+	}
+
+	var result string
+	f.mu.Lock()
+	switch action {
+	case "SendRawEmail":
+		f.sends = append(f.sends, r.PostForm)
+		result = fmt.Sprintf("<MessageId>ses-%d</MessageId>", len(f.sends))
+	case "ListIdentities":
+		result = "<Identities>"
+		for _, id := range f.verified {
+			result += "<member>" + html.EscapeString(id) + "</member>"
+		}
+		result += "</Identities>"
+	case "GetIdentityVerificationAttributes":
+		result = "<VerificationAttributes>"
+		for _, id := range f.verified {
+			result += "<entry><key>" + html.EscapeString(id) + "</key><value><VerificationStatus>Success</VerificationStatus></value></entry>"
+		}
+		result += "</VerificationAttributes>"
+	}
+	f.mu.Unlock()
+	fmt.Fprintf(w, `<%[1]sResponse><%[1]sResult>%s</%[1]sResult><ResponseMetadata><RequestId>req</RequestId></ResponseMetadata></%[1]sResponse>`, action, result)
+}
+
+// Sends returns the forms of the SendRawEmail requests that succeeded
+func (f *fakeSES) Sends() []url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]url.Values(nil), f.sends...)
+}
+
+// sesConfig returns testConfig sending to the fake SES endpoint at endpoint
+// rather than to a mailbox
+func sesConfig(endpoint string) Config {
+	cfg := testConfig()
+	cfg.Mailbox = nil
+	cfg.AWSEndpointURL = endpoint
+	return cfg
+}
+
+// startServer starts a proxy with cfg on a free local port and returns it
+// and its address. The proxy is stopped when the test ends.
+func startServer(t testing.TB, cfg Config) (*Server, string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listener = l
+
+	s, err := New(cfg)
+	if err != nil {
+		l.Close()
+		t.Fatalf("New: %v", err)
+	}
+	serve(t, s)
+
+	return s, l.Addr().String()
+}
+
+// serve runs s, created with a Listener, until the test ends
+func serve(t testing.TB, s *Server) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// dial connects to the proxy at addr and greets it
+func dial(t testing.TB, addr string) *smtp.Client {
+	t.Helper()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	if err := c.Hello("client.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// rawDial connects to the proxy at addr and greets it without an SMTP
+// client, for commands the client would change
+func rawDial(t testing.TB, addr string) *textproto.Conn {
+	t.Helper()
+
+	tc, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tc.Close() })
+
+	if _, _, err := tc.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	if code, msg := rawCmd(tc, "EHLO client.example.com"); code != 250 {
+		t.Fatalf("EHLO: %d %s", code, msg)
+	}
+	return tc
+}
+
+// rawCmd sends cmd over tc and returns the reply
+func rawCmd(tc *textproto.Conn, cmd string) (int, string) {
+	if err := tc.PrintfLine("%s", cmd); err != nil {
+		return 0, err.Error()
+	}
+	code, msg, _ := tc.ReadResponse(0)
+	return code, msg
+}
+
+// rawData sends msg as the body of DATA over tc and returns the reply
+func rawData(tc *textproto.Conn, msg string) (int, string) {
+	if code, reply := rawCmd(tc, "DATA"); code != 354 {
+		return code, reply
+	}
+	w := tc.DotWriter()
+	w.Write([]byte(msg))
+	w.Close()
+	code, reply, _ := tc.ReadResponse(0)
+	return code, reply
+}
+
+// staticAuthenticator accepts the passwords in the map and returns the
+// username as the identity
+type staticAuthenticator map[string]string
+
+func (a staticAuthenticator) Authenticate(user, pass string) (string, error) {
+	if p, ok := a[user]; !ok || p != pass {
+		return "", ErrInvalidCredentials
+	}
+	return user, nil
+}
+
+// login authenticates c with PLAIN
+func login(c *smtp.Client, user, pass string) error {
+	return c.Auth(sasl.NewPlainClient("", user, pass))
+}
+
+// sendMessage sends msg from from to the recipients over c and returns the
+// reply to DATA, or the first error
+func sendMessage(c *smtp.Client, from string, to []string, msg string) (*smtp.DataResponse, error) {
+	if err := c.Mail(from, nil); err != nil {
+		return nil, err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return nil, err
+	}
+	return w.CloseWithResponse()
+}
+
+// message builds a message from header fields, given as "Name: value", and
+// a body
+func message(body string, fields ...string) string {
+	return strings.Join(fields, "\r\n") + "\r\n\r\n" + body
+}
+
+// replyCode returns the SMTP reply code of err, 0 if it isn't an SMTP error
+func replyCode(err error) int {
+	if e, ok := err.(*smtp.SMTPError); ok {
+		return e.Code
+	}
+	return 0
+}
+
+// metricValue returns the sum of the values of the counters or gauges named
+// name, with the given labels, gathered from reg
+func metricValue(t testing.TB, reg prometheus.Registerer, name string, labels map[string]string) float64 {
+	t.Helper()
+
+	families, err := reg.(prometheus.Gatherer).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sum float64
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if v, ok := labels[l.GetName()]; ok && v != l.GetValue() {
+					continue metrics
+				}
+			}
+			sum += m.GetCounter().GetValue() + m.GetGauge().GetValue()
+		}
+	}
+	return sum
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+)
+
+// verifiedIdentities holds the identities verified in the SES account of one
+// client, used to reject senders SES would refuse before the message is
+// transferred. Until they have been fetched every sender is allowed.
+type verifiedIdentities struct {
+	mu      sync.RWMutex
+	loaded  bool
+	domains map[string]bool
+	emails  map[string]bool
+}
+
+// allows reports whether SES may send from addr: the address itself is
+// verified, or its domain or a parent domain of it is
+func (v *verifiedIdentities) allows(addr string) bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	if !v.loaded || v.emails[strings.ToLower(addr)] {
+		return true
+	}
+	for domain := addressDomain(addr); domain != ""; {
+		if v.domains[domain] {
+			return true
+		}
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok {
+			break
+		}
+		domain = parent
+	}
+	return false
+}
+
+func (v *verifiedIdentities) set(domains, emails map[string]bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.loaded, v.domains, v.emails = true, domains, emails
+}
+
+// maxVerificationBatch is the most identities GetIdentityVerificationAttributes
+// accepts in one request
+const maxVerificationBatch = 100
+
+// fetchVerifiedIdentities returns the domains and email addresses that have
+// been verified in the SES account of client
+func fetchVerifiedIdentities(ctx context.Context, client *ses.Client) (map[string]bool, map[string]bool, error) {
+	var identities []string
+	p := ses.NewListIdentitiesPaginator(client, &ses.ListIdentitiesInput{})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		identities = append(identities, page.Identities...)
+	}
+
+	domains, emails := map[string]bool{}, map[string]bool{}
+	for len(identities) > 0 {
+		batch := identities[:min(len(identities), maxVerificationBatch)]
+		identities = identities[len(batch):]
+
+		out, err := client.GetIdentityVerificationAttributes(ctx, &ses.GetIdentityVerificationAttributesInput{Identities: batch})
+		if err != nil {
+			return nil, nil, err
+		}
+		for id, attrs := range out.VerificationAttributes {
+			if attrs.VerificationStatus != types.VerificationStatusSuccess {
+				continue
+			}
+			if strings.Contains(id, "@") {
+				emails[strings.ToLower(id)] = true
+			} else {
+				domains[strings.ToLower(id)] = true
+			}
+		}
+	}
+	return domains, emails, nil
+}
+
+// newVerifiedSenders returns an empty set of verified identities for each
+// client senders are checked against: the proxy's own, those of users with
+// their own role and no sending authorization ARNs, and those of recipient
+// routes with their own role. Each client may be of another account or
+// region, with identities of its own.
+func newVerifiedSenders(sesClient *ses.Client, users map[string]*tenant, routes map[string]*recipientRoute) map[*ses.Client]*verifiedIdentities {
+	verified := map[*ses.Client]*verifiedIdentities{sesClient: {}}
+	for _, t := range users {
+		if t.sesClient != nil && !t.hasArns() {
+			verified[t.sesClient] = &verifiedIdentities{}
+		}
+	}
+	for _, r := range routes {
+		if r.sesClient != nil {
+			verified[r.sesClient] = &verifiedIdentities{}
+		}
+	}
+	return verified
+}
+
+// pollVerifiedIdentities fetches the verified identities of the SES account
+// of each client senders are checked against straight away and then every
+// interval, randomized by the configured jitter, until ctx is canceled. If a
+// fetch fails the identities from the last one are kept.
+func (s *Server) pollVerifiedIdentities(ctx context.Context, interval time.Duration) {
+	for {
+		for client, verified := range s.backend.verifiedSenders {
+			region := client.Options().Region
+			domains, emails, err := fetchVerifiedIdentities(ctx, client)
+			if err != nil {
+				log.Printf("ERROR: unable to fetch SES verified identities in region %s: %v", region, err)
+				continue
+			}
+			log.Printf("Checking senders against %d verified domains and %d verified addresses in SES region %s", len(domains), len(emails), region)
+			verified.set(domains, emails)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jittered(interval, s.cfg.PollJitter)):
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+)
+
+func TestVerifiedSendersPerClient(t *testing.T) {
+	fake, endpoint := startFakeSES(t, nil)
+	fake.verified = []string{"example.com", "partner.example"}
+	routeFake, routeEndpoint := startFakeSES(t, nil)
+	routeFake.verified = []string{"partner.example"}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := sesConfig(endpoint)
+	cfg.Listener = l
+	cfg.VerifySenderInterval = time.Hour
+	s, err := New(cfg)
+	if err != nil {
+		l.Close()
+		t.Fatalf("New: %v", err)
+	}
+
+	// A route only has a client of its own with a role, which would be
+	// assumed with STS, so it is given a client of the second fake instead
+	routeClient := ses.New(ses.Options{
+		Region:       "eu-west-1",
+		BaseEndpoint: aws.String(routeEndpoint),
+		Credentials:  credentials.NewStaticCredentialsProvider("AKID", "SECRET", ""),
+	})
+	s.backend.recipientRoutes = map[string]*recipientRoute{
+		"routed.example": {name: "partner role", sesClient: routeClient},
+	}
+	s.backend.verifiedSenders = newVerifiedSenders(s.backend.sesClient, nil, s.backend.recipientRoutes)
+	serve(t, s)
+
+	waitFor(t, "the verified identities", func() bool {
+		for _, v := range s.backend.verifiedSenders {
+			v.mu.RLock()
+			loaded := v.loaded
+			v.mu.RUnlock()
+			if !loaded {
+				return false
+			}
+		}
+		return true
+	})
+
+	c := dial(t, l.Addr().String())
+
+	// Verified in the proxy's account only, so it can't be sent to
+	// recipients routed through the other one
+	if err := c.Mail("sender@example.com", nil); err != nil {
+		t.Fatalf("MAIL of a sender verified in the proxy's account: %v", err)
+	}
+	if err := c.Rcpt("rcpt@example.net", nil); err != nil {
+		t.Errorf("RCPT of a recipient sent with the proxy's account: %v", err)
+	}
+	if code := replyCode(c.Rcpt("rcpt@routed.example", nil)); code != 550 {
+		t.Errorf("RCPT of a recipient routed through an account the sender isn't verified in got code %d, want 550", code)
+	}
+	if err := c.Reset(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Verified in both accounts
+	if _, err := sendMessage(c, "sender@partner.example", []string{"rcpt@example.net", "rcpt@routed.example"}, message("Hello", "Subject: Test")); err != nil {
+		t.Fatalf("send from a sender verified in both accounts: %v", err)
+	}
+	if n := len(fake.Sends()); n != 1 {
+		t.Errorf("sent %d messages with the proxy's account, want 1", n)
+	}
+	if n := len(routeFake.Sends()); n != 1 {
+		t.Errorf("sent %d messages with the route's account, want 1", n)
+	}
+
+	if code := replyCode(c.Mail("sender@unverified.example", nil)); code != 553 {
+		t.Errorf("MAIL of an unverified sender got code %d, want 553", code)
+	}
+}
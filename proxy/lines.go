@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"bytes"
+	"slices"
+)
+
+// maxLineLength is the longest line RFC 5322 allows, not counting the CRLF
+const maxLineLength = 998
+
+// normalizeLineEndings converts bare LF and CR line endings in data to CRLF
+// and reports whether any were found. SMTP only recognizes lines ending in
+// CRLF, so a line after a bare line ending that was dot-stuffed by the client
+// still starts with two dots. If unstuff is set one of them is removed.
+func normalizeLineEndings(data []byte, unstuff bool) ([]byte, bool) {
+	bare := false
+	for i, c := range data {
+		if c == '\n' && (i == 0 || data[i-1] != '\r') || c == '\r' && (i == len(data)-1 || data[i+1] != '\n') {
+			bare = true
+			break
+		}
+	}
+	if !bare {
+		return data, false
+	}
+
+	out := make([]byte, 0, len(data)+len(data)/32)
+	afterBare := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if afterBare && unstuff && c == '.' && i+1 < len(data) && data[i+1] == '.' {
+			i++
+		}
+		afterBare = false
+
+		switch {
+		case c == '\r' && i+1 < len(data) && data[i+1] == '\n':
+			out = append(out, '\r', '\n')
+			i++
+		case c == '\r' || c == '\n':
+			out = append(out, '\r', '\n')
+			afterBare = true
+		default:
+			out = append(out, data[i])
+		}
+	}
+	return out, true
+}
+
+// hasLongLine reports whether data contains a line longer than RFC 5322
+// allows
+func hasLongLine(data []byte) bool {
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		if len(bytes.TrimSuffix(line, []byte("\r"))) > maxLineLength {
+			return true
+		}
+	}
+	return false
+}
+
+// foldLongLines folds header lines that are too long at whitespace and
+// re-encodes body parts with lines that are too long as quoted-printable, for
+// text, or base64. Header lines without whitespace to fold at are left as
+// they are.
+func foldLongLines(data []byte) ([]byte, error) {
+	rawHeader, body, eol := splitEntity(data)
+	if hasLongLine(rawHeader) {
+		data = slices.Concat(foldHeader(rawHeader, eol), body)
+	}
+	return encodeEntity(data, true, hasLongLine)
+}
+
+// foldHeader breaks header lines that are too long before the last
+// whitespace that keeps them short enough. Unfolding the header restores the
+// original lines.
+func foldHeader(rawHeader []byte, eol string) []byte {
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(rawHeader, []byte("\n")) {
+		for len(bytes.TrimRight(line, "\r\n")) > maxLineLength {
+			i := bytes.LastIndexAny(line[1:maxLineLength], " \t") + 1
+			if i == 0 {
+				break
+			}
+			out.Write(line[:i])
+			out.WriteString(eol)
+			line = line[i:]
+		}
+		out.Write(line)
+	}
+	return out.Bytes()
+}
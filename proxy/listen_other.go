@@ -0,0 +1,17 @@
+//go:build !(linux || darwin || freebsd)
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// listen opens the listening socket, the backlog and SO_REUSEPORT can't be
+// set on this platform
+func listen(network, addr string, backlog int, reusePort bool) (net.Listener, error) {
+	if backlog > 0 || reusePort {
+		return nil, errors.New("the listen backlog and SO_REUSEPORT are not supported on this platform")
+	}
+	return net.Listen(network, addr)
+}
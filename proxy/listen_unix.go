@@ -0,0 +1,54 @@
+//go:build linux || darwin || freebsd
+
+package proxy
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listen opens the listening socket, setting SO_REUSEPORT before it is bound
+// if reusePort is set, and replacing the kernel default accept backlog if
+// backlog is greater than zero. Calling listen(2) again on a listening socket
+// changes its backlog, the kernel still caps it at its own maximum
+// (net.core.somaxconn on Linux, kern.ipc.somaxconn on BSDs).
+func listen(network, addr string, backlog int, reusePort bool) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if reusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			if err := c.Control(func(fd uintptr) {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+
+	l, err := lc.Listen(context.Background(), network, addr)
+	if err != nil || backlog <= 0 {
+		return l, err
+	}
+
+	rc, err := l.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	var lerr error
+	if err := rc.Control(func(fd uintptr) {
+		lerr = unix.Listen(int(fd), backlog)
+	}); err != nil {
+		lerr = err
+	}
+	if lerr != nil {
+		l.Close()
+		return nil, lerr
+	}
+
+	return l, nil
+}
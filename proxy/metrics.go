@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+type metrics struct {
+	emailSent       prometheus.Counter
+	emailError      *prometheus.CounterVec
+	sesError        prometheus.Counter
+	sendRetries     *prometheus.CounterVec
+	breakerState    prometheus.Gauge
+	breakerTrips    prometheus.Counter
+	sandboxRejected prometheus.Counter
+	mirrorSends     *prometheus.CounterVec
+	resets          *prometheus.CounterVec
+	policyDecision  *prometheus.CounterVec
+	sendRateLimit   prometheus.Gauge
+	smtpResponse    *prometheus.CounterVec
+	dataTimeout     prometheus.Counter
+	sesQuota        *prometheus.GaugeVec
+	clientHelo      *prometheus.CounterVec
+	refusedDraining prometheus.Counter
+	refusedNetwork  prometheus.Counter
+
+	sesQuotaRemaining    prometheus.Gauge
+	fromHeadersRewritten prometheus.Counter
+	recipientsRewritten  prometheus.Counter
+	recipientDomain      *prometheus.CounterVec
+	sendWorkers          prometheus.Gauge
+	sendQueueDepth       *prometheus.GaugeVec
+	suppressionAdded     *prometheus.CounterVec
+	bounceConsumerUp     prometheus.Gauge
+	bounceNotifications  *prometheus.CounterVec
+	configSetRateLimited *prometheus.CounterVec
+	commandsThrottled    prometheus.Counter
+	duplicateRecipients  prometheus.Counter
+	bccHeadersStripped   prometheus.Counter
+	fromHeadersAdded     prometheus.Counter
+	lineEndingsFixed     prometheus.Counter
+	longLinesFolded      prometheus.Counter
+	parseFailures        *prometheus.CounterVec
+	reencoded8bit        *prometheus.CounterVec
+	dsnSent              *prometheus.CounterVec
+	authAttempts         *prometheus.CounterVec
+	authLockouts         *prometheus.CounterVec
+	authLockedOut        *prometheus.CounterVec
+	userSessions         *prometheus.GaugeVec
+	userSessionsRejected prometheus.Counter
+	certLogins           *prometheus.CounterVec
+	contentDenied        *prometheus.CounterVec
+	configSetMissing     *prometheus.CounterVec
+	configSetMissingNow  *prometheus.GaugeVec
+}
+
+// newMetrics creates the proxy metrics and registers them with reg
+func newMetrics(reg prometheus.Registerer) *metrics {
+	f := promauto.With(reg)
+
+	return &metrics{
+		emailSent: f.NewCounter(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "email_send_success_total",
+			Help:      "Total number of successfuly sent emails",
+		}),
+		emailError: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "email_send_fail_total",
+			Help:      "Total number emails that failed to send",
+		}, []string{"type"}),
+		sesError: f.NewCounter(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "ses_error_total",
+			Help:      "Total number errors with SES",
+		}),
+		sendRetries: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "ses_send_retries_total",
+			Help:      "Total number of sends retried after a transient SES error by reason",
+		}, []string{"reason"}),
+		breakerState: f.NewGauge(prometheus.GaugeOpts{
+			Namespace: "smtpd",
+			Name:      "ses_breaker_state",
+			Help:      "State of the SES circuit breaker: 0 closed, 1 open, 2 half open",
+		}),
+		breakerTrips: f.NewCounter(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "ses_breaker_trips_total",
+			Help:      "Total number of times the SES circuit breaker opened",
+		}),
+		resets: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "reset_total",
+			Help:      "Total number of session resets by whether they followed a message, aborted a transaction or were idle",
+		}, []string{"kind"}),
+		mirrorSends: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "mirror_sends_total",
+			Help:      "Total number of messages mirrored to the mirror SES target by result",
+		}, []string{"result"}),
+		sandboxRejected: f.NewCounter(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "ses_sandbox_rejected_total",
+			Help:      "Total number of sends rejected because the SES account is in the sandbox and a recipient is not verified",
+		}),
+		policyDecision: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "policy_decision_total",
+			Help:      "Total number of policy rejections by policy and decision",
+		}, []string{"policy", "decision"}),
+		sendRateLimit: f.NewGauge(prometheus.GaugeOpts{
+			Namespace: "smtpd",
+			Name:      "send_rate_limit",
+			Help:      "Currently effective send rate limit in messages per second",
+		}),
+		smtpResponse: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "smtp_response_total",
+			Help:      "Total number of SMTP responses to MAIL, RCPT and DATA by reply code",
+		}, []string{"code"}),
+		dataTimeout: f.NewCounter(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "data_timeout_total",
+			Help:      "Total number of DATA transfers aborted for exceeding the DATA read timeout",
+		}),
+		sesQuota: f.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "smtpd",
+			Name:      "ses_send_quota",
+			Help:      "SES account send quota as of the last poll",
+		}, []string{"quota"}),
+		sesQuotaRemaining: f.NewGauge(prometheus.GaugeOpts{
+			Namespace: "smtpd",
+			Name:      "ses_send_quota_remaining",
+			Help:      "Estimated number of messages left in the SES 24 hour send quota",
+		}),
+		fromHeadersRewritten: f.NewCounter(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "from_headers_rewritten_total",
+			Help:      "Total number of messages whose From header was replaced by the rewrite From address",
+		}),
+		recipientsRewritten: f.NewCounter(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "recipients_rewritten_total",
+			Help:      "Total number of recipients whose address was changed by the recipient rewrite rules",
+		}),
+		recipientDomain: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "recipient_domain_decisions_total",
+			Help:      "Total number of recipients checked against the recipient domain lists by decision",
+		}, []string{"decision"}),
+		clientHelo: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "client_helo_total",
+			Help:      "Total number of sessions that started a mail transaction by kind of HELO/EHLO name",
+		}, []string{"kind"}),
+		refusedNetwork: f.NewCounter(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "connections_refused_network_total",
+			Help:      "Total number of connections refused with a 554 because the client is not in an allowed network",
+		}),
+		refusedDraining: f.NewCounter(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "connections_refused_draining_total",
+			Help:      "Total number of connections refused with a 421 because the server was draining",
+		}),
+		sendWorkers: f.NewGauge(prometheus.GaugeOpts{
+			Namespace: "smtpd",
+			Name:      "send_workers",
+			Help:      "Number of workers sending messages to SES at the same time, 0 if sends aren't bounded",
+		}),
+		sendQueueDepth: f.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "smtpd",
+			Name:      "send_queue_depth",
+			Help:      "Number of sends waiting for a free send worker by priority",
+		}, []string{"priority"}),
+		suppressionAdded: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "local_suppression_added_total",
+			Help:      "Total number of recipients added to the local suppression list from SES notifications by reason",
+		}, []string{"reason"}),
+		bounceConsumerUp: f.NewGauge(prometheus.GaugeOpts{
+			Namespace: "smtpd",
+			Name:      "bounce_consumer_up",
+			Help:      "1 if the last receive from the bounce queue succeeded, 0 while receives fail",
+		}),
+		bounceNotifications: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "bounce_notifications_total",
+			Help:      "Total number of SES notifications received from the bounce queue by result",
+		}, []string{"result"}),
+		configSetRateLimited: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "config_set_rate_limited_total",
+			Help:      "Total number of messages deferred by the send rate limit of their configuration set",
+		}, []string{"configuration_set"}),
+		commandsThrottled: f.NewCounter(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "commands_throttled_total",
+			Help:      "Total number of SMTP commands delayed by the per-session command rate limit",
+		}),
+		duplicateRecipients: f.NewCounter(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "duplicate_recipients_total",
+			Help:      "Total number of duplicate recipients removed from messages",
+		}),
+		bccHeadersStripped: f.NewCounter(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "bcc_headers_stripped_total",
+			Help:      "Total number of messages whose Bcc header was removed before sending",
+		}),
+		fromHeadersAdded: f.NewCounter(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "from_headers_added_total",
+			Help:      "Total number of messages sent with the default From header because they had none",
+		}),
+		lineEndingsFixed: f.NewCounter(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "line_endings_normalized_total",
+			Help:      "Total number of messages whose bare LF or CR line endings were converted to CRLF",
+		}),
+		longLinesFolded: f.NewCounter(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "long_lines_folded_total",
+			Help:      "Total number of messages whose overlong lines were folded or re-encoded",
+		}),
+		parseFailures: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "parse_failures_total",
+			Help:      "Total number of messages that could not be parsed by the feature that needed to",
+		}, []string{"feature"}),
+		reencoded8bit: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "8bit_reencoded_total",
+			Help:      "Total number of messages whose 8-bit parts were re-encoded by reason",
+		}, []string{"reason"}),
+		dsnSent: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "dsn_sent_total",
+			Help:      "Total number of delivery status notifications sent by the proxy by result",
+		}, []string{"result"}),
+		authAttempts: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "auth_attempts_total",
+			Help:      "Total number of SMTP AUTH attempts by result",
+		}, []string{"result"}),
+		authLockouts: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "auth_lockouts_total",
+			Help:      "Total number of client addresses or usernames locked out after failed authentications by scope",
+		}, []string{"scope"}),
+		authLockedOut: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "auth_locked_out_total",
+			Help:      "Total number of authentication attempts refused because the client address or username was locked out by scope",
+		}, []string{"scope"}),
+		userSessions: f.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "smtpd",
+			Name:      "user_active_sessions",
+			Help:      "Number of active sessions by authenticated user, users that aren't configured are counted as other",
+		}, []string{"user"}),
+		userSessionsRejected: f.NewCounter(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "user_sessions_rejected_total",
+			Help:      "Total number of authentications rejected because the user had reached their concurrent session limit",
+		}),
+		certLogins: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "client_cert_logins_total",
+			Help:      "Total number of sessions authenticated by TLS client certificate by identity, identities that aren't configured users are counted as other",
+		}, []string{"identity"}),
+		contentDenied: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "content_denylist_match_total",
+			Help:      "Total number of messages that matched a content denylist pattern by pattern name",
+		}, []string{"pattern"}),
+		configSetMissing: f.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "config_set_missing_total",
+			Help:      "Total number of sends SES rejected because their configuration set does not exist",
+		}, []string{"configuration_set"}),
+		configSetMissingNow: f.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "smtpd",
+			Name:      "config_set_missing",
+			Help:      "Whether SES reported the configuration set does not exist the last time it was used",
+		}, []string{"configuration_set"}),
+	}
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricsSeparateRegistries(t *testing.T) {
+	cfgA, cfgB := testConfig(), testConfig()
+	_, addrA := startServer(t, cfgA)
+	startServer(t, cfgB)
+
+	c := dial(t, addrA)
+	if _, err := sendMessage(c, "sender@example.com", []string{"rcpt@example.com"}, message("Hello", "Subject: Test")); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	if v := metricValue(t, cfgA.Registerer, "smtpd_email_send_success_total", nil); v != 1 {
+		t.Errorf("first server sent %g messages, want 1", v)
+	}
+	if v := metricValue(t, cfgB.Registerer, "smtpd_email_send_success_total", nil); v != 0 {
+		t.Errorf("second server sent %g messages, want 0", v)
+	}
+}
+
+func TestMetricsNotRegisteredOnError(t *testing.T) {
+	cfg := testConfig()
+	cfg.MaxMessageSize = -1
+
+	if _, err := New(cfg); err == nil {
+		t.Fatal("New accepted an invalid configuration")
+	}
+
+	families, err := cfg.Registerer.(prometheus.Gatherer).Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 0 {
+		t.Errorf("rejected configuration registered %d metrics", len(families))
+	}
+
+	// The same registry can be used again once the configuration is fixed
+	cfg.MaxMessageSize = 0
+	if _, err := New(cfg); err != nil {
+		t.Fatalf("New: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+var errMimeTooDeep = errors.New("MIME structure nested too deeply")
+
+// checkMimeDepth walks the MIME tree of a message and returns errMimeTooDeep
+// as soon as the nesting exceeds max. The top level message is depth one.
+// Other errors mean the structure could not be parsed.
+func checkMimeDepth(data []byte, max int) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	return walkMime(textproto.MIMEHeader(msg.Header), msg.Body, 1, max)
+}
+
+func walkMime(h textproto.MIMEHeader, body io.Reader, depth, max int) error {
+	if depth > max {
+		return errMimeTooDeep
+	}
+
+	// Parts without a usable content type are leaves
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		boundary := params["boundary"]
+		if boundary == "" {
+			return fmt.Errorf("%s part has no boundary", mediaType)
+		}
+
+		mr := multipart.NewReader(body, boundary)
+		for {
+			p, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			if err := walkMime(p.Header, p, depth+1, max); err != nil {
+				return err
+			}
+		}
+	case mediaType == "message/rfc822":
+		// An encoded message can't be walked without decoding it first,
+		// which is more work than this check warrants
+		switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+		case "", "7bit", "8bit", "binary":
+		default:
+			return nil
+		}
+
+		msg, err := mail.ReadMessage(body)
+		if err != nil {
+			return err
+		}
+		return walkMime(textproto.MIMEHeader(msg.Header), msg.Body, depth+1, max)
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// nestedMessage builds a message whose body is nested depth-1 multiparts
+// deep, so that its MIME structure has depth levels
+func nestedMessage(depth int) string {
+	body := "Content-Type: text/plain\r\n\r\nHello\r\n"
+	for i := depth - 1; i > 0; i-- {
+		boundary := fmt.Sprintf("b%d", i)
+		body = fmt.Sprintf("Content-Type: multipart/mixed; boundary=%s\r\n\r\n--%s\r\n%s--%s--\r\n", boundary, boundary, body, boundary)
+	}
+	return "Subject: Nested\r\n" + body
+}
+
+func TestCheckMimeDepth(t *testing.T) {
+	rfc822 := message("Subject: Inner\r\nContent-Type: multipart/mixed; boundary=in\r\n\r\n--in\r\nContent-Type: text/plain\r\n\r\nHi\r\n--in--\r\n",
+		"Subject: Outer", "Content-Type: message/rfc822")
+
+	tests := []struct {
+		name      string
+		msg       string
+		max       int
+		wantDeep  bool
+		wantParse bool
+	}{
+		{"plain text", message("Hello", "Subject: Plain"), 1, false, false},
+		{"at limit", nestedMessage(5), 5, false, false},
+		{"over limit", nestedMessage(6), 5, true, false},
+		{"pathological", nestedMessage(1000), 10, true, false},
+		{"attached message at limit", rfc822, 3, false, false},
+		{"attached message over limit", rfc822, 2, true, false},
+		{"missing boundary", message("Hello", "Content-Type: multipart/mixed"), 5, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkMimeDepth([]byte(tt.msg), tt.max)
+			deep := errors.Is(err, errMimeTooDeep)
+			if deep != tt.wantDeep || (err != nil && !deep) != tt.wantParse {
+				t.Errorf("checkMimeDepth = %v, want too deep %t, parse error %t", err, tt.wantDeep, tt.wantParse)
+			}
+		})
+	}
+}
+
+func TestDataMimeDepth(t *testing.T) {
+	tests := []struct {
+		name           string
+		msg            string
+		onParseFailure string
+		wantCode       int
+	}{
+		{"shallow", nestedMessage(3), "", 250},
+		{"pathological", nestedMessage(1000), "", 550},
+		{"unparseable sent as is", message("Hello", "Content-Type: multipart/mixed"), "", 250},
+		{"unparseable rejected", message("Hello", "Content-Type: multipart/mixed"), "reject", 550},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.MaxMimeDepth = 10
+			cfg.OnParseFailure = tt.onParseFailure
+			_, addr := startServer(t, cfg)
+
+			c := dial(t, addr)
+			_, err := sendMessage(c, "sender@example.com", []string{"rcpt@example.com"}, tt.msg)
+			code := 250
+			if err != nil {
+				code = replyCode(err)
+			}
+			if code != tt.wantCode {
+				t.Errorf("DATA reply %d (%v), want %d", code, err, tt.wantCode)
+			}
+			if n := len(cfg.Mailbox.List()); (n == 1) != (tt.wantCode == 250) {
+				t.Errorf("delivered %d messages", n)
+			}
+		})
+	}
+}
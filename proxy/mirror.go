@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// maxMirrorsInFlight is the most mirrored sends waiting for SES at once,
+// further messages aren't mirrored until one finishes
+const maxMirrorsInFlight = 32
+
+// mirrorTimeout bounds how long a mirrored send may take
+const mirrorTimeout = 30 * time.Second
+
+// mirror sends a sample of the messages sent successfully to a second SES
+// target, such as a candidate region or account, to validate it with real
+// traffic. Mirrored sends happen in the background and their outcome never
+// affects the client.
+type mirror struct {
+	client   *ses.Client
+	v2       bool
+	percent  float64
+	limiter  *rate.Limiter
+	inFlight chan struct{}
+	sends    *prometheus.CounterVec
+}
+
+func newMirror(client *ses.Client, v2 bool, percent, maxRate float64, sends *prometheus.CounterVec) *mirror {
+	m := &mirror{
+		client:   client,
+		v2:       v2,
+		percent:  percent,
+		limiter:  rate.NewLimiter(rate.Inf, 1),
+		inFlight: make(chan struct{}, maxMirrorsInFlight),
+		sends:    sends,
+	}
+	if maxRate > 0 {
+		m.limiter = rate.NewLimiter(rate.Limit(maxRate), burstFor(maxRate))
+	}
+	return m
+}
+
+// sample reports whether a message should be mirrored
+func (m *mirror) sample() bool {
+	return rand.Float64()*100 < m.percent
+}
+
+// send mirrors inputs, the SES requests a message was sent with, in the
+// background. The message data and recipients are copied since the session
+// reuses their memory once the client is answered.
+func (m *mirror) send(inputs []*ses.SendRawEmailInput) {
+	if !m.limiter.Allow() {
+		m.sends.With(prometheus.Labels{"result": "rate limited"}).Inc()
+		return
+	}
+
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		m.sends.With(prometheus.Labels{"result": "dropped"}).Inc()
+		return
+	}
+
+	// The inputs point into the session, which is reused for the next
+	// message while the mirror sends, so what can change is copied
+	data := append([]byte(nil), inputs[0].RawMessage.Data...)
+	copies := make([]*ses.SendRawEmailInput, len(inputs))
+	for i, in := range inputs {
+		c := *in
+		c.Source = aws.String(aws.ToString(in.Source))
+		c.RawMessage = &types.RawMessage{Data: data}
+		c.Destinations = slices.Clone(in.Destinations)
+		copies[i] = &c
+	}
+
+	go func() {
+		defer func() { <-m.inFlight }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+		defer cancel()
+
+		for _, in := range copies {
+			if _, err := sendRawEmail(ctx, m.client, in, m.v2); err != nil {
+				log.Printf("mirror: message from %s to %v failed in %s: %v", aws.ToString(in.Source), in.Destinations, m.client.Options().Region, err)
+				m.sends.With(prometheus.Labels{"result": "failed"}).Inc()
+				continue
+			}
+			m.sends.With(prometheus.Labels{"result": "sent"}).Inc()
+		}
+	}()
+}
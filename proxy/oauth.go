@@ -0,0 +1,317 @@
+package proxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TokenValidator verifies the OAuth access tokens clients present with the
+// OAUTHBEARER and XOAUTH2 SASL mechanisms and returns the identity of the
+// user, which selects their per-user settings. Invalid tokens are reported
+// with ErrInvalidCredentials, other errors are treated as temporary failures.
+type TokenValidator interface {
+	Validate(token string) (identity string, err error)
+}
+
+// OAuthConfig configures the validation of OAuth access tokens, either as
+// JWTs signed by a key published at JWKSURL or by asking the authorization
+// server about them at IntrospectionURL
+type OAuthConfig struct {
+	// JWKSURL is the URL of the JSON Web Key Set whose keys sign the tokens
+	JWKSURL string `json:"jwks_url"`
+
+	// IntrospectionURL is an RFC 7662 token introspection endpoint, which
+	// is called with ClientID and ClientSecret as basic authentication
+	IntrospectionURL string `json:"introspection_url"`
+	ClientID         string `json:"client_id"`
+	ClientSecret     string `json:"client_secret"`
+
+	// Issuer and Audience, if set, must match the iss and aud claims of the
+	// token
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+
+	// IdentityClaim is the claim holding the identity of the user, "sub" if
+	// empty
+	IdentityClaim string `json:"identity_claim"`
+}
+
+// oauthTimeout bounds requests to the authorization server
+const oauthTimeout = 10 * time.Second
+
+// NewTokenValidator validates cfg and returns a validator for it
+func NewTokenValidator(cfg OAuthConfig) (TokenValidator, error) {
+	if cfg.IdentityClaim == "" {
+		cfg.IdentityClaim = "sub"
+	}
+
+	switch {
+	case cfg.JWKSURL != "" && cfg.IntrospectionURL != "":
+		return nil, errors.New("oauth: only one of jwks_url and introspection_url may be set")
+	case cfg.JWKSURL != "":
+		return &JWKSValidator{cfg: cfg, client: &http.Client{Timeout: oauthTimeout}}, nil
+	case cfg.IntrospectionURL != "":
+		return &IntrospectionValidator{cfg: cfg, client: &http.Client{Timeout: oauthTimeout}}, nil
+	}
+	return nil, errors.New("oauth: one of jwks_url and introspection_url is required")
+}
+
+// checkClaims checks the issuer and audience of a token and returns the
+// identity it was issued to
+func (cfg *OAuthConfig) checkClaims(claims map[string]any) (string, error) {
+	if cfg.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != cfg.Issuer {
+			return "", ErrInvalidCredentials
+		}
+	}
+
+	if cfg.Audience != "" {
+		found := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			found = aud == cfg.Audience
+		case []any:
+			for _, a := range aud {
+				if a == cfg.Audience {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return "", ErrInvalidCredentials
+		}
+	}
+
+	identity, _ := claims[cfg.IdentityClaim].(string)
+	if identity == "" {
+		return "", ErrInvalidCredentials
+	}
+	return identity, nil
+}
+
+// Limits on how often the JWKS is fetched again: at least once an hour, and
+// not more than once a minute for tokens signed with an unknown key
+const (
+	jwksMaxAge     = time.Hour
+	jwksMinRefresh = time.Minute
+)
+
+// JWKSValidator validates tokens that are JWTs signed with one of the keys
+// of a JSON Web Key Set. The keys are fetched when first needed and again
+// when they get old or a token is signed with a key that isn't known, which
+// picks up rotated keys.
+type JWKSValidator struct {
+	cfg    OAuthConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func (v *JWKSValidator) Validate(token string) (string, error) {
+	var keyErr error
+	parsed, err := jwt.Parse(token, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		var key crypto.PublicKey
+		key, keyErr = v.key(kid)
+		return key, keyErr
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithExpirationRequired(),
+	)
+	if keyErr != nil && !errors.Is(keyErr, ErrInvalidCredentials) {
+		return "", keyErr
+	}
+	if err != nil {
+		return "", ErrInvalidCredentials
+	}
+
+	return v.cfg.checkClaims(parsed.Claims.(jwt.MapClaims))
+}
+
+// key returns the key with the id kid, fetching the key set if needed
+func (v *JWKSValidator) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key, ok := v.keys[kid]
+	age := time.Since(v.fetched)
+	if ok && age < jwksMaxAge || !ok && v.keys != nil && age < jwksMinRefresh {
+		if !ok {
+			return nil, ErrInvalidCredentials
+		}
+		return key, nil
+	}
+
+	keys, err := v.fetch()
+	if err != nil {
+		// Keep using the keys already known while the key set can't be
+		// fetched
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+	v.keys = keys
+	v.fetched = time.Now()
+
+	if key, ok = keys[kid]; !ok {
+		return nil, ErrInvalidCredentials
+	}
+	return key, nil
+}
+
+// jsonWebKey is the part of a JSON Web Key needed to verify signatures
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (v *JWKSValidator) fetch() (map[string]crypto.PublicKey, error) {
+	resp, err := v.client.Get(v.cfg.JWKSURL)
+	if err != nil {
+		return nil, fmt.Errorf("oauth: fetching JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oauth: fetching JWKS: %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("oauth: decoding JWKS: %w", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		// Keys of unsupported types are skipped so that they don't stop
+		// the others from being used
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// IntrospectionValidator validates tokens by asking the authorization server
+// about each of them with RFC 7662 token introspection
+type IntrospectionValidator struct {
+	cfg    OAuthConfig
+	client *http.Client
+}
+
+func (v *IntrospectionValidator) Validate(token string) (string, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest(http.MethodPost, v.cfg.IntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("oauth: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if v.cfg.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(v.cfg.ClientID), url.QueryEscape(v.cfg.ClientSecret))
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("oauth: introspecting token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oauth: introspecting token: %s", resp.Status)
+	}
+
+	var claims map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return "", fmt.Errorf("oauth: decoding introspection response: %w", err)
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return "", ErrInvalidCredentials
+	}
+
+	return v.cfg.checkClaims(claims)
+}
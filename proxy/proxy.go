@@ -0,0 +1,1188 @@
+// Package proxy implements an SMTP server that relays the messages it
+// receives to SES using SendRawEmail. It is used by the ses-smtpd-proxy
+// command but can also be embedded in other programs.
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"code.crute.us/mcrute/ses-smtpd-proxy/events"
+	"code.crute.us/mcrute/ses-smtpd-proxy/mailbox"
+	"code.crute.us/mcrute/ses-smtpd-proxy/suppression"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	SesSizeLimit          = 10000000
+	SesV2SizeLimit        = 40000000
+	SesMaxDestinations    = 50
+	DefaultAddr           = ":2500"
+	DefaultTCPKeepAlive   = 30 * time.Second
+	DefaultSendRateWindow = time.Minute
+	DefaultSendRetryDelay = 500 * time.Millisecond
+)
+
+// Config is the configuration of a proxy Server. The zero value is a usable
+// configuration that listens on DefaultAddr and uses the default AWS SDK
+// configuration.
+type Config struct {
+	// Addr is the address on which to listen for SMTP connections. If empty
+	// DefaultAddr is used.
+	Addr string
+
+	// Listener, if set, is served instead of listening on Addr. It is used
+	// to serve on a socket inherited from systemd socket activation.
+	Listener net.Listener
+
+	// Network is the address family to listen on, "tcp" for dual-stack
+	// (the default), "tcp4" for IPv4 only or "tcp6" for IPv6 only.
+	Network string
+
+	// ListenBacklog replaces the kernel's default accept backlog of the
+	// listening socket when greater than zero. ReusePort sets SO_REUSEPORT so
+	// that several processes can listen on the same port. Neither applies to
+	// a Listener passed in and both are only supported on Linux, macOS and
+	// FreeBSD.
+	ListenBacklog int
+	ReusePort     bool
+
+	// AllowedNetworks, if not empty, restricts the clients that may connect
+	// to those with addresses in these networks. Others are answered with a
+	// 554 greeting and disconnected.
+	AllowedNetworks []netip.Prefix
+
+	// TCPKeepAlive is the keepalive period for accepted connections, zero
+	// disables keepalives.
+	TCPKeepAlive time.Duration
+
+	// Credentials is used to sign SES requests. If nil the default AWS SDK
+	// credential chain is used.
+	Credentials aws.CredentialsProvider
+
+	// AWSRegion, if set, is the region of SES and STS instead of the one
+	// from the AWS SDK configuration. AWSEndpointURL, if set, is the URL
+	// all AWS requests are sent to instead of the AWS endpoints, such as a
+	// LocalStack or moto server for testing.
+	AWSRegion      string
+	AWSEndpointURL string
+
+	// HTTPSProxy is the URL of an HTTP or SOCKS5 proxy through which SES and
+	// STS are reached. If empty the HTTPS_PROXY environment variable is
+	// honored.
+	HTTPSProxy string
+
+	// CrossAccountRole is the ARN of a role to assume for SES access.
+	CrossAccountRole string
+
+	// SourceArn, FromArn and ReturnPathArn are the ARNs of the SES
+	// identities whose sending authorization policies permit sends from an
+	// identity owned by another account. Users can override them. If
+	// ArnHeaders is set the X-SES-SOURCE-ARN, X-SES-FROM-ARN and
+	// X-SES-RETURN-PATH-ARN header fields of a message override them for
+	// that message, and are removed before it is sent.
+	SourceArn     string
+	FromArn       string
+	ReturnPathArn string
+	ArnHeaders    bool
+
+	// ConfigurationSetName is the SES configuration set with which messages
+	// are sent, if empty no configuration set is used.
+	ConfigurationSetName string
+
+	// MessageTags are SES message tags added to every send, so that the
+	// events of a configuration set can be told apart. The tags in the
+	// X-SES-MESSAGE-TAGS header field of a message are added to them,
+	// replacing tags with the same name, and the field is removed.
+	MessageTags map[string]string
+
+	// PriorityConfigSets maps a message priority ("high", "normal" or
+	// "low") to the configuration set used for messages of that priority.
+	PriorityConfigSets map[string]string
+
+	// AllowedConfigSets, if not empty, are the configuration sets messages
+	// may select with the X-SES-CONFIGURATION-SET header field. A message
+	// selecting another one is rejected, or sent with the configuration set
+	// it would have had without the header if DisallowedConfigSet is
+	// "default". The header field is always removed before sending.
+	AllowedConfigSets   []string
+	DisallowedConfigSet string
+
+	// MaxMessageSize is the largest message accepted in bytes, advertised
+	// with the SIZE extension. Clients declaring a larger SIZE are rejected
+	// at MAIL FROM. If zero the SES limit of the API version is used,
+	// SesSizeLimit or SesV2SizeLimit, and it can't be larger.
+	MaxMessageSize int64
+
+	// OversizeDrainLimit is the maximum number of bytes of an oversized
+	// message that are read and discarded so the client receives a clean
+	// error. If more remain the connection is closed. Zero drains the whole
+	// message.
+	OversizeDrainLimit int64
+
+	// DataReadTimeout bounds the total time a client may take to transfer
+	// the message body, zero means no limit.
+	DataReadTimeout time.Duration
+
+	// ReadTimeout and WriteTimeout bound how long the proxy waits for a
+	// client to send each command and to read each reply, zero means no
+	// limit. The message body is bounded by DataReadTimeout instead.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// MaxLineLength is the longest line accepted in commands and message
+	// data, counting the line ending. Zero uses the go-smtp default of 2000
+	// and RFC 5321 requires at least 1000.
+	MaxLineLength int
+
+	// MaxRecipients limits the number of recipients of one message, which
+	// is advertised with LIMITS RCPTMAX, zero means no limit
+	MaxRecipients int
+
+	// SpoolThreshold is the message size in bytes above which the body is
+	// buffered in a temporary file in SpoolDir while it is received, zero
+	// keeps all messages in memory. An empty SpoolDir uses the default
+	// temporary directory. Messages that would be spooled are deferred with
+	// a 451 while the spool filesystem has less than SpoolMinFree bytes
+	// available.
+	SpoolThreshold int64
+	SpoolDir       string
+	SpoolMinFree   uint64
+
+	// VerifyDeclaredSize defers messages that are more than 1% smaller than
+	// the SIZE the client declared in MAIL FROM, which indicates a transfer
+	// that was cut short.
+	VerifyDeclaredSize bool
+
+	// MaxMimeDepth rejects messages whose MIME structure is nested deeper
+	// than this many levels, zero disables the check.
+	MaxMimeDepth int
+
+	// Undeclared8bit selects how messages containing 8-bit data are handled
+	// when the client didn't declare BODY=8BITMIME: "pass" (the default)
+	// sends them as they are, "reject" rejects them and "encode" re-encodes
+	// their 8-bit parts as quoted-printable or base64.
+	Undeclared8bit string
+
+	// Declared8bit selects how messages containing 8-bit data are handled
+	// when the client declared BODY=8BITMIME or SMTPUTF8: "pass" (the
+	// default) sends them as they are, "encode" re-encodes their 8-bit parts
+	// before sending and "fallback" sends them as they are but re-encodes
+	// and retries a send that SES rejects.
+	Declared8bit string
+
+	// NormalizeLineEndings converts bare LF and CR line endings, which SES
+	// rejects, to CRLF. SMTP only recognizes lines ending in CRLF, so a
+	// dot-stuffed line after a bare line ending still has its extra dot,
+	// which is removed for messages sent with DATA.
+	NormalizeLineEndings bool
+
+	// LongLines selects how messages with lines longer than the 998
+	// characters RFC 5322 allows are handled: "pass" (the default) sends
+	// them as they are, "reject" rejects them and "fold" folds long header
+	// lines at whitespace and re-encodes body parts with long lines as
+	// quoted-printable or base64.
+	LongLines string
+
+	// BccHeader selects what happens to a Bcc header left in a message by
+	// the client: "keep" (the default) sends it as it is, which shows every
+	// Bcc recipient to all recipients, and "strip" removes it. Bcc
+	// recipients are delivered from the envelope either way.
+	BccHeader string
+
+	// MaxDateSkew rejects messages without a valid Date header or whose date
+	// is further than this from the current time, zero disables the check.
+	MaxDateSkew time.Duration
+
+	// DefaultFrom is added as the From header of messages that don't have
+	// one, which SES would otherwise reject. It is an address, optionally
+	// with a display name, or "envelope" to use the MAIL FROM address.
+	// Messages with a From header are not changed.
+	DefaultFrom string
+
+	// RewriteFrom, if set, replaces the address of the From header of every
+	// message, keeping the display name, for clients that send from
+	// addresses SES won't accept. The original header is kept in
+	// X-Original-From. Messages From an address in RewriteFromKeepDomains
+	// are not changed.
+	RewriteFrom            string
+	RewriteFromKeepDomains []string
+
+	// AllowedSenderDomains, if not empty, are the only domains messages may
+	// be sent from. MAIL FROM with an address in another domain is rejected
+	// with a 553.
+	AllowedSenderDomains []string
+
+	// AllowedRecipientDomains, if not empty, are the only domains messages
+	// may be sent to, and DeniedRecipientDomains are domains they may not
+	// be sent to. Recipients outside them are rejected at RCPT with a 550.
+	AllowedRecipientDomains []string
+	DeniedRecipientDomains  []string
+
+	// NullSenderRewrite is the address used as the sender of messages with
+	// the null sender, MAIL FROM:<>, which SES doesn't accept. Such messages
+	// are usually bounces being relayed. If empty the null sender is
+	// rejected.
+	NullSenderRewrite string
+
+	// ArchiveBcc, if set, is an address added to the destinations of every
+	// message sent, for compliance archiving. The message itself isn't
+	// changed, so other recipients can't see the address.
+	ArchiveBcc string
+
+	// OnParseFailure selects what happens to a message that a feature such
+	// as the MIME depth check, 8-bit encoding or DefaultFrom needs to parse
+	// but can't: "send-as-is" (the default) skips the feature for that
+	// message and "reject" rejects it.
+	OnParseFailure string
+
+	// DMARCAlignment rejects messages whose From header domain doesn't align
+	// with the envelope sender. It is "relaxed" or "strict" to select the
+	// DMARC alignment mode, or empty to disable the check.
+	DMARCAlignment string
+
+	// DMARCMisalignment selects what happens to messages that fail the
+	// DMARCAlignment check: "reject" (the default) rejects them with a 550
+	// and "rewrite" replaces the address of their From header with the
+	// envelope sender, keeping the original in X-Original-From.
+	DMARCMisalignment string
+
+	// ContentDenylist rejects messages that match any of the patterns with a
+	// 550. Only the first ContentScanLimit bytes of each message are
+	// scanned, zero scans the whole message.
+	ContentDenylist  []ContentPattern
+	ContentScanLimit int
+
+	// Transforms is the pipeline of transformations applied, in order, to
+	// every message after the policy checks and before it is sent.
+	Transforms []TransformConfig
+
+	// MaxSendRate limits the number of messages sent to SES per second,
+	// zero means unlimited. Messages over the limit are deferred with a 451.
+	MaxSendRate float64
+
+	// ConfigSetRateLimits limits the messages per second sent with each
+	// listed configuration set. Other configuration sets, and messages sent
+	// without one, are each limited to DefaultConfigSetRateLimit. Zero means
+	// unlimited. Configuration sets not named anywhere in the configuration,
+	// such as those chosen with the X-SES-CONFIGURATION-SET header when
+	// AllowedConfigSets is empty, share one limit and are counted as "other"
+	// in the metrics. These limits apply in addition to MaxSendRate.
+	ConfigSetRateLimits       map[string]float64
+	DefaultConfigSetRateLimit float64
+
+	// WarmupDuration and WarmupStartRate configure a ramp of the send rate
+	// limit after startup. The limit starts at WarmupStartRate and increases
+	// linearly to MaxSendRate over WarmupDuration.
+	WarmupDuration  time.Duration
+	WarmupStartRate float64
+
+	// CredentialSlowStart, if not zero, lowers the send rate limit to
+	// WarmupStartRate when the AWS SDK refreshes the SES credentials with a
+	// new access key, such as those of an assumed CrossAccountRole, and ramps
+	// it back up to the maximum over this period, easing into credentials
+	// whose permissions may still be propagating. Static Credentials,
+	// including those from Vault, never change and don't trigger it.
+	CredentialSlowStart time.Duration
+
+	// SendQuotaPollInterval is how often the SES account send quota is
+	// fetched, zero disables polling. When MaxSendRate is zero the send rate
+	// limit follows the account's maximum send rate. Messages that would
+	// exceed the account's 24 hour send quota are deferred with a 452 at
+	// DATA rather than sent to SES.
+	SendQuotaPollInterval time.Duration
+
+	// SendWorkers is the number of messages sent to SES at the same time
+	// across all sessions, further sends wait for one of them to finish.
+	// When it is zero and the send quota is polled, the number of workers
+	// follows the account's maximum send rate, one per message per second.
+	// Otherwise sends aren't bounded. Waiting sends get a worker by priority,
+	// highest first.
+	SendWorkers int
+
+	// VerifySenderInterval, if not zero, is how often the identities
+	// verified in the SES account of each client are fetched, starting at
+	// startup. Senders that aren't verified, by address or domain, in the
+	// account of the client that sends the message, the user's if it has its
+	// own role, are then rejected at MAIL FROM with a 553. Recipients routed
+	// through a role of their own are rejected with a 550 if the sender
+	// isn't verified in that account. Senders of users with sending
+	// authorization ARNs aren't checked, nor are any if SourceArn or
+	// ArnHeaders are set, as they send from identities of other accounts.
+	VerifySenderInterval time.Duration
+
+	// MirrorRegion, if set, is an SES region to which MirrorPercent percent
+	// of the messages sent successfully are also sent, to validate it with
+	// real traffic before moving to it. MirrorRole is assumed for the mirror
+	// sends if set, to mirror to another account. Mirrored sends happen in
+	// the background, are limited to MirrorMaxRate messages per second if
+	// it's set, and their failures don't affect the client.
+	MirrorRegion  string
+	MirrorRole    string
+	MirrorPercent float64
+	MirrorMaxRate float64
+
+	// CheckSandbox logs a warning at startup if the SES account appears to
+	// be in the sandbox, where it can only send to verified addresses
+	CheckSandbox bool
+
+	// ConfigSetFallback sends messages without a configuration set when SES
+	// reports that their configuration set doesn't exist, instead of
+	// deferring them.
+	ConfigSetFallback bool
+
+	// ErrorDebugDir, if set, is a directory to which a trace of each message
+	// that fails in DATA is written: the envelope, headers, SES requests and
+	// their errors, and timings. Only the newest ErrorDebugMaxFiles traces
+	// are kept, zero keeps all of them. The body of the message is only
+	// included if ErrorDebugIncludeBody is set.
+	ErrorDebugDir         string
+	ErrorDebugMaxFiles    int
+	ErrorDebugIncludeBody bool
+
+	// PollJitter randomizes the interval of periodic polls, such as the send
+	// quota poll, by up to this fraction in either direction and delays the
+	// first poll by up to this fraction of the interval. Must be at least 0
+	// and less than 1.
+	PollJitter float64
+
+	// SendCountPath, if set, is a file in which the rolling count of messages
+	// sent over the last 24 hours is persisted so it survives restarts
+	SendCountPath string
+
+	// DSN advertises the DSN extension (RFC 3461) so that clients can ask
+	// for delivery status notifications. SES doesn't pass these requests on,
+	// so the proxy sends the notifications to the sender itself: a message
+	// that is only partly sent is accepted and the recipients it failed for
+	// are reported, and recipients that asked for NOTIFY=SUCCESS are
+	// reported as relayed. DSNFrom is the address they are sent from,
+	// MAILER-DAEMON at the domain of the sender if empty, which SES must be
+	// allowed to send from.
+	DSN     bool
+	DSNFrom string
+
+	// SendRateWindow is the sliding window over which the current send rate
+	// metric is measured, it defaults to DefaultSendRateWindow.
+	SendRateWindow time.Duration
+
+	// SesAPIVersion is the SES API messages are sent with, SesAPIv1 or
+	// SesAPIv2. SESv2 accepts larger messages. It defaults to SesAPIv1.
+	SesAPIVersion string
+
+	// SendRetries is how many times a send that SES throttled or failed
+	// with a service error is retried before the client is told to try
+	// again later. The delay before each retry doubles from SendRetryDelay,
+	// which defaults to DefaultSendRetryDelay, with jitter. This is on top
+	// of the retries the AWS SDK makes itself.
+	SendRetries    int
+	SendRetryDelay time.Duration
+
+	// BreakerErrorRate opens a circuit breaker around SES once at least
+	// this fraction of the sends in BreakerWindow, and at least
+	// BreakerMinSends of them, fail with temporary errors. While it is open
+	// messages are deferred with a 451 at DATA without calling SES. After
+	// BreakerCooldown one message is let through to probe SES, which closes
+	// the breaker if it is sent. Zero disables the breaker; the others
+	// default to a minute, 10 sends and 30 seconds.
+	BreakerErrorRate float64
+	BreakerWindow    time.Duration
+	BreakerMinSends  int
+	BreakerCooldown  time.Duration
+
+	// Quiet suppresses the log line for each successfully sent message,
+	// otherwise SuccessLogSample logs only one in that many of them. Errors
+	// are always logged.
+	Quiet            bool
+	SuccessLogSample int
+
+	// PolicyAuditMode logs and counts policy rejections but still accepts
+	// and sends the message.
+	PolicyAuditMode bool
+
+	// Suppression, if set, is consulted for every recipient and suppressed
+	// recipients are rejected.
+	Suppression *suppression.List
+
+	// BounceQueueURL, if set, is the URL of an SQS queue receiving SES bounce
+	// and complaint notifications, directly or through SNS. Recipients that
+	// bounce permanently or complain are added to Suppression, which must be
+	// set.
+	BounceQueueURL string
+
+	// Mailbox, if set, puts the proxy in test receiver mode: accepted
+	// messages are stored in it instead of being sent to SES.
+	Mailbox *mailbox.Mailbox
+
+	// Events, if set, is sent an event for every message that is sent or
+	// fails to send
+	Events *events.Publisher
+
+	// DedupeRecipients accepts but ignores RCPT TO addresses that are already
+	// recipients of the message, compared case-insensitively, so they are
+	// only sent one copy.
+	DedupeRecipients bool
+
+	// RecipientRewriteFile, if set, is a JSON file of RecipientRewriteRule
+	// that rewrite the address of every recipient at RCPT, before the
+	// recipient checks. Server.ReloadRecipientRewrites reloads it.
+	RecipientRewriteFile string
+
+	// RequireAuth rejects MAIL FROM with a 530 in sessions that haven't
+	// authenticated.
+	RequireAuth bool
+
+	// Users maps SMTP AUTH usernames to per-user SES settings. Users that
+	// aren't listed use the global settings. It requires an Authenticator,
+	// TokenValidator or TLSClientCAFile, as otherwise clients could claim
+	// to be any user.
+	Users map[string]UserConfig
+
+	// SenderConfigSets maps the domains of envelope senders to the
+	// configuration set their messages are sent with, in place of the
+	// global and per-user configuration sets.
+	SenderConfigSets map[string]string
+
+	// RecipientRoutes maps recipient domains to the configuration set or SES
+	// account used to send to them. Recipients of a message in domains with
+	// different routes are sent as separate SES requests.
+	RecipientRoutes map[string]RecipientRouteConfig
+
+	// MaxSessionsPerUser limits the number of concurrent sessions
+	// authenticated as the same user, unless overridden for the user. Zero
+	// means unlimited.
+	MaxSessionsPerUser int
+
+	// TLSCertificates enables STARTTLS with these certificates, selected by
+	// the server name the client asks for. The first is used for clients
+	// that don't ask for a name or ask for one no certificate covers.
+	TLSCertificates []TLSCertificate
+
+	// SMTPSAddr, if set, is the address of a second listener for clients
+	// that speak SMTP wrapped in TLS from the start of the connection
+	// (SMTPS, usually on port 465) rather than using STARTTLS. It requires
+	// TLSCertificates.
+	SMTPSAddr string
+
+	// SMTPSListener, if set, is served as the SMTPS listener instead of
+	// listening on SMTPSAddr, like Listener
+	SMTPSListener net.Listener
+
+	// TLSClientCAFile, if set, is a PEM file of the certificate authorities
+	// that sign client certificates. Clients must then present a certificate
+	// signed by one of them when starting TLS, and are authenticated as the
+	// common name of the certificate, or its first DNS or email subject
+	// alternative name if it has none, instead of with AUTH.
+	TLSClientCAFile string
+
+	// RequireTLS refuses AUTH and MAIL FROM until the client has started
+	// TLS, so that neither credentials nor messages are sent in the clear.
+	// It requires TLSCertificates.
+	RequireTLS bool
+
+	// Authenticator verifies the passwords of clients that authenticate. When
+	// nil the username is accepted as presented without checking the
+	// password.
+	Authenticator Authenticator
+
+	// TokenValidator verifies the OAuth access tokens of clients that
+	// authenticate with OAUTHBEARER or XOAUTH2, which are only offered when
+	// it is set. When it is set and Authenticator is nil PLAIN and LOGIN
+	// aren't offered.
+	TokenValidator TokenValidator
+
+	// AuthLockoutThreshold is the number of failed authentications in a row
+	// after which a client address or username is locked out, zero
+	// disables lockouts. The lockout lasts AuthLockoutDelay, doubling with
+	// each further failure up to AuthLockoutMaxDelay.
+	AuthLockoutThreshold int
+	AuthLockoutDelay     time.Duration
+	AuthLockoutMaxDelay  time.Duration
+
+	// AuthMechanisms restricts the SASL mechanisms offered to clients to
+	// those listed, out of PLAIN, LOGIN, OAUTHBEARER and XOAUTH2. If empty
+	// every mechanism the configured backends support is offered.
+	AuthMechanisms []string
+
+	// MaxCommandRate limits the rate of AUTH, MAIL, RCPT and RSET commands
+	// within a session to this many per second, commands over the limit are
+	// delayed. Zero means unlimited.
+	MaxCommandRate float64
+
+	// RecentErrors is the number of recent failed commands kept for
+	// RecentErrors and ErrorsHandler, zero disables recording them.
+	RecentErrors int
+
+	// Registerer is used to register the proxy metrics. If nil the default
+	// Prometheus registerer is used.
+	Registerer prometheus.Registerer
+}
+
+// Server is an SMTP server that relays messages to SES
+type Server struct {
+	cfg      Config
+	backend  *Backend
+	smtp     *smtp.Server
+	draining atomic.Bool
+}
+
+// New creates a Server and the SES client it will use
+func New(cfg Config) (*Server, error) {
+	if cfg.Addr == "" {
+		cfg.Addr = DefaultAddr
+	}
+	if cfg.Network == "" {
+		cfg.Network = "tcp"
+	}
+	if err := validateListenAddr(cfg.Network, cfg.Addr); err != nil {
+		return nil, err
+	}
+	if cfg.Registerer == nil {
+		cfg.Registerer = prometheus.DefaultRegisterer
+	}
+	if cfg.SendRateWindow <= 0 {
+		cfg.SendRateWindow = DefaultSendRateWindow
+	}
+	if cfg.SendRetries < 0 {
+		return nil, fmt.Errorf("the number of send retries must not be negative")
+	}
+	if cfg.SendRetryDelay <= 0 {
+		cfg.SendRetryDelay = DefaultSendRetryDelay
+	}
+	if cfg.BreakerErrorRate < 0 || cfg.BreakerErrorRate > 1 {
+		return nil, fmt.Errorf("the circuit breaker error rate must be between 0 and 1")
+	}
+	if cfg.BreakerWindow <= 0 {
+		cfg.BreakerWindow = time.Minute
+	}
+	if cfg.BreakerMinSends <= 0 {
+		cfg.BreakerMinSends = 10
+	}
+	if cfg.BreakerCooldown <= 0 {
+		cfg.BreakerCooldown = 30 * time.Second
+	}
+	for name, value := range cfg.MessageTags {
+		if err := validateTag(name, value); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.MessageTags) > maxMessageTags {
+		return nil, fmt.Errorf("at most %d message tags can be set", maxMessageTags)
+	}
+	sizeLimit := int64(SesSizeLimit)
+	switch cfg.SesAPIVersion {
+	case "", SesAPIv1:
+		cfg.SesAPIVersion = SesAPIv1
+	case SesAPIv2:
+		sizeLimit = SesV2SizeLimit
+	default:
+		return nil, fmt.Errorf("invalid SES API version %q, must be %s or %s", cfg.SesAPIVersion, SesAPIv1, SesAPIv2)
+	}
+	if cfg.MaxMessageSize == 0 {
+		cfg.MaxMessageSize = sizeLimit
+	}
+	if cfg.MaxMessageSize < 0 || cfg.MaxMessageSize > sizeLimit {
+		return nil, fmt.Errorf("the maximum message size must be between 1 and the SES %s limit of %d bytes", cfg.SesAPIVersion, sizeLimit)
+	}
+	if cfg.ReadTimeout < 0 || cfg.WriteTimeout < 0 {
+		return nil, fmt.Errorf("the read and write timeouts must not be negative")
+	}
+	if cfg.MaxLineLength != 0 && cfg.MaxLineLength < 1000 {
+		return nil, fmt.Errorf("the maximum line length must be at least 1000 as RFC 5321 requires")
+	}
+	if cfg.MaxRecipients < 0 {
+		return nil, fmt.Errorf("the maximum number of recipients must not be negative")
+	}
+	switch cfg.Undeclared8bit {
+	case "":
+		cfg.Undeclared8bit = "pass"
+	case "pass", "reject", "encode":
+	default:
+		return nil, fmt.Errorf("unsupported undeclared 8-bit handling %q, must be pass, reject or encode", cfg.Undeclared8bit)
+	}
+	switch cfg.LongLines {
+	case "":
+		cfg.LongLines = "pass"
+	case "pass", "reject", "fold":
+	default:
+		return nil, fmt.Errorf("unsupported long line handling %q, must be pass, reject or fold", cfg.LongLines)
+	}
+	switch cfg.Declared8bit {
+	case "":
+		cfg.Declared8bit = "pass"
+	case "pass", "encode", "fallback":
+	default:
+		return nil, fmt.Errorf("unsupported declared 8-bit handling %q, must be pass, encode or fallback", cfg.Declared8bit)
+	}
+	var authMechanisms map[string]bool
+	if len(cfg.AuthMechanisms) > 0 {
+		authMechanisms = map[string]bool{}
+		for _, mech := range cfg.AuthMechanisms {
+			mech = strings.ToUpper(mech)
+			switch mech {
+			case sasl.Plain, sasl.Login, sasl.OAuthBearer, xoauth2:
+				authMechanisms[mech] = true
+			default:
+				return nil, fmt.Errorf("unsupported authentication mechanism %q, must be PLAIN, LOGIN, OAUTHBEARER or XOAUTH2", mech)
+			}
+		}
+	}
+	switch cfg.BccHeader {
+	case "":
+		cfg.BccHeader = "keep"
+	case "keep", "strip":
+	default:
+		return nil, fmt.Errorf("unsupported Bcc header handling %q, must be keep or strip", cfg.BccHeader)
+	}
+	if cfg.DefaultFrom != "" && cfg.DefaultFrom != "envelope" {
+		addr, err := mail.ParseAddress(cfg.DefaultFrom)
+		if err != nil {
+			return nil, fmt.Errorf("invalid default From address %q: %w", cfg.DefaultFrom, err)
+		}
+		cfg.DefaultFrom = addr.String()
+	}
+	if cfg.RewriteFrom != "" {
+		addr, err := mail.ParseAddress(cfg.RewriteFrom)
+		if err != nil || addr.Name != "" {
+			return nil, fmt.Errorf("invalid rewrite From address %q", cfg.RewriteFrom)
+		}
+		cfg.RewriteFrom = addr.Address
+	}
+	if cfg.NullSenderRewrite != "" {
+		addr, err := mail.ParseAddress(cfg.NullSenderRewrite)
+		if err != nil || addr.Name != "" {
+			return nil, fmt.Errorf("invalid null sender rewrite address %q", cfg.NullSenderRewrite)
+		}
+		cfg.NullSenderRewrite = addr.Address
+	}
+	if cfg.ArchiveBcc != "" {
+		addr, err := mail.ParseAddress(cfg.ArchiveBcc)
+		if err != nil || addr.Name != "" {
+			return nil, fmt.Errorf("invalid archive Bcc address %q", cfg.ArchiveBcc)
+		}
+		cfg.ArchiveBcc = addr.Address
+	}
+	switch cfg.OnParseFailure {
+	case "", "send-as-is", "reject":
+	default:
+		return nil, fmt.Errorf("unsupported parse failure handling %q, must be send-as-is or reject", cfg.OnParseFailure)
+	}
+	switch cfg.DMARCAlignment {
+	case "", "relaxed", "strict":
+	default:
+		return nil, fmt.Errorf("unsupported DMARC alignment mode %q, must be relaxed or strict", cfg.DMARCAlignment)
+	}
+	switch cfg.DMARCMisalignment {
+	case "", "reject", "rewrite":
+	default:
+		return nil, fmt.Errorf("unsupported DMARC misalignment handling %q, must be reject or rewrite", cfg.DMARCMisalignment)
+	}
+	if cfg.PollJitter < 0 || cfg.PollJitter >= 1 {
+		return nil, fmt.Errorf("poll jitter must be at least 0 and less than 1")
+	}
+	if cfg.SendWorkers < 0 {
+		return nil, fmt.Errorf("the number of send workers must not be negative")
+	}
+	switch cfg.DisallowedConfigSet {
+	case "":
+		cfg.DisallowedConfigSet = "reject"
+	case "reject", "default":
+	default:
+		return nil, fmt.Errorf("invalid disallowed configuration set action %q, must be reject or default", cfg.DisallowedConfigSet)
+	}
+	var allowedConfigSets map[string]bool
+	if len(cfg.AllowedConfigSets) > 0 {
+		allowedConfigSets = map[string]bool{}
+		for _, name := range cfg.AllowedConfigSets {
+			allowedConfigSets[name] = true
+		}
+	}
+	for name, u := range cfg.Users {
+		switch u.SendPriority {
+		case "", "high", "normal", "low":
+		default:
+			return nil, fmt.Errorf("invalid send priority %q for user %s, must be high, normal or low", u.SendPriority, name)
+		}
+	}
+	if cfg.BounceQueueURL != "" && cfg.Suppression == nil {
+		return nil, fmt.Errorf("a bounce queue requires the local suppression list")
+	}
+	if (cfg.WarmupDuration > 0 || cfg.CredentialSlowStart > 0) && cfg.MaxSendRate <= 0 && cfg.SendQuotaPollInterval <= 0 {
+		return nil, fmt.Errorf("a send rate warm-up or slow start requires a maximum send rate or send quota polling")
+	}
+	if cfg.MirrorRegion != "" && cfg.Mailbox == nil && (cfg.MirrorPercent <= 0 || cfg.MirrorPercent > 100) {
+		return nil, fmt.Errorf("mirror percentage must be greater than 0 and at most 100, got %g", cfg.MirrorPercent)
+	}
+	if cfg.AuthLockoutThreshold > 0 && cfg.AuthLockoutDelay <= 0 {
+		return nil, fmt.Errorf("the authentication lockout delay must be positive")
+	}
+	authBackends := &Backend{authenticator: cfg.Authenticator, tokenValidator: cfg.TokenValidator, authMechanisms: authMechanisms}
+	if authMechanisms != nil && len(authBackends.authMechs()) == 0 {
+		return nil, fmt.Errorf("none of the permitted authentication mechanisms is supported by the authentication backends")
+	}
+	if len(cfg.Users) > 0 && cfg.Authenticator == nil && cfg.TokenValidator == nil && cfg.TLSClientCAFile == "" {
+		return nil, fmt.Errorf("per-user settings need an authenticator, token validator or client CA to verify who the users are")
+	}
+	if cfg.RequireTLS && len(cfg.TLSCertificates) == 0 {
+		return nil, fmt.Errorf("requiring TLS needs at least one TLS certificate")
+	}
+	if (cfg.SMTPSAddr != "" || cfg.SMTPSListener != nil) && len(cfg.TLSCertificates) == 0 {
+		return nil, fmt.Errorf("an SMTPS listener needs at least one TLS certificate")
+	}
+	if cfg.TLSClientCAFile != "" && len(cfg.TLSCertificates) == 0 {
+		return nil, fmt.Errorf("client certificate authentication needs at least one TLS certificate")
+	}
+
+	var tlsConfig *tls.Config
+	if len(cfg.TLSCertificates) > 0 {
+		certs, err := newCertSelector(cfg.TLSCertificates)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+		if cfg.TLSClientCAFile != "" {
+			pool, err := loadClientCAs(cfg.TLSClientCAFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.ClientCAs = pool
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	if cfg.ErrorDebugDir != "" {
+		if err := os.MkdirAll(cfg.ErrorDebugDir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+
+	transforms, err := newTransforms(cfg.Transforms)
+	if err != nil {
+		return nil, err
+	}
+
+	var rcptRewriter *recipientRewriter
+	if cfg.RecipientRewriteFile != "" {
+		if rcptRewriter, err = newRecipientRewriter(cfg.RecipientRewriteFile); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx := context.Background()
+	awsCfg, err := loadAwsConfig(ctx, &cfg)
+	if err != nil {
+		return nil, err
+	}
+	// The backend doesn't exist yet when the client is made, the callback
+	// only runs once credentials expire
+	var backend *Backend
+	var onRefresh func()
+	if cfg.CredentialSlowStart > 0 {
+		onRefresh = func() {
+			log.Printf("AWS credentials refreshed, slowing sends for %s", cfg.CredentialSlowStart)
+			backend.sendLimiter.slowStart(cfg.CredentialSlowStart)
+		}
+	}
+	sesClient := makeSesClient(ctx, awsCfg, cfg.CrossAccountRole, onRefresh)
+
+	users := make(map[string]*tenant, len(cfg.Users))
+	for name, u := range cfg.Users {
+		users[name] = newTenant(ctx, awsCfg, u)
+	}
+
+	var configSet *string
+	if cfg.ConfigurationSetName != "" {
+		configSet = &cfg.ConfigurationSetName
+	}
+
+	var bounceQueue *sqs.Client
+	if cfg.BounceQueueURL != "" {
+		bounceQueue = sqs.NewFromConfig(awsCfg)
+	}
+
+	// Everything that can fail is done before any metrics are registered,
+	// so that a rejected configuration leaves the registry as it was
+	dailyCount, err := newDailyCounter(cfg.SendCountPath, cfg.Registerer)
+	if err != nil {
+		return nil, err
+	}
+	m := newMetrics(cfg.Registerer)
+
+	// The name of the host reports which server generated a DSN
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	backend = &Backend{
+		sesClient:          sesClient,
+		configSetName:      configSet,
+		priorityConfigSets: cfg.PriorityConfigSets,
+		allowedConfigSets:  allowedConfigSets,
+		disallowedSet:      cfg.DisallowedConfigSet,
+		maxMessageSize:     cfg.MaxMessageSize,
+		oversizeDrainLimit: cfg.OversizeDrainLimit,
+		dataReadTimeout:    cfg.DataReadTimeout,
+		readTimeout:        cfg.ReadTimeout,
+		sendRetries:        cfg.SendRetries,
+		sendRetryDelay:     cfg.SendRetryDelay,
+		sesV2:              cfg.SesAPIVersion == SesAPIv2,
+		arns: sendingArns{
+			source:     optionalString(cfg.SourceArn),
+			from:       optionalString(cfg.FromArn),
+			returnPath: optionalString(cfg.ReturnPathArn),
+		},
+		arnHeaders:         cfg.ArnHeaders,
+		messageTags:        cfg.MessageTags,
+		maxMimeDepth:       cfg.MaxMimeDepth,
+		verifyDeclaredSize: cfg.VerifyDeclaredSize,
+		undeclared8bit:     cfg.Undeclared8bit,
+		declared8bit:       cfg.Declared8bit,
+		normalizeLines:     cfg.NormalizeLineEndings,
+		longLines:          cfg.LongLines,
+		stripBcc:           cfg.BccHeader == "strip",
+		maxDateSkew:        cfg.MaxDateSkew,
+		dmarcAlignment:     cfg.DMARCAlignment,
+		rewriteMisaligned:  cfg.DMARCMisalignment == "rewrite",
+		defaultFrom:        cfg.DefaultFrom,
+		rewriteFrom:        cfg.RewriteFrom,
+		keepFromDomains:    domainSet(cfg.RewriteFromKeepDomains),
+		nullSenderRewrite:  cfg.NullSenderRewrite,
+		archiveBcc:         cfg.ArchiveBcc,
+		allowedSenders:     domainSet(cfg.AllowedSenderDomains),
+		allowedRcpts:       domainSet(cfg.AllowedRecipientDomains),
+		deniedRcpts:        domainSet(cfg.DeniedRecipientDomains),
+		rejectUnparseable:  cfg.OnParseFailure == "reject",
+		contentDenylist:    cfg.ContentDenylist,
+		contentScanLimit:   cfg.ContentScanLimit,
+		transforms:         transforms,
+		spoolThreshold:     cfg.SpoolThreshold,
+		spoolDir:           cfg.SpoolDir,
+		spoolMinFree:       cfg.SpoolMinFree,
+		policyAuditMode:    cfg.PolicyAuditMode,
+		requireAuth:        cfg.RequireAuth,
+		requireTLS:         cfg.RequireTLS,
+		authenticator:      cfg.Authenticator,
+		tokenValidator:     cfg.TokenValidator,
+		authMechanisms:     authMechanisms,
+		dedupeRecipients:   cfg.DedupeRecipients,
+		rcptRewriter:       rcptRewriter,
+		maxCommandRate:     cfg.MaxCommandRate,
+		quiet:              cfg.Quiet,
+		dsn:                cfg.DSN,
+		dsnFrom:            cfg.DSNFrom,
+		hostname:           hostname,
+		successLogSample:   uint64(max(cfg.SuccessLogSample, 0)),
+		suppression:        cfg.Suppression,
+		bounceQueue:        bounceQueue,
+		mailbox:            cfg.Mailbox,
+		events:             cfg.Events,
+		users:              users,
+		recipientRoutes:    newRecipientRoutes(ctx, awsCfg, cfg.RecipientRoutes),
+		senderConfigSets:   lowerKeys(cfg.SenderConfigSets),
+		missingConfigSets:  newMissingConfigSets(m.configSetMissingNow),
+		configSetFallback:  cfg.ConfigSetFallback,
+		userSessions:       newUserSessions(cfg.MaxSessionsPerUser, cfg.Users, m.userSessions),
+		metrics:            m,
+		throughput:         newRateTracker(cfg.SendRateWindow, cfg.Registerer),
+		stats:              newStats(),
+		dailyCount:         dailyCount,
+	}
+
+	if cfg.MaxSendRate > 0 || cfg.SendQuotaPollInterval > 0 {
+		backend.sendLimiter = newSendLimiter(cfg.MaxSendRate, cfg.WarmupStartRate, cfg.WarmupDuration, m.sendRateLimit)
+	}
+	if cfg.SendWorkers > 0 || cfg.SendQuotaPollInterval > 0 {
+		backend.sendPool = newSendPool(cfg.SendWorkers, m.sendWorkers, m.sendQueueDepth)
+	}
+	if cfg.VerifySenderInterval > 0 && cfg.Mailbox == nil && cfg.SourceArn == "" && !cfg.ArnHeaders {
+		backend.verifiedSenders = newVerifiedSenders(sesClient, users, backend.recipientRoutes)
+	}
+	if cfg.SendQuotaPollInterval > 0 {
+		backend.dailyQuota = newDailyQuota(m.sesQuotaRemaining)
+	}
+
+	if cfg.SpoolThreshold > 0 {
+		registerSpoolMetrics(cfg.Registerer, cfg.SpoolDir)
+	}
+
+	if cfg.MirrorRegion != "" && cfg.Mailbox == nil {
+		mirrorCfg := awsCfg.Copy()
+		mirrorCfg.Region = cfg.MirrorRegion
+		client := makeSesClient(ctx, mirrorCfg, cfg.MirrorRole, nil)
+		backend.mirror = newMirror(client, cfg.SesAPIVersion == SesAPIv2, cfg.MirrorPercent, cfg.MirrorMaxRate, m.mirrorSends)
+		log.Printf("Mirroring %g%% of sent messages to SES in %s", cfg.MirrorPercent, cfg.MirrorRegion)
+	}
+
+	if cfg.ErrorDebugDir != "" {
+		backend.debugDumper = &debugDumper{
+			dir:         cfg.ErrorDebugDir,
+			max:         cfg.ErrorDebugMaxFiles,
+			includeBody: cfg.ErrorDebugIncludeBody,
+		}
+	}
+
+	if cfg.AuthLockoutThreshold > 0 {
+		backend.authLockout = newAuthLockout(cfg.AuthLockoutThreshold, cfg.AuthLockoutDelay, cfg.AuthLockoutMaxDelay, m.authLockouts, m.authLockedOut)
+	}
+
+	if cfg.BreakerErrorRate > 0 {
+		backend.breaker = newSesBreaker(cfg.BreakerErrorRate, cfg.BreakerWindow, cfg.BreakerMinSends, cfg.BreakerCooldown, m.breakerState, m.breakerTrips)
+	}
+
+	if cfg.RecentErrors > 0 {
+		backend.recentErrors = newRecentErrors(cfg.RecentErrors)
+	}
+
+	if len(cfg.ConfigSetRateLimits) > 0 || cfg.DefaultConfigSetRateLimit > 0 {
+		backend.configSetLimiters = newConfigSetLimiters(cfg.ConfigSetRateLimits, cfg.DefaultConfigSetRateLimit, configuredConfigSets(cfg))
+	}
+
+	s := smtp.NewServer(backend)
+	s.Addr = cfg.Addr
+	s.Domain = "localhost"
+	s.AllowInsecureAuth = !cfg.RequireTLS
+	s.MaxMessageBytes = cfg.MaxMessageSize
+	s.ReadTimeout = cfg.ReadTimeout
+	s.WriteTimeout = cfg.WriteTimeout
+	s.MaxRecipients = cfg.MaxRecipients
+	if cfg.MaxLineLength > 0 {
+		s.MaxLineLength = cfg.MaxLineLength
+	}
+	s.EnableSMTPUTF8 = true
+	s.EnableDSN = cfg.DSN
+	s.TLSConfig = tlsConfig
+
+	return &Server{
+		cfg:     cfg,
+		backend: backend,
+		smtp:    s,
+	}, nil
+}
+
+// Run listens on the configured address and serves SMTP connections until
+// ctx is canceled, at which point all connections are closed, or the server
+// is shut down.
+func (s *Server) Run(ctx context.Context) error {
+	l := s.cfg.Listener
+	if l == nil {
+		var err error
+		l, err = listen(s.cfg.Network, s.cfg.Addr, s.cfg.ListenBacklog, s.cfg.ReusePort)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.cfg.SendCountPath != "" {
+		go s.backend.dailyCount.persist(ctx)
+	}
+
+	if s.cfg.CheckSandbox && s.cfg.Mailbox == nil {
+		go s.checkSandbox(ctx)
+	}
+
+	if s.cfg.SendQuotaPollInterval > 0 && s.cfg.Mailbox == nil {
+		go s.pollSendQuota(ctx, s.cfg.SendQuotaPollInterval)
+	}
+
+	if s.backend.verifiedSenders != nil {
+		go s.pollVerifiedIdentities(ctx, s.cfg.VerifySenderInterval)
+	}
+
+	if s.backend.bounceQueue != nil {
+		go s.consumeBounces(ctx, s.backend.bounceQueue, minBounceQueueRetryDelay)
+	}
+
+	errc := make(chan error, 2)
+	go func() {
+		log.Printf("ListenAndServe on %s (%s)", l.Addr(), s.cfg.Network)
+		errc <- s.smtp.Serve(s.wrapListener(&keepAliveListener{l, s.cfg.TCPKeepAlive}))
+	}()
+
+	// The SMTPS listener shares the server so that it serves the same
+	// backend and is closed and drained along with the main listener. The
+	// draining reply is sent over TLS like the rest of the session.
+	if sl := s.cfg.SMTPSListener; sl != nil || s.cfg.SMTPSAddr != "" {
+		if sl == nil {
+			var err error
+			sl, err = listen(s.cfg.Network, s.cfg.SMTPSAddr, s.cfg.ListenBacklog, s.cfg.ReusePort)
+			if err != nil {
+				s.smtp.Close()
+				return err
+			}
+		}
+		go func() {
+			log.Printf("ListenAndServe SMTPS on %s (%s)", sl.Addr(), s.cfg.Network)
+			errc <- s.smtp.Serve(s.wrapListener(tls.NewListener(&keepAliveListener{sl, s.cfg.TCPKeepAlive}, s.smtp.TLSConfig)))
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+		s.smtp.Close()
+		return nil
+	case err := <-errc:
+		return err
+	}
+}
+
+// Shutdown stops accepting new connections and waits for active connections
+// to finish or for ctx to expire.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.smtp.Shutdown(ctx)
+}
+
+// Drain makes the server refuse new connections with a 421 reply while
+// sessions that are already connected continue normally. It is used to take
+// the server out of service politely before shutting it down.
+func (s *Server) Drain() {
+	s.draining.Store(true)
+}
+
+// Draining reports whether Drain has been called
+func (s *Server) Draining() bool {
+	return s.draining.Load()
+}
+
+// validateListenAddr checks that addr is a host:port pair suitable for the
+// network. IPv6 hosts must be bracketed, as in "[::1]:2500".
+func validateListenAddr(network, addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q (IPv6 addresses must be bracketed, e.g. [::1]:2500): %w", addr, err)
+	}
+
+	ip := net.ParseIP(host)
+	switch network {
+	case "tcp":
+	case "tcp4":
+		if ip != nil && ip.To4() == nil {
+			return fmt.Errorf("listen address %q is not an IPv4 address", addr)
+		}
+	case "tcp6":
+		if ip != nil && ip.To4() != nil {
+			return fmt.Errorf("listen address %q is not an IPv6 address", addr)
+		}
+	default:
+		return fmt.Errorf("unsupported listen network %q, must be tcp, tcp4 or tcp6", network)
+	}
+
+	return nil
+}
+
+// wrapListener adds the listeners that refuse connections from clients
+// outside the allowed networks and while draining to l
+func (s *Server) wrapListener(l net.Listener) net.Listener {
+	if len(s.cfg.AllowedNetworks) > 0 {
+		l = &allowListener{l, s}
+	}
+	return &drainingListener{l, s}
+}
+
+// keepAliveListener enables TCP keepalives on accepted connections so that
+// peers which silently disappear (for example behind a NAT or load balancer
+// with an aggressive idle timeout) are eventually detected and cleaned up.
+// The connections are returned as limitedConns.
+type keepAliveListener struct {
+	net.Listener
+	period time.Duration
+}
+
+func (l *keepAliveListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if tc, ok := c.(*net.TCPConn); ok {
+		if l.period > 0 {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(l.period)
+		} else {
+			tc.SetKeepAlive(false)
+		}
+	}
+
+	return &limitedConn{Conn: c, remaining: -1}, nil
+}
+
+// limitedConn is a connection from which at most a given number of bytes may
+// be read. It bounds how much of an oversized message go-smtp discards,
+// which it does itself once the message has been rejected. Reads happen on
+// the goroutine serving the session, so it needs no locking.
+type limitedConn struct {
+	net.Conn
+	remaining int64
+}
+
+// limitReads closes the connection once more than n further bytes are read
+func (c *limitedConn) limitReads(n int64) {
+	c.remaining = n
+}
+
+// unlimitReads removes the limit set by limitReads
+func (c *limitedConn) unlimitReads() {
+	c.remaining = -1
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.remaining < 0 {
+		return n, err
+	}
+
+	if c.remaining -= int64(n); c.remaining < 0 {
+		log.Printf("oversized message from %s exceeded drain limit, closing connection", c.RemoteAddr())
+		c.Conn.Close()
+		return 0, net.ErrClosed
+	}
+	return n, err
+}
+
+// drainingListener answers connections accepted while the server is draining
+// with a 421 greeting and closes them, so clients retry elsewhere or later
+// instead of seeing a refused or reset connection.
+type drainingListener struct {
+	net.Listener
+	server *Server
+}
+
+func (l *drainingListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil || !l.server.Draining() {
+			return c, err
+		}
+
+		refuse(c, fmt.Sprintf("421 %s Service shutting down, please try again later\r\n", l.server.smtp.Domain))
+		l.server.backend.metrics.refusedDraining.Inc()
+	}
+}
+
+// refuse sends reply to c and closes it. This is done in another goroutine
+// with a deadline for the whole exchange, as on the SMTPS listener the
+// reply can only be sent once the TLS handshake is done, and a client that
+// never completes it must not hold up accepting other connections.
+func refuse(c net.Conn, reply string) {
+	go func() {
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(c, reply)
+	}()
+}
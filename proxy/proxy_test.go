@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestValidateListenAddr(t *testing.T) {
+	tests := []struct {
+		network string
+		addr    string
+		wantErr bool
+	}{
+		{"tcp", ":2500", false},
+		{"tcp", "0.0.0.0:2500", false},
+		{"tcp", "[::]:2500", false},
+		{"tcp", "[::1]:2500", false},
+		{"tcp", "[fe80::1%eth0]:2500", false},
+		{"tcp", "::1:2500", true},
+		{"tcp", "::1", true},
+		{"tcp", "127.0.0.1", true},
+		{"tcp4", "127.0.0.1:2500", false},
+		{"tcp4", ":2500", false},
+		{"tcp4", "[::1]:2500", true},
+		{"tcp6", "[::1]:2500", false},
+		{"tcp6", ":2500", false},
+		{"tcp6", "127.0.0.1:2500", true},
+		{"tcp6", "localhost:2500", false},
+		{"udp", ":2500", true},
+	}
+
+	for _, tt := range tests {
+		err := validateListenAddr(tt.network, tt.addr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateListenAddr(%q, %q) = %v, want error %t", tt.network, tt.addr, err, tt.wantErr)
+		}
+	}
+}
+
+// requireIPv6 skips the test if the host can't listen on the IPv6 loopback
+func requireIPv6(t *testing.T) {
+	t.Helper()
+
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	l.Close()
+}
+
+func TestListenFamilies(t *testing.T) {
+	requireIPv6(t)
+
+	tests := []struct {
+		name    string
+		network string
+		addr    string
+		dial    map[string]bool
+	}{
+		{"dual stack", "tcp", ":0", map[string]bool{"127.0.0.1": true, "::1": true}},
+		{"IPv4 only", "tcp4", ":0", map[string]bool{"127.0.0.1": true, "::1": false}},
+		{"IPv6 only", "tcp6", ":0", map[string]bool{"127.0.0.1": false, "::1": true}},
+		{"IPv6 loopback", "tcp6", "[::1]:0", map[string]bool{"::1": true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateListenAddr(tt.network, tt.addr); err != nil {
+				t.Fatal(err)
+			}
+			l, err := listen(tt.network, tt.addr, 0, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			go func() {
+				for {
+					c, err := l.Accept()
+					if err != nil {
+						return
+					}
+					c.Close()
+				}
+			}()
+
+			_, port, _ := net.SplitHostPort(l.Addr().String())
+			for host, want := range tt.dial {
+				c, err := net.Dial("tcp", net.JoinHostPort(host, port))
+				if err == nil {
+					c.Close()
+				}
+				if (err == nil) != want {
+					t.Errorf("connecting to %s: %v, want success %t", host, err, want)
+				}
+			}
+		})
+	}
+}
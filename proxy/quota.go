@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pollSendQuota fetches the SES account send quota every interval until ctx
+// is canceled. Unless a maximum send rate was configured explicitly the send
+// rate limit follows the account's maximum send rate, as does the size of the
+// send worker pool unless it was configured explicitly, and messages are
+// deferred once the account's 24 hour quota is used up. Each interval, and the
+// delay before the first poll, is randomized by the configured jitter so
+// that proxies started together don't poll SES at the same time.
+func (s *Server) pollSendQuota(ctx context.Context, interval time.Duration) {
+	jitter := s.cfg.PollJitter
+	log.Printf("Polling SES send quota every %s ± %s", interval, time.Duration(float64(interval)*jitter))
+
+	t := time.NewTimer(time.Duration(rand.Float64() * jitter * float64(interval)))
+	defer t.Stop()
+
+	var current float64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		t.Reset(jittered(interval, jitter))
+
+		quota, err := s.backend.sesClient.GetSendQuota(ctx, &ses.GetSendQuotaInput{})
+		if err != nil {
+			log.Printf("ERROR: unable to get SES send quota: %v", err)
+		} else {
+			m := s.backend.metrics.sesQuota
+			m.With(prometheus.Labels{"quota": "max_send_rate"}).Set(quota.MaxSendRate)
+			m.With(prometheus.Labels{"quota": "max_24_hour_send"}).Set(quota.Max24HourSend)
+			m.With(prometheus.Labels{"quota": "sent_last_24_hours"}).Set(quota.SentLast24Hours)
+			s.backend.dailyQuota.update(quota.Max24HourSend, quota.SentLast24Hours)
+
+			if s.cfg.MaxSendRate <= 0 && quota.MaxSendRate != current {
+				log.Printf("SES maximum send rate is %g messages per second, adjusting send rate limit", quota.MaxSendRate)
+				s.backend.sendLimiter.setMaxRate(quota.MaxSendRate)
+				current = quota.MaxSendRate
+			}
+			if s.cfg.SendWorkers <= 0 {
+				if n := sendWorkersFor(quota.MaxSendRate); s.backend.sendPool.resize(n) {
+					log.Printf("Resizing SES send worker pool to %d workers for a maximum send rate of %g messages per second", n, quota.MaxSendRate)
+				}
+			}
+		}
+	}
+}
+
+// Limits of an SES account in the sandbox
+const (
+	sandboxMaxSendRate   = 1
+	sandboxMax24HourSend = 200
+)
+
+// checkSandbox logs a warning if the send quota of the SES account is the
+// quota of a sandbox account, which can only send to verified addresses
+func (s *Server) checkSandbox(ctx context.Context) {
+	quota, err := s.backend.sesClient.GetSendQuota(ctx, &ses.GetSendQuotaInput{})
+	if err != nil {
+		log.Printf("Unable to check whether the SES account is in the sandbox: %v", err)
+		return
+	}
+
+	if quota.MaxSendRate == sandboxMaxSendRate && quota.Max24HourSend == sandboxMax24HourSend {
+		log.Printf("WARNING: the SES account in region %s appears to be in the sandbox, it can only send to verified "+
+			"addresses and %g messages a day. Request production access in the SES console to send to anyone.",
+			s.backend.sesClient.Options().Region, quota.Max24HourSend)
+	}
+}
+
+// jittered returns d randomly scaled by up to the fraction jitter in either
+// direction
+func jittered(d time.Duration, jitter float64) time.Duration {
+	return time.Duration(float64(d) * (1 + jitter*(2*rand.Float64()-1)))
+}
+
+// dailyQuota tracks how much of the SES account's 24 hour send quota is left.
+// The quota reported by SES lags behind sends, so the recipients of the sends
+// made since the last poll, each of which SES counts as a message, are added
+// to the count it reported. Until the quota has been fetched, or if it is
+// unlimited, nothing is deferred.
+type dailyQuota struct {
+	mu        sync.Mutex
+	known     bool
+	max       float64
+	sent      float64
+	sentSince float64
+
+	remaining prometheus.Gauge
+}
+
+func newDailyQuota(remaining prometheus.Gauge) *dailyQuota {
+	return &dailyQuota{remaining: remaining}
+}
+
+// update sets the quota and the count of messages sent from a poll of SES
+func (q *dailyQuota) update(max, sent float64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.known = max >= 0
+	q.max, q.sent, q.sentSince = max, sent, 0
+	q.setGauge()
+}
+
+// allow reports whether there is quota left to send to n recipients
+func (q *dailyQuota) allow(n int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return !q.known || q.sent+q.sentSince+float64(n) <= q.max
+}
+
+// record counts a send to n recipients against the quota
+func (q *dailyQuota) record(n int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.sentSince += float64(n)
+	q.setGauge()
+}
+
+func (q *dailyQuota) setGauge() {
+	if q.known {
+		q.remaining.Set(max(q.max-q.sent-q.sentSince, 0))
+	}
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// sendLimiter limits the rate at which messages are sent to SES. For the
+// warm-up period after it is created the limit ramps linearly from the
+// warm-up start rate up to the maximum rate, which helps when sending from
+// freshly provisioned dedicated IPs. A maximum rate of zero means unlimited.
+type sendLimiter struct {
+	mu        sync.Mutex
+	limiter   *rate.Limiter
+	maxRate   float64
+	startRate float64
+	warmup    time.Duration
+	started   time.Time
+	gauge     prometheus.Gauge
+}
+
+func newSendLimiter(maxRate, startRate float64, warmup time.Duration, gauge prometheus.Gauge) *sendLimiter {
+	l := &sendLimiter{
+		limiter:   rate.NewLimiter(rate.Inf, 1),
+		maxRate:   maxRate,
+		startRate: startRate,
+		warmup:    warmup,
+		started:   time.Now(),
+		gauge:     gauge,
+	}
+	l.update(l.started)
+	return l
+}
+
+func burstFor(r float64) int {
+	return max(1, int(math.Ceil(r)))
+}
+
+// effectiveRate returns the send rate limit in effect at now
+func (l *sendLimiter) effectiveRate(now time.Time) float64 {
+	if l.maxRate <= 0 {
+		return 0
+	}
+
+	elapsed := now.Sub(l.started)
+	if l.warmup <= 0 || elapsed >= l.warmup {
+		return l.maxRate
+	}
+
+	progress := float64(elapsed) / float64(l.warmup)
+	return l.startRate + (l.maxRate-l.startRate)*progress
+}
+
+// update adjusts the underlying limiter to the currently effective rate, the
+// caller must hold the lock
+func (l *sendLimiter) update(now time.Time) {
+	r := l.effectiveRate(now)
+	limit := rate.Limit(r)
+	if r <= 0 {
+		limit = rate.Inf
+	}
+	if l.limiter.Limit() != limit {
+		l.limiter.SetLimitAt(now, limit)
+		l.limiter.SetBurstAt(now, burstFor(r))
+	}
+	if l.gauge != nil {
+		l.gauge.Set(r)
+	}
+}
+
+// Allow reports whether a message may be sent now
+func (l *sendLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.update(now)
+	return l.limiter.AllowN(now, 1)
+}
+
+// slowStart restarts the ramp from the start rate to the maximum rate, taking
+// d, unless a ramp already in progress would take longer
+func (l *sendLimiter) slowStart(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.started.Add(l.warmup).After(now.Add(d)) {
+		return
+	}
+
+	l.started = now
+	l.warmup = d
+	l.update(now)
+}
+
+// setMaxRate changes the maximum send rate, any warm-up in progress continues
+// towards the new rate
+func (l *sendLimiter) setMaxRate(maxRate float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.maxRate = maxRate
+	l.update(time.Now())
+}
+
+// otherConfigSets is the bucket shared by configuration sets that aren't
+// configured anywhere, so that names chosen by clients with the
+// X-SES-CONFIGURATION-SET header can't grow the limiters and metric labels
+// without bound
+const otherConfigSets = "other"
+
+// configSetLimiters limits the send rate of each configuration set
+// separately. Configuration sets without their own limit, including messages
+// sent without a configuration set, are each limited to the default rate;
+// a rate of zero means unlimited. Configuration sets that aren't known share
+// a single limiter at the default rate.
+type configSetLimiters struct {
+	mu          sync.Mutex
+	limits      map[string]float64
+	defaultRate float64
+	known       map[string]bool
+	limiters    map[string]*sendLimiter
+}
+
+func newConfigSetLimiters(limits map[string]float64, defaultRate float64, known map[string]bool) *configSetLimiters {
+	return &configSetLimiters{
+		limits:      limits,
+		defaultRate: defaultRate,
+		known:       known,
+		limiters:    map[string]*sendLimiter{},
+	}
+}
+
+// Allow reports whether a message may be sent with configSet now, and the
+// name of the limiter it was counted against
+func (c *configSetLimiters) Allow(configSet string) (string, bool) {
+	if _, ok := c.limits[configSet]; !ok && !c.known[configSet] {
+		configSet = otherConfigSets
+	}
+
+	c.mu.Lock()
+	l, ok := c.limiters[configSet]
+	if !ok {
+		r, ok := c.limits[configSet]
+		if !ok {
+			r = c.defaultRate
+		}
+		if r > 0 {
+			l = newSendLimiter(r, 0, 0, nil)
+		}
+		c.limiters[configSet] = l
+	}
+	c.mu.Unlock()
+
+	return configSet, l == nil || l.Allow()
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// RecipientRewriteRule rewrites the recipients whose whole address matches
+// Match to Replace, in which $1 or ${name} are replaced by the groups of
+// the match as with regexp.Regexp.Expand
+type RecipientRewriteRule struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+type rewriteRule struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+// recipientRewriter rewrites recipient addresses by the rules of a file,
+// which can be reloaded while the proxy runs
+type recipientRewriter struct {
+	path string
+
+	mu    sync.RWMutex
+	rules []rewriteRule
+}
+
+func newRecipientRewriter(path string) (*recipientRewriter, error) {
+	r := &recipientRewriter{path: path}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load replaces the rules with those of the file, keeping the current ones
+// if it can't be read or a rule is invalid
+func (r *recipientRewriter) load() error {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return fmt.Errorf("loading recipient rewrite rules: %w", err)
+	}
+
+	var cfgs []RecipientRewriteRule
+	if err := json.Unmarshal(data, &cfgs); err != nil {
+		return fmt.Errorf("unable to parse recipient rewrite rules %s: %w", r.path, err)
+	}
+
+	rules := make([]rewriteRule, 0, len(cfgs))
+	for i, c := range cfgs {
+		re, err := regexp.Compile("^(?:" + c.Match + ")$")
+		if err != nil {
+			return fmt.Errorf("recipient rewrite rule %d: invalid match %q: %w", i+1, c.Match, err)
+		}
+		if c.Replace == "" {
+			return fmt.Errorf("recipient rewrite rule %d: replace is empty", i+1)
+		}
+		rules = append(rules, rewriteRule{re: re, replace: c.Replace})
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rules = rules
+	return nil
+}
+
+// rewrite applies the rules to addr in order, each to the result of the
+// previous ones, and returns the final address. It returns an error if the
+// result isn't a valid address.
+func (r *recipientRewriter) rewrite(addr string) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	out := addr
+	for _, rule := range r.rules {
+		if m := rule.re.FindStringSubmatchIndex(out); m != nil {
+			out = string(rule.re.ExpandString(nil, rule.replace, out, m))
+		}
+	}
+	if out == addr {
+		return addr, nil
+	}
+
+	if parsed, err := mail.ParseAddress(out); err != nil || parsed.Address != out {
+		return addr, fmt.Errorf("recipient %s is rewritten to the invalid address %q", addr, out)
+	}
+	return out, nil
+}
+
+// ReloadRecipientRewrites reloads the recipient rewrite rules from their
+// file. If the file can't be loaded the current rules are kept and the
+// error is returned. It does nothing if no rules file is configured.
+func (s *Server) ReloadRecipientRewrites() error {
+	if s.backend.rcptRewriter == nil {
+		return nil
+	}
+	return s.backend.rcptRewriter.load()
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// ErrorRecord describes a MAIL, RCPT or DATA command that failed. Email
+// addresses are redacted.
+type ErrorRecord struct {
+	Time       time.Time `json:"time"`
+	Command    string    `json:"command"`
+	Code       int       `json:"code"`
+	Reply      string    `json:"reply"`
+	Detail     string    `json:"detail,omitempty"`
+	Client     string    `json:"client"`
+	Helo       string    `json:"helo,omitempty"`
+	User       string    `json:"user,omitempty"`
+	From       string    `json:"from,omitempty"`
+	Recipients int       `json:"recipients"`
+}
+
+// recentErrors is a ring buffer of the most recent failures
+type recentErrors struct {
+	mu      sync.Mutex
+	records []ErrorRecord
+	next    int
+	full    bool
+}
+
+func newRecentErrors(size int) *recentErrors {
+	return &recentErrors{records: make([]ErrorRecord, size)}
+}
+
+func (r *recentErrors) add(rec ErrorRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.records[r.next] = rec
+	r.next = (r.next + 1) % len(r.records)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns the recorded failures, newest first
+func (r *recentErrors) list() []ErrorRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := r.next
+	if r.full {
+		n = len(r.records)
+	}
+
+	out := make([]ErrorRecord, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, r.records[(r.next-i+len(r.records))%len(r.records)])
+	}
+	return out
+}
+
+var addressLocalPart = regexp.MustCompile(`[^\s<>@,;:"']+@`)
+
+// redactAddresses replaces the local part of any email address in s
+func redactAddresses(s string) string {
+	return addressLocalPart.ReplaceAllString(s, "***@")
+}
+
+// RecentErrors returns the most recent failed commands, newest first. It
+// returns nil if recording recent errors isn't enabled.
+func (s *Server) RecentErrors() []ErrorRecord {
+	if s.backend.recentErrors == nil {
+		return nil
+	}
+	return s.backend.recentErrors.list()
+}
+
+// ErrorsHandler returns an HTTP handler that serves RecentErrors as JSON to
+// requests bearing token in an "Authorization: Bearer" header
+func (s *Server) ErrorsHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if token == "" || subtle.ConstantTimeCompare(got, []byte("Bearer "+token)) != 1 {
+			w.Header().Add("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		records := s.RecentErrors()
+		if records == nil {
+			records = []ErrorRecord{}
+		}
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(records)
+	})
+}
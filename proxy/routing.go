@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+)
+
+// RecipientRouteConfig routes the recipients in a domain through a different
+// configuration set or SES account than the rest of the message
+type RecipientRouteConfig struct {
+	// ConfigurationSet replaces the configuration set for the recipients
+	ConfigurationSet string `json:"configuration_set"`
+
+	// CrossAccountRole is the ARN of a role assumed to send to the
+	// recipients instead of the global or per-user role
+	CrossAccountRole string `json:"cross_account_role"`
+}
+
+// recipientRoute is the resolved form of a RecipientRouteConfig
+type recipientRoute struct {
+	name      string
+	configSet *string
+	sesClient *ses.Client
+}
+
+// newRecipientRoutes resolves the routes for each recipient domain. Domains
+// with identical settings share a route so their recipients are sent
+// together.
+func newRecipientRoutes(ctx context.Context, awsCfg aws.Config, cfg map[string]RecipientRouteConfig) map[string]*recipientRoute {
+	routes := map[string]*recipientRoute{}
+	shared := map[RecipientRouteConfig]*recipientRoute{}
+	for domain, rc := range cfg {
+		r, ok := shared[rc]
+		if !ok {
+			r = &recipientRoute{name: routeName(rc)}
+			if rc.ConfigurationSet != "" {
+				r.configSet = &rc.ConfigurationSet
+			}
+			if rc.CrossAccountRole != "" {
+				r.sesClient = makeSesClient(ctx, awsCfg, rc.CrossAccountRole, nil)
+			}
+			shared[rc] = r
+		}
+		routes[strings.ToLower(domain)] = r
+	}
+	return routes
+}
+
+// routeName describes a route in logs
+func routeName(rc RecipientRouteConfig) string {
+	var parts []string
+	if rc.ConfigurationSet != "" {
+		parts = append(parts, "config set "+rc.ConfigurationSet)
+	}
+	if rc.CrossAccountRole != "" {
+		parts = append(parts, "role "+rc.CrossAccountRole)
+	}
+	if len(parts) == 0 {
+		return "default"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// lowerKeys returns m with its keys, such as domains, in lower case
+func lowerKeys(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[strings.ToLower(k)] = v
+	}
+	return out
+}
+
+// recipientGroup is a set of recipients of a message that are sent with one
+// SES request. A nil route means the default settings.
+type recipientGroup struct {
+	route      *recipientRoute
+	recipients []string
+}
+
+// groupRecipients splits recipients into groups by the route of their domain,
+// keeping the order in which each group first appears
+func (b *Backend) groupRecipients(recipients []string) []recipientGroup {
+	if len(b.recipientRoutes) == 0 {
+		return []recipientGroup{{recipients: recipients}}
+	}
+
+	var groups []recipientGroup
+	index := map[*recipientRoute]int{}
+	for _, rcpt := range recipients {
+		route := b.recipientRoutes[addressDomain(rcpt)]
+		i, ok := index[route]
+		if !ok {
+			i = len(groups)
+			index[route] = i
+			groups = append(groups, recipientGroup{route: route})
+		}
+		groups[i].recipients = append(groups[i].recipients, rcpt)
+	}
+	return groups
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"math"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sendPriorities are the priorities of sends waiting for a send worker,
+// highest first
+var sendPriorities = []string{"high", "normal", "low"}
+
+// sendPool is the pool of workers that send messages to SES, which bounds the
+// number of sends in flight across all sessions. Sessions wait for a free
+// worker before each send. A free worker goes to the waiting send of the
+// highest priority, so that a backlog of bulk mail doesn't hold up
+// transactional mail, and sends of the same priority get one in the order
+// they started waiting. A size of zero means the sends aren't bounded.
+type sendPool struct {
+	mu      sync.Mutex
+	size    int
+	active  int
+	queued  int
+	waiting map[string][]chan struct{}
+
+	gauge prometheus.Gauge
+	depth *prometheus.GaugeVec
+}
+
+func newSendPool(size int, gauge prometheus.Gauge, depth *prometheus.GaugeVec) *sendPool {
+	p := &sendPool{size: size, waiting: map[string][]chan struct{}{}, gauge: gauge, depth: depth}
+	gauge.Set(float64(size))
+	for _, priority := range sendPriorities {
+		depth.With(prometheus.Labels{"priority": priority}).Set(0)
+	}
+	return p
+}
+
+// acquire waits for a free worker and takes it for a send of priority, one of
+// sendPriorities
+func (p *sendPool) acquire(priority string) {
+	p.mu.Lock()
+	if p.queued == 0 && p.free() {
+		p.active++
+		p.mu.Unlock()
+		return
+	}
+
+	ready := make(chan struct{})
+	p.waiting[priority] = append(p.waiting[priority], ready)
+	p.queued++
+	p.depth.With(prometheus.Labels{"priority": priority}).Inc()
+	p.mu.Unlock()
+
+	// The worker is taken on our behalf by dispatch
+	<-ready
+}
+
+// release returns a worker taken with acquire
+func (p *sendPool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.active--
+	p.dispatch()
+}
+
+// resize changes the number of workers and reports whether it changed. Sends
+// in flight over a smaller size finish, but no more start until they have.
+func (p *sendPool) resize(size int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if size == p.size {
+		return false
+	}
+	p.size = size
+	p.gauge.Set(float64(size))
+	p.dispatch()
+	return true
+}
+
+// free reports whether a worker is free, the caller must hold the lock
+func (p *sendPool) free() bool {
+	return p.size <= 0 || p.active < p.size
+}
+
+// dispatch hands the free workers to the waiting sends, highest priority
+// first. The caller must hold the lock.
+func (p *sendPool) dispatch() {
+	for _, priority := range sendPriorities {
+		for len(p.waiting[priority]) > 0 && p.free() {
+			close(p.waiting[priority][0])
+			p.waiting[priority] = p.waiting[priority][1:]
+			p.queued--
+			p.depth.With(prometheus.Labels{"priority": priority}).Dec()
+			p.active++
+		}
+	}
+}
+
+// sendWorkersFor returns the number of send workers for an SES maximum send
+// rate. A send to SES takes well under a second, so one worker per message
+// per second keeps up with the rate without many more sends in flight than
+// SES allows.
+func sendWorkersFor(maxSendRate float64) int {
+	return max(1, int(math.Ceil(maxSendRate)))
+}
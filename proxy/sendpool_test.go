@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSendPoolPriority(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := newMetrics(reg)
+	p := newSendPool(1, m.sendWorkers, m.sendQueueDepth)
+
+	// Hold the only worker while sends of every priority queue up
+	p.acquire("normal")
+
+	order := make(chan string, 4)
+	for _, priority := range []string{"low", "normal", "high", "low"} {
+		want := metricValue(t, reg, "smtpd_send_queue_depth", map[string]string{"priority": priority}) + 1
+		go func() {
+			p.acquire(priority)
+			order <- priority
+			p.release()
+		}()
+
+		// Wait for the send to queue so that the order they queued in is known
+		deadline := time.Now().Add(5 * time.Second)
+		for metricValue(t, reg, "smtpd_send_queue_depth", map[string]string{"priority": priority}) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s priority send didn't wait for a worker", priority)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	p.release()
+	var got []string
+	for range 4 {
+		select {
+		case priority := <-order:
+			got = append(got, priority)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("sends %v got a worker, want 4", got)
+		}
+	}
+	if want := []string{"high", "normal", "low", "low"}; !slices.Equal(got, want) {
+		t.Errorf("sends got a worker in the order %v, want %v", got, want)
+	}
+
+	if v := metricValue(t, reg, "smtpd_send_queue_depth", nil); v != 0 {
+		t.Errorf("%g sends still waiting", v)
+	}
+	if v := metricValue(t, reg, "smtpd_send_workers", nil); v != 1 {
+		t.Errorf("send workers gauge is %g, want 1", v)
+	}
+}
+
+func TestSendPoolUnbounded(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := newMetrics(reg)
+	p := newSendPool(0, m.sendWorkers, m.sendQueueDepth)
+
+	done := make(chan struct{})
+	go func() {
+		for range 100 {
+			p.acquire("low")
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sends waited for a worker without a bound")
+	}
+	if v := metricValue(t, reg, "smtpd_send_queue_depth", nil); v != 0 {
+		t.Errorf("%g sends waiting without a bound", v)
+	}
+}
+
+func TestSendPriority(t *testing.T) {
+	tests := []struct {
+		name   string
+		tenant *tenant
+		fields []string
+		want   string
+	}{
+		{"no header", nil, nil, "normal"},
+		{"X-Priority", nil, []string{"X-Priority: 1 (Highest)"}, "high"},
+		{"Importance", nil, []string{"Importance: low"}, "low"},
+		{"user priority", &tenant{sendPriority: "low"}, []string{"X-Priority: 1"}, "low"},
+		{"user without priority", &tenant{}, []string{"X-Priority: 5"}, "low"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := append([]string{"Subject: Test"}, tt.fields...)
+			s := &Session{tenant: tt.tenant, data: []byte(message("Hello", fields...))}
+			if got := s.sendPriority(); got != tt.want {
+				t.Errorf("priority %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
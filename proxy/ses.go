@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+// loadAwsConfig loads the base AWS configuration. Credentials come from
+// c.Credentials if set, otherwise from the default AWS SDK credential chain.
+// The region and endpoint of the SDK configuration are overridden by
+// c.AWSRegion and c.AWSEndpointURL if they are set.
+// Requests go through c.HTTPSProxy if set, otherwise through the proxy from
+// the HTTPS_PROXY environment variable, if any.
+func loadAwsConfig(ctx context.Context, c *Config) (aws.Config, error) {
+	var opts []func(*config.LoadOptions) error
+	if c.Credentials != nil {
+		opts = append(opts, config.WithCredentialsProvider(c.Credentials))
+	}
+	if c.AWSRegion != "" {
+		opts = append(opts, config.WithRegion(c.AWSRegion))
+	}
+	if c.AWSEndpointURL != "" {
+		u, err := url.Parse(c.AWSEndpointURL)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return aws.Config{}, fmt.Errorf("invalid AWS endpoint URL %q, must be an http:// or https:// URL", c.AWSEndpointURL)
+		}
+		log.Printf("Sending AWS requests to %s", c.AWSEndpointURL)
+		opts = append(opts, config.WithBaseEndpoint(c.AWSEndpointURL))
+	}
+	if c.HTTPSProxy != "" {
+		proxyURL, err := url.Parse(c.HTTPSProxy)
+		if err != nil {
+			return aws.Config{}, fmt.Errorf("invalid HTTPS proxy %q: %w", c.HTTPSProxy, err)
+		}
+		opts = append(opts, config.WithHTTPClient(awshttp.NewBuildableClient().WithTransportOptions(func(t *http.Transport) {
+			t.Proxy = http.ProxyURL(proxyURL)
+		})))
+	}
+
+	return config.LoadDefaultConfig(ctx, opts...)
+}
+
+// makeSesClient builds an SES client from cfg, assuming crossAccountRole
+// first if it is not empty. If onRefresh is not nil it is called whenever the
+// client's credentials are replaced by new ones.
+func makeSesClient(ctx context.Context, cfg aws.Config, crossAccountRole string, onRefresh func()) *ses.Client {
+	// If cross-account role is specified, assume it
+	if crossAccountRole != "" {
+		log.Printf("Assuming cross-account role: %s", crossAccountRole)
+		stsClient := sts.NewFromConfig(cfg)
+		creds := stscreds.NewAssumeRoleProvider(stsClient, crossAccountRole)
+		cfg.Credentials = creds
+		log.Printf("Successfully assumed cross-account role")
+
+		// Verify the assumed identity
+		identity, err := stsClient.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+		if err != nil {
+			log.Printf("Warning: Could not verify assumed identity: %v", err)
+		} else {
+			log.Printf("Current identity - Account: %s, ARN: %s", *identity.Account, *identity.Arn)
+		}
+	}
+
+	if onRefresh != nil && cfg.Credentials != nil {
+		cfg.Credentials = &credentialWatcher{provider: cfg.Credentials, onRefresh: onRefresh}
+	}
+
+	return ses.NewFromConfig(cfg)
+}
+
+// credentialWatcher calls onRefresh when the provider it wraps returns a
+// different access key than it did the last time, for example when an
+// assumed role's credentials expire and the role is assumed again. The SDK
+// caches the credentials so Retrieve is only called when they expire.
+type credentialWatcher struct {
+	provider  aws.CredentialsProvider
+	onRefresh func()
+
+	mu      sync.Mutex
+	lastKey string
+}
+
+func (w *credentialWatcher) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	creds, err := w.provider.Retrieve(ctx)
+	if err != nil {
+		return creds, err
+	}
+
+	w.mu.Lock()
+	changed := w.lastKey != "" && w.lastKey != creds.AccessKeyID
+	w.lastKey = creds.AccessKeyID
+	w.mu.Unlock()
+
+	if changed {
+		w.onRefresh()
+	}
+
+	return creds, nil
+}
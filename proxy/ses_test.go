@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestDataReturnsMessageID(t *testing.T) {
+	fake, endpoint := startFakeSES(t, nil)
+	_, addr := startServer(t, sesConfig(endpoint))
+
+	c := dial(t, addr)
+	resp, err := sendMessage(c, "sender@example.com", []string{"rcpt@example.com"}, message("Hello", "Subject: Test"))
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	if len(fake.Sends()) != 1 {
+		t.Fatalf("sent %d messages to SES, want 1", len(fake.Sends()))
+	}
+	m := regexp.MustCompile(`^2\.0\.0 OK: queued as (\S+)$`).FindStringSubmatch(resp.StatusText)
+	if m == nil || m[1] != "ses-1" {
+		t.Errorf("DATA reply %q, want the SES message ID ses-1", resp.StatusText)
+	}
+}
+
+// rotatingCredentials returns credentials with the access key in key, which
+// expire straight away so that the SDK fetches them again for every request
+type rotatingCredentials struct {
+	mu  sync.Mutex
+	key string
+}
+
+func (c *rotatingCredentials) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return aws.Credentials{AccessKeyID: c.key, SecretAccessKey: "SECRET", CanExpire: true, Expires: time.Now()}, nil
+}
+
+func (c *rotatingCredentials) rotate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.key = key
+}
+
+func TestCredentialSlowStart(t *testing.T) {
+	fake, endpoint := startFakeSES(t, nil)
+	creds := &rotatingCredentials{key: "AKID1"}
+	cfg := sesConfig(endpoint)
+	cfg.Credentials = creds
+	cfg.MaxSendRate = 1000
+	cfg.WarmupStartRate = 1
+	cfg.CredentialSlowStart = time.Hour
+	_, addr := startServer(t, cfg)
+	c := dial(t, addr)
+
+	if _, err := sendMessage(c, "sender@example.com", []string{"rcpt@example.com"}, message("Hello", "Subject: Test")); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if v := metricValue(t, cfg.Registerer, "smtpd_send_rate_limit", nil); v != 1000 {
+		t.Fatalf("send rate limit %g before the key changed, want 1000", v)
+	}
+
+	// The limiter starts with a single token, let it refill for the second
+	// message
+	time.Sleep(10 * time.Millisecond)
+	creds.rotate("AKID2")
+	if _, err := sendMessage(c, "sender@example.com", []string{"rcpt@example.com"}, message("Hello", "Subject: Test")); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(fake.Sends()) != 2 {
+		t.Fatalf("sent %d messages to SES, want 2", len(fake.Sends()))
+	}
+	if v := metricValue(t, cfg.Registerer, "smtpd_send_rate_limit", nil); v < 1 || v > 1.1 {
+		t.Errorf("send rate limit %g after the key changed, want the slow start rate 1", v)
+	}
+}
+
+func TestHTTPSProxy(t *testing.T) {
+	fake, endpoint := startFakeSES(t, nil)
+	sesURL, err := url.Parse(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A forward proxy receives the absolute URL of each request, which it
+	// answers with the fake SES itself rather than forwarding it
+	var mu sync.Mutex
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		proxied = append(proxied, r.URL.Host+" "+r.PostForm.Get("Action"))
+		mu.Unlock()
+		fake.ServeHTTP(w, r)
+	}))
+	t.Cleanup(proxy.Close)
+
+	cfg := sesConfig(endpoint)
+	cfg.HTTPSProxy = proxy.URL
+	_, addr := startServer(t, cfg)
+
+	c := dial(t, addr)
+	if _, err := sendMessage(c, "sender@example.com", []string{"rcpt@example.com"}, message("Hello", "Subject: Test")); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	if len(fake.Sends()) != 1 {
+		t.Fatalf("sent %d messages to SES, want 1", len(fake.Sends()))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := sesURL.Host + " SendRawEmail"; len(proxied) != 1 || proxied[0] != want {
+		t.Errorf("proxy saw %q, want %q", proxied, want)
+	}
+}
@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+	"github.com/aws/smithy-go"
+	"github.com/emersion/go-smtp"
+)
+
+// classifySesError maps an error sending a message with SES to a reason, used
+// in logs and metrics, and the reply that tells the client what is wrong.
+// The enhanced status code of the reply describes the class of failure as
+// precisely as possible so that clients and DSNs can act on it. Errors that
+// aren't recognized are reported as temporary.
+func classifySesError(err error, from string, recipients []string, region string) (string, *smtp.SMTPError) {
+	var paused *types.AccountSendingPausedException
+	var setPaused *types.ConfigurationSetSendingPausedException
+	if errors.As(err, &paused) || errors.As(err, &setPaused) {
+		return "sending paused", &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Sending is paused for this SES account. Please try again later",
+		}
+	}
+
+	var noConfigSet *types.ConfigurationSetDoesNotExistException
+	if errors.As(err, &noConfigSet) {
+		return "configuration set missing", &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 5},
+			Message:      "SES configuration set does not exist. Please try again later",
+		}
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "Throttling", "ThrottlingException":
+			if strings.Contains(strings.ToLower(apiErr.ErrorMessage()), "daily message quota") {
+				return "daily quota exceeded", &smtp.SMTPError{
+					Code:         451,
+					EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+					Message:      "SES daily sending quota exceeded. Please try again later",
+				}
+			}
+			return "throttled", &smtp.SMTPError{
+				Code:         451,
+				EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+				Message:      "SES is throttling sends. Please try again later",
+			}
+		case "ServiceUnavailable", "InternalFailure":
+			return "ses unavailable", &smtp.SMTPError{
+				Code:         451,
+				EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+				Message:      "SES is unavailable. Please try again later",
+			}
+		case "AccessDenied", "AccessDeniedException", "UnrecognizedClientException",
+			"InvalidClientTokenId", "ExpiredToken", "SignatureDoesNotMatch":
+			// The proxy is misconfigured, so the message is kept with
+			// the client until that is fixed
+			return "ses access denied", &smtp.SMTPError{
+				Code:         451,
+				EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+				Message:      "SES denied the proxy access. Please try again later",
+			}
+		case "InvalidParameterValue":
+			if strings.Contains(strings.ToLower(apiErr.ErrorMessage()), "address") ||
+				strings.Contains(apiErr.ErrorMessage(), "@domain") {
+				return "invalid address", &smtp.SMTPError{
+					Code:         550,
+					EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+					Message:      "Error: SES rejected a sender or recipient address as invalid",
+				}
+			}
+			return "invalid message", &smtp.SMTPError{
+				Code:         554,
+				EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+				Message:      "Error: message rejected by SES as invalid",
+			}
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return "ses unreachable", &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 4, 1},
+			Message:      "Unable to reach SES. Please try again later",
+		}
+	}
+
+	var notVerified *types.MailFromDomainNotVerifiedException
+	if errors.As(err, &notVerified) {
+		return "identity not verified", &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      fmt.Sprintf("Error: sender domain of <%s> is not verified in SES region %s", from, region),
+		}
+	}
+
+	var rejected *types.MessageRejected
+	if !errors.As(err, &rejected) {
+		return "ses error", temporarySesError
+	}
+
+	msg := rejected.ErrorMessage()
+	lower := strings.ToLower(msg)
+	switch {
+	case strings.Contains(lower, "not verified"):
+		var identities string
+		if i := strings.LastIndex(msg, ": "); i >= 0 {
+			identities = strings.TrimSpace(msg[i+2:])
+		}
+
+		// Only accounts in the sandbox require recipients to be verified
+		if rcpt := unverifiedRecipient(identities, recipients); rcpt != "" {
+			return reasonSandbox, &smtp.SMTPError{
+				Code:         550,
+				EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+				Message: fmt.Sprintf("Error: recipient <%s> is not verified and the SES account is in the sandbox in region %s, "+
+					"which only allows sending to verified addresses. Verify the recipient in SES or request production access", rcpt, region),
+			}
+		}
+
+		reply := fmt.Sprintf("Error: identity not verified in SES region %s", region)
+		if identities != "" {
+			reply += ": " + identities
+		}
+		return "identity not verified", &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      reply,
+		}
+	case strings.Contains(lower, "virus"):
+		return "content rejected", &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+			Message:      "Error: message rejected by SES as containing a virus",
+		}
+	case strings.Contains(lower, "content"):
+		return "content rejected", &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Error: message content rejected by SES",
+		}
+	case strings.Contains(lower, "illegal address"):
+		return "invalid address", &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+			Message:      "Error: SES rejected a sender or recipient address as invalid",
+		}
+	case strings.Contains(lower, "message length"):
+		return "message too large", &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+			Message:      "Error: message too large for SES",
+		}
+	case strings.Contains(lower, "paused") || strings.Contains(lower, "suspended"):
+		return "sending paused", &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+			Message:      "Sending is paused for this SES account. Please try again later",
+		}
+	}
+
+	return "message rejected", &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Error: message rejected by SES",
+	}
+}
+
+// reasonSandbox is the reason for sends rejected because the SES account is
+// in the sandbox and a recipient isn't verified
+const reasonSandbox = "sandbox recipient"
+
+// unverifiedRecipient returns the first of the comma separated identities
+// that SES reported as not verified that is one of recipients, or "" if none
+// are
+func unverifiedRecipient(identities string, recipients []string) string {
+	for _, id := range strings.Split(identities, ",") {
+		id = strings.TrimSpace(id)
+		for _, r := range recipients {
+			if id != "" && strings.EqualFold(id, strings.TrimSpace(r)) {
+				return r
+			}
+		}
+	}
+	return ""
+}
+
+// temporarySesError is the reply for SES errors that aren't recognized
+var temporarySesError = &smtp.SMTPError{
+	Code:         451,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+	Message:      "Temporary server error. Please try again later",
+}
+
+// retryableSesError returns the reason for errors that retrying the send
+// soon may fix: throttling, other than for the daily quota, and SES service
+// errors. It returns "" for any other error. Network errors are not retried
+// as SES may have accepted the message.
+func retryableSesError(err error) string {
+	switch reason, _ := classifySesError(err, "", nil, ""); reason {
+	case "throttled", "ses unavailable":
+		return reason
+	}
+	return ""
+}
+
+// isTemporarySesError reports whether err is one that SES may not return
+// if the send is tried again later, as opposed to a rejection of the message
+func isTemporarySesError(err error) bool {
+	_, reply := classifySesError(err, "", nil, "")
+	return reply.Code < 500
+}
+
+// retryDelay returns the delay before the given retry, doubling from base
+// with each attempt up to maxRetryDelay and jittered down by up to half so
+// that clients throttled together don't retry together
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	d := base
+	for i := 1; i < attempt && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	d = min(d, maxRetryDelay)
+	return d/2 + rand.N(d/2+1)
+}
+
+// maxRetryDelay caps the delay between send retries, as the client waits
+// for them
+const maxRetryDelay = 10 * time.Second
+
+// isMessageRejected reports whether SES rejected the content of a message
+func isMessageRejected(err error) bool {
+	var rejected *types.MessageRejected
+	return errors.As(err, &rejected)
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+	v2types "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"github.com/aws/smithy-go"
+	"github.com/emersion/go-smtp"
+)
+
+// v2Error wraps an SESv2 error the way sendEmailV2 does
+func v2Error(err error) error {
+	return &sesV2Error{err: err, v1: sesV1Error(err)}
+}
+
+func TestClassifySesErrorEnhancedCodes(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		wantReason   string
+		wantCode     int
+		wantEnhanced smtp.EnhancedCode
+	}{
+		{"account paused", &types.AccountSendingPausedException{}, "sending paused", 451, smtp.EnhancedCode{4, 7, 0}},
+		{"configuration set paused", &types.ConfigurationSetSendingPausedException{}, "sending paused", 451, smtp.EnhancedCode{4, 7, 0}},
+		{"configuration set missing", &types.ConfigurationSetDoesNotExistException{}, "configuration set missing", 451, smtp.EnhancedCode{4, 3, 5}},
+		{"throttled", &smithy.GenericAPIError{Code: "Throttling", Message: "Maximum sending rate exceeded."}, "throttled", 451, smtp.EnhancedCode{4, 3, 2}},
+		{"daily quota", &smithy.GenericAPIError{Code: "Throttling", Message: "Daily message quota exceeded."}, "daily quota exceeded", 451, smtp.EnhancedCode{4, 3, 2}},
+		{"service unavailable", &smithy.GenericAPIError{Code: "ServiceUnavailable"}, "ses unavailable", 451, smtp.EnhancedCode{4, 3, 2}},
+		{"internal failure", &smithy.GenericAPIError{Code: "InternalFailure"}, "ses unavailable", 451, smtp.EnhancedCode{4, 3, 2}},
+		{"access denied", &smithy.GenericAPIError{Code: "AccessDenied"}, "ses access denied", 451, smtp.EnhancedCode{4, 7, 0}},
+		{"expired token", &smithy.GenericAPIError{Code: "ExpiredToken"}, "ses access denied", 451, smtp.EnhancedCode{4, 7, 0}},
+		{"invalid address", &smithy.GenericAPIError{Code: "InvalidParameterValue", Message: "Missing final '@domain'"}, "invalid address", 550, smtp.EnhancedCode{5, 1, 3}},
+		{"invalid message", &smithy.GenericAPIError{Code: "InvalidParameterValue", Message: "Nested group"}, "invalid message", 554, smtp.EnhancedCode{5, 6, 0}},
+		{"mail from not verified", &types.MailFromDomainNotVerifiedException{}, "identity not verified", 550, smtp.EnhancedCode{5, 7, 1}},
+		{"message rejected", &types.MessageRejected{Message: aws.String("Rejected")}, "message rejected", 554, smtp.EnhancedCode{5, 7, 1}},
+		{"network error", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, "ses unreachable", 451, smtp.EnhancedCode{4, 4, 1}},
+		{"deadline exceeded", fmt.Errorf("send: %w", context.DeadlineExceeded), "ses unreachable", 451, smtp.EnhancedCode{4, 4, 1}},
+		{"unknown", errors.New("something else"), "ses error", 451, smtp.EnhancedCode{4, 3, 0}},
+		{"v2 too many requests", v2Error(&v2types.TooManyRequestsException{}), "throttled", 451, smtp.EnhancedCode{4, 3, 2}},
+		{"v2 sending paused", v2Error(&v2types.SendingPausedException{}), "sending paused", 451, smtp.EnhancedCode{4, 7, 0}},
+		{"v2 configuration set missing", v2Error(&v2types.NotFoundException{Message: aws.String("Configuration set <x> does not exist.")}), "configuration set missing", 451, smtp.EnhancedCode{4, 3, 5}},
+		{"v2 mail from not verified", v2Error(&v2types.MailFromDomainNotVerifiedException{}), "identity not verified", 550, smtp.EnhancedCode{5, 7, 1}},
+		{"v2 bad request", v2Error(&v2types.BadRequestException{Message: aws.String("Invalid address")}), "invalid address", 550, smtp.EnhancedCode{5, 1, 3}},
+		{"v2 internal error", v2Error(&v2types.InternalServiceErrorException{}), "ses error", 451, smtp.EnhancedCode{4, 3, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, reply := classifySesError(tt.err, "sender@example.com", []string{"rcpt@example.com"}, "us-east-1")
+			if reason != tt.wantReason {
+				t.Errorf("reason %q, want %q", reason, tt.wantReason)
+			}
+			if reply.Code != tt.wantCode || reply.EnhancedCode != tt.wantEnhanced {
+				t.Errorf("reply %d %v, want %d %v", reply.Code, reply.EnhancedCode, tt.wantCode, tt.wantEnhanced)
+			}
+			if reply.Code/100 != tt.wantEnhanced[0] {
+				t.Errorf("reply code %d and enhanced code %v disagree on the class", reply.Code, reply.EnhancedCode)
+			}
+		})
+	}
+}
+
+func TestClassifyMessageRejected(t *testing.T) {
+	tests := []struct {
+		message      string
+		wantReason   string
+		wantCode     int
+		wantEnhanced smtp.EnhancedCode
+		wantText     string
+	}{
+		{
+			"Email address is not verified. The following identities failed the check in region US-EAST-1: sender@example.com",
+			"identity not verified", 550, smtp.EnhancedCode{5, 7, 1}, "identity not verified in SES region us-east-1: sender@example.com",
+		},
+		{
+			"Email address is not verified. The following identities failed the check in region US-EAST-1: sender@example.com, Rcpt@Example.com",
+			reasonSandbox, 550, smtp.EnhancedCode{5, 7, 1}, "recipient <rcpt@example.com> is not verified",
+		},
+		{"Message contains a virus", "content rejected", 554, smtp.EnhancedCode{5, 7, 0}, "virus"},
+		{"Message content rejected due to policy", "content rejected", 550, smtp.EnhancedCode{5, 7, 1}, "content rejected"},
+		{"Illegal address", "invalid address", 550, smtp.EnhancedCode{5, 1, 3}, "address as invalid"},
+		{"Message length is more than 10485760 bytes long", "message too large", 552, smtp.EnhancedCode{5, 3, 4}, "too large"},
+		{"Sending suspended for this account", "sending paused", 451, smtp.EnhancedCode{4, 7, 0}, "paused"},
+		{"Something SES has never said before", "message rejected", 554, smtp.EnhancedCode{5, 7, 1}, "rejected by SES"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.wantReason, func(t *testing.T) {
+			err := &types.MessageRejected{Message: &tt.message}
+			reason, reply := classifySesError(err, "sender@example.com", []string{"rcpt@example.com"}, "us-east-1")
+			if reason != tt.wantReason {
+				t.Errorf("reason %q, want %q", reason, tt.wantReason)
+			}
+			if reply.Code != tt.wantCode || reply.EnhancedCode != tt.wantEnhanced {
+				t.Errorf("reply %d %v, want %d %v", reply.Code, reply.EnhancedCode, tt.wantCode, tt.wantEnhanced)
+			}
+			if !strings.Contains(reply.Message, tt.wantText) {
+				t.Errorf("reply %q, want it to contain %q", reply.Message, tt.wantText)
+			}
+		})
+	}
+}
+
+func TestDataMessageRejected(t *testing.T) {
+	_, endpoint := startFakeSES(t, func(url.Values) *fakeSESError {
+		return &fakeSESError{400, "MessageRejected", "Message content rejected due to policy"}
+	})
+	cfg := sesConfig(endpoint)
+	_, addr := startServer(t, cfg)
+
+	c := dial(t, addr)
+	_, err := sendMessage(c, "sender@example.com", []string{"rcpt@example.com"}, message("Hello", "Subject: Test"))
+	if code := replyCode(err); code != 550 {
+		t.Errorf("DATA reply %d (%v), want 550", code, err)
+	}
+	if v := metricValue(t, cfg.Registerer, "smtpd_email_send_fail_total", map[string]string{"type": "content rejected"}); v != 1 {
+		t.Errorf("counted %g content rejections, want 1", v)
+	}
+}
+
+func TestDataEnhancedCodes(t *testing.T) {
+	tests := []struct {
+		code         string
+		message      string
+		wantCode     int
+		wantEnhanced smtp.EnhancedCode
+	}{
+		{"AccountSendingPausedException", "Sending paused", 451, smtp.EnhancedCode{4, 7, 0}},
+		{"MailFromDomainNotVerifiedException", "MAIL FROM domain not verified", 550, smtp.EnhancedCode{5, 7, 1}},
+		{"InvalidParameterValue", "Illegal address", 550, smtp.EnhancedCode{5, 1, 3}},
+		{"MessageRejected", "Message contains a virus", 554, smtp.EnhancedCode{5, 7, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			_, endpoint := startFakeSES(t, func(url.Values) *fakeSESError {
+				return &fakeSESError{400, tt.code, tt.message}
+			})
+			_, addr := startServer(t, sesConfig(endpoint))
+
+			c := dial(t, addr)
+			_, err := sendMessage(c, "sender@example.com", []string{"rcpt@example.com"}, message("Hello", "Subject: Test"))
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) {
+				t.Fatalf("send: %v, want an SMTP error", err)
+			}
+			if smtpErr.Code != tt.wantCode || smtpErr.EnhancedCode != tt.wantEnhanced {
+				t.Errorf("DATA reply %d %v, want %d %v", smtpErr.Code, smtpErr.EnhancedCode, tt.wantCode, tt.wantEnhanced)
+			}
+		})
+	}
+}
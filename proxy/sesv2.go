@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+	"github.com/aws/aws-sdk-go-v2/service/sesv2"
+	v2types "github.com/aws/aws-sdk-go-v2/service/sesv2/types"
+	"github.com/aws/smithy-go"
+)
+
+// SES API versions that messages can be sent with
+const (
+	SesAPIv1 = "v1"
+	SesAPIv2 = "v2"
+)
+
+// sendRawEmail sends input with SES, using the SESv2 SendEmail API instead
+// of SendRawEmail if v2 is set
+func sendRawEmail(ctx context.Context, client *ses.Client, input *ses.SendRawEmailInput, v2 bool) (*ses.SendRawEmailOutput, error) {
+	if v2 {
+		return sendEmailV2(ctx, client, input)
+	}
+	return client.SendRawEmail(ctx, input)
+}
+
+// sesV2Clients holds the SESv2 client made for each SES client, keyed by the
+// *ses.Client
+var sesV2Clients sync.Map
+
+// sesV2Client returns the SESv2 client with the region, credentials, endpoint
+// and HTTP client of client, so that the SES clients of routes and users
+// work for both versions
+func sesV2Client(client *ses.Client) *sesv2.Client {
+	if c, ok := sesV2Clients.Load(client); ok {
+		return c.(*sesv2.Client)
+	}
+
+	opts := client.Options()
+	c := sesv2.New(sesv2.Options{
+		APIOptions:       opts.APIOptions,
+		AppID:            opts.AppID,
+		BaseEndpoint:     opts.BaseEndpoint,
+		ClientLogMode:    opts.ClientLogMode,
+		Credentials:      opts.Credentials,
+		Logger:           opts.Logger,
+		Region:           opts.Region,
+		RetryMaxAttempts: opts.RetryMaxAttempts,
+		RetryMode:        opts.RetryMode,
+		Retryer:          opts.Retryer,
+		HTTPClient:       opts.HTTPClient,
+	})
+	actual, _ := sesV2Clients.LoadOrStore(client, c)
+	return actual.(*sesv2.Client)
+}
+
+// sendEmailV2 sends the SendRawEmail request input with the SESv2 SendEmail
+// API, which accepts messages up to SesV2SizeLimit. Errors are returned as
+// the v1 errors that mean the same thing so that they are handled the same
+// way.
+func sendEmailV2(ctx context.Context, client *ses.Client, input *ses.SendRawEmailInput) (*ses.SendRawEmailOutput, error) {
+	req := &sesv2.SendEmailInput{
+		FromEmailAddress:     input.Source,
+		Destination:          &v2types.Destination{ToAddresses: input.Destinations},
+		Content:              &v2types.EmailContent{Raw: &v2types.RawMessage{Data: input.RawMessage.Data}},
+		ConfigurationSetName: input.ConfigurationSetName,
+	}
+	req.FromEmailAddressIdentityArn = input.FromArn
+	if req.FromEmailAddressIdentityArn == nil {
+		req.FromEmailAddressIdentityArn = input.SourceArn
+	}
+	req.FeedbackForwardingEmailAddressIdentityArn = input.ReturnPathArn
+	for _, t := range input.Tags {
+		req.EmailTags = append(req.EmailTags, v2types.MessageTag{Name: t.Name, Value: t.Value})
+	}
+
+	out, err := sesV2Client(client).SendEmail(ctx, req)
+	if err != nil {
+		return nil, &sesV2Error{err: err, v1: sesV1Error(err)}
+	}
+	return &ses.SendRawEmailOutput{MessageId: out.MessageId}, nil
+}
+
+// sesV2Error is an error of SESv2 that also unwraps to the v1 error for the
+// same failure
+type sesV2Error struct {
+	err error
+	v1  error
+}
+
+func (e *sesV2Error) Error() string { return e.err.Error() }
+
+func (e *sesV2Error) Unwrap() []error {
+	if e.v1 == nil {
+		return []error{e.err}
+	}
+	return []error{e.v1, e.err}
+}
+
+// sesV1Error returns the v1 error for the SESv2 error err, or a generic API
+// error with the v1 code if there is no specific error for it. It returns
+// nil if err isn't an SESv2 API error.
+func sesV1Error(err error) error {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return nil
+	}
+
+	code, msg := apiErr.ErrorCode(), apiErr.ErrorMessage()
+	switch code {
+	case "MessageRejected":
+		return &types.MessageRejected{Message: aws.String(msg)}
+	case "MailFromDomainNotVerifiedException":
+		return &types.MailFromDomainNotVerifiedException{Message: aws.String(msg)}
+	case "SendingPausedException", "AccountSuspendedException":
+		return &types.AccountSendingPausedException{Message: aws.String(msg)}
+	case "NotFoundException":
+		if strings.Contains(strings.ToLower(msg), "configuration set") {
+			return &types.ConfigurationSetDoesNotExistException{Message: aws.String(msg)}
+		}
+		return nil
+	case "TooManyRequestsException", "LimitExceededException":
+		code = "Throttling"
+	case "BadRequestException":
+		code = "InvalidParameterValue"
+	default:
+		return nil
+	}
+	return &smithy.GenericAPIError{Code: code, Message: msg}
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-smtp"
+	"golang.org/x/net/idna"
+)
+
+// asciiAddress converts an envelope address, which may be internationalized
+// when the client uses SMTPUTF8, to the 7-bit form SES accepts by encoding
+// its domain with punycode. SES has no equivalent for a non-ASCII local part
+// so those addresses are rejected, as are ones that aren't valid UTF-8 or
+// whose domain isn't a valid IDN, or that are sent without declaring
+// SMTPUTF8. syntaxCode is the enhanced status code for a malformed address,
+// which differs between senders and recipients.
+func asciiAddress(addr string, smtputf8 bool, syntaxCode smtp.EnhancedCode) (string, error) {
+	if isASCII(addr) {
+		return addr, nil
+	}
+	if !smtputf8 {
+		return "", &smtp.SMTPError{
+			Code:         553,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 7},
+			Message:      "Error: non-ASCII address requires SMTPUTF8",
+		}
+	}
+	if !utf8.ValidString(addr) {
+		return "", &smtp.SMTPError{
+			Code:         553,
+			EnhancedCode: syntaxCode,
+			Message:      "Error: address is not valid UTF-8",
+		}
+	}
+
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr, nil
+	}
+
+	local, domain := addr[:at], addr[at+1:]
+	if !isASCII(local) {
+		return "", &smtp.SMTPError{
+			Code:         553,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 7},
+			Message:      "Error: non-ASCII local parts are not supported, use an ASCII address",
+		}
+	}
+
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", &smtp.SMTPError{
+			Code:         553,
+			EnhancedCode: syntaxCode,
+			Message:      "Error: invalid internationalized domain name",
+		}
+	}
+	return local + "@" + ascii, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// errSpool is wrapped by errors writing or reading back a spooled
+	// message
+	errSpool = errors.New("spool error")
+
+	// errSpoolFull is returned when the spool filesystem has less than the
+	// configured minimum of free space
+	errSpoolFull = errors.New("spool filesystem is full")
+)
+
+// spoolWriter tags write errors so they can be told apart from errors
+// reading from the client
+type spoolWriter struct {
+	f *os.File
+}
+
+func (w spoolWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	if err != nil {
+		return n, fmt.Errorf("%w: %w", errSpool, err)
+	}
+	return n, nil
+}
+
+// readMessage reads the message body from r, reading at most one byte more
+// than the message size limit. The body is read into buf, which is reset first,
+// so that sessions can reuse its memory from one message to the next. If
+// spooling is enabled, the body of a message larger than the spool threshold
+// is streamed to a temporary file while the client sends it and only read
+// back into memory once the transfer is complete. This avoids holding large,
+// growing buffers for the duration of slow transfers.
+func (b *Backend) readMessage(r io.Reader, buf *bytes.Buffer) ([]byte, error) {
+	buf.Reset()
+	r = io.LimitReader(r, b.maxMessageSize+1)
+	if b.spoolThreshold <= 0 {
+		_, err := buf.ReadFrom(r)
+		return buf.Bytes(), err
+	}
+
+	_, err := buf.ReadFrom(io.LimitReader(r, b.spoolThreshold+1))
+	if err != nil || int64(buf.Len()) <= b.spoolThreshold {
+		return buf.Bytes(), err
+	}
+
+	if b.spoolMinFree > 0 {
+		free, err := diskFree(spoolDir(b.spoolDir))
+		if err != nil && !errors.Is(err, errors.ErrUnsupported) {
+			return nil, fmt.Errorf("%w: %w", errSpool, err)
+		} else if err == nil && free < b.spoolMinFree {
+			return nil, errSpoolFull
+		}
+	}
+
+	f, err := os.CreateTemp(b.spoolDir, "ses-smtpd-proxy-*")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errSpool, err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := spoolWriter{f}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("%w: %w", errSpool, err)
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errSpool, err)
+	}
+
+	return data, nil
+}
+
+// spoolDir returns the directory in which messages are spooled
+func spoolDir(dir string) string {
+	if dir == "" {
+		return os.TempDir()
+	}
+	return dir
+}
+
+// registerSpoolMetrics registers a gauge reporting the free space of the
+// spool filesystem with reg
+func registerSpoolMetrics(reg prometheus.Registerer, dir string) {
+	promauto.With(reg).NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "smtpd",
+		Name:      "spool_free_bytes",
+		Help:      "Bytes available on the filesystem of the spool directory",
+	}, func() float64 {
+		free, err := diskFree(spoolDir(dir))
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(free)
+	})
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadMessageSpool(t *testing.T) {
+	msg := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+
+	tests := []struct {
+		name      string
+		threshold int64
+		size      int
+	}{
+		{"disabled", 0, len(msg)},
+		{"under threshold", 1 << 20, 1000},
+		{"at threshold", 1 << 20, 1 << 20},
+		{"over threshold", 1 << 20, len(msg)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			b := &Backend{maxMessageSize: 10 << 20, spoolThreshold: tt.threshold, spoolDir: dir}
+
+			var buf bytes.Buffer
+			data, err := b.readMessage(bytes.NewReader(msg[:tt.size]), &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, msg[:tt.size]) {
+				t.Errorf("read %d bytes that differ from the %d sent", len(data), tt.size)
+			}
+
+			if files, _ := os.ReadDir(dir); len(files) != 0 {
+				t.Errorf("%d spool files left behind", len(files))
+			}
+		})
+	}
+}
+
+func TestReadMessageSpoolError(t *testing.T) {
+	b := &Backend{maxMessageSize: 10 << 20, spoolThreshold: 1000, spoolDir: filepath.Join(t.TempDir(), "missing")}
+
+	var buf bytes.Buffer
+	if _, err := b.readMessage(bytes.NewReader(make([]byte, 2000)), &buf); !errors.Is(err, errSpool) {
+		t.Errorf("readMessage = %v, want a spool error", err)
+	}
+}
+
+func TestDataSpoolFull(t *testing.T) {
+	tests := []struct {
+		name     string
+		minFree  uint64
+		bodySize int
+		wantCode int
+	}{
+		{"space available", 1, 8000, 250},
+		{"full, message spooled", math.MaxUint64, 8000, 451},
+		{"full, message in memory", math.MaxUint64, 100, 250},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.SpoolThreshold = 4096
+			cfg.SpoolDir = t.TempDir()
+			cfg.SpoolMinFree = tt.minFree
+			_, addr := startServer(t, cfg)
+
+			c := dial(t, addr)
+			_, err := sendMessage(c, "sender@example.com", []string{"rcpt@example.com"}, message(strings.Repeat(strings.Repeat("x", 98)+"\r\n", tt.bodySize/100), "Subject: Test"))
+			code := 250
+			if err != nil {
+				code = replyCode(err)
+			}
+			if code != tt.wantCode {
+				t.Errorf("DATA reply %d (%v), want %d", code, err, tt.wantCode)
+			}
+
+			want := 0.0
+			if tt.wantCode == 451 {
+				want = 1
+			}
+			if v := metricValue(t, cfg.Registerer, "smtpd_email_send_fail_total", map[string]string{"type": "spool full"}); v != want {
+				t.Errorf("counted %g full spool failures, want %g", v, want)
+			}
+			if v := metricValue(t, cfg.Registerer, "smtpd_spool_free_bytes", nil); !(v > 0) {
+				t.Errorf("spool free space gauge is %g", v)
+			}
+		})
+	}
+}
+
+// chunkedReader returns a message in small reads, like a client sending it
+// over the network
+type chunkedReader struct {
+	data  []byte
+	chunk int
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), r.chunk)], r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// BenchmarkReadMessage compares the memory allocated reading a large message
+// into memory with spooling it to disk
+func BenchmarkReadMessage(b *testing.B) {
+	msg := bytes.Repeat([]byte("x"), 9<<20)
+
+	benchmarks := []struct {
+		name      string
+		threshold int64
+	}{
+		{"memory", 0},
+		{"spooled", 64 << 10},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			be := &Backend{maxMessageSize: 10 << 20, spoolThreshold: bm.threshold, spoolDir: b.TempDir()}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(msg)))
+
+			for i := 0; i < b.N; i++ {
+				var buf bytes.Buffer
+				if _, err := be.readMessage(&chunkedReader{msg, 32 << 10}, &buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
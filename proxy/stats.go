@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stats keeps lifetime counters for the summary logged at shutdown. They
+// parallel the Prometheus metrics, which can't easily be read back.
+type stats struct {
+	started time.Time
+	sent    atomic.Int64
+	active  atomic.Int64
+	peak    atomic.Int64
+
+	mu     sync.Mutex
+	errors map[string]int64
+}
+
+func newStats() *stats {
+	return &stats{
+		started: time.Now(),
+		errors:  map[string]int64{},
+	}
+}
+
+func (s *stats) sessionStarted() {
+	n := s.active.Add(1)
+	for {
+		peak := s.peak.Load()
+		if n <= peak || s.peak.CompareAndSwap(peak, n) {
+			return
+		}
+	}
+}
+
+func (s *stats) sessionEnded() {
+	s.active.Add(-1)
+}
+
+func (s *stats) error(typ string) {
+	s.mu.Lock()
+	s.errors[typ]++
+	s.mu.Unlock()
+}
+
+func (s *stats) String() string {
+	s.mu.Lock()
+	types := make([]string, 0, len(s.errors))
+	var total int64
+	for typ, n := range s.errors {
+		types = append(types, fmt.Sprintf("%q:%d", typ, n))
+		total += n
+	}
+	s.mu.Unlock()
+	slices.Sort(types)
+
+	return fmt.Sprintf("uptime=%s sent=%d errors=%d error_types={%s} peak_sessions=%d",
+		time.Since(s.started).Round(time.Second),
+		s.sent.Load(),
+		total,
+		strings.Join(types, ","),
+		s.peak.Load(),
+	)
+}
+
+// LogSummary logs the lifetime totals of the server, it is intended to be
+// called when the process is about to exit
+func (s *Server) LogSummary() {
+	log.Printf("summary: %s", s.backend.stats)
+}
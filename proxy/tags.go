@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"net/mail"
+	"net/textproto"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses/types"
+)
+
+// messageTagsHeader is the header field that sets the SES message tags of a
+// message, in the format the SES SMTP interface accepts: name=value pairs
+// separated by commas
+const messageTagsHeader = "X-SES-MESSAGE-TAGS"
+
+// maxMessageTags is the most tags SES accepts on a message
+const maxMessageTags = 50
+
+// errInvalidTag is returned by messageTags when the header field could be
+// parsed but contains a tag SES won't accept
+var errInvalidTag = errors.New("invalid message tag")
+
+// validateTag returns an error if name or value can't be used in an SES
+// message tag. Both may only contain ASCII letters, digits, underscores and
+// dashes, and be 1 to 256 characters long.
+func validateTag(name, value string) error {
+	for _, s := range []string{name, value} {
+		if s == "" || len(s) > 256 {
+			return fmt.Errorf("%w %s=%s: names and values must be 1 to 256 characters long", errInvalidTag, name, value)
+		}
+		for _, c := range s {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+				return fmt.Errorf("%w %s=%s: names and values may only contain letters, digits, _ and -", errInvalidTag, name, value)
+			}
+		}
+	}
+	return nil
+}
+
+// parseTags adds the name=value pairs separated by commas in s to tags
+func parseTags(s string, tags map[string]string) error {
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("%w %q: not of the form name=value", errInvalidTag, pair)
+		}
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if err := validateTag(name, value); err != nil {
+			return err
+		}
+		tags[name] = value
+	}
+	return nil
+}
+
+// messageTags returns the message tags set by the header of data and data
+// with that header field removed, so that it isn't sent on to the
+// recipients. Messages without the field are returned as they are without
+// being parsed.
+func messageTags(data []byte) (map[string]string, []byte, error) {
+	rawHeader, body, _ := splitEntity(data)
+	if !hasHeaderField(rawHeader, messageTagsHeader) {
+		return nil, data, nil
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, data, err
+	}
+
+	tags := map[string]string{}
+	for _, v := range msg.Header[textproto.CanonicalMIMEHeaderKey(messageTagsHeader)] {
+		if err := parseTags(v, tags); err != nil {
+			return nil, data, err
+		}
+	}
+	return tags, append(removeHeader(rawHeader, messageTagsHeader), body...), nil
+}
+
+// sesTags converts tags to SES message tags sorted by name
+func sesTags(tags map[string]string) []types.MessageTag {
+	var out []types.MessageTag
+	for _, name := range slices.Sorted(maps.Keys(tags)) {
+		out = append(out, types.MessageTag{Name: aws.String(name), Value: aws.String(tags[name])})
+	}
+	return out
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+)
+
+// UserConfig holds the SES settings for an authenticated SMTP user. Unset
+// fields fall back to the global configuration.
+type UserConfig struct {
+	// ConfigurationSet replaces the global configuration set for messages
+	// sent by the user.
+	ConfigurationSet string `json:"configuration_set"`
+
+	// AllowedFromDomains restricts the MAIL FROM domains the user may send
+	// from. If empty any domain is allowed.
+	AllowedFromDomains []string `json:"allowed_from_domains"`
+
+	// MaxSendRate limits the messages per second the user may send, in
+	// addition to the global limit. Zero means unlimited.
+	MaxSendRate float64 `json:"max_send_rate"`
+
+	// SendPriority, "high", "normal" or "low", replaces the priority the
+	// headers of the user's messages give them when they wait for a send
+	// worker.
+	SendPriority string `json:"send_priority"`
+
+	// CrossAccountRole is the ARN of a role assumed for the user's sends
+	// instead of the global cross-account role.
+	CrossAccountRole string `json:"cross_account_role"`
+
+	// SourceArn, FromArn and ReturnPathArn are the ARNs of the SES
+	// identities whose sending authorization policies permit the user's
+	// sends, when they send from an identity owned by another account.
+	SourceArn     string `json:"source_arn"`
+	FromArn       string `json:"from_arn"`
+	ReturnPathArn string `json:"return_path_arn"`
+
+	// MaxSessions limits the number of concurrent sessions authenticated as
+	// the user, replacing the default limit. Zero means the default applies.
+	MaxSessions int `json:"max_sessions"`
+}
+
+// tenant is the resolved form of a UserConfig
+type tenant struct {
+	configSet          *string
+	allowedFromDomains map[string]bool
+	sendLimiter        *sendLimiter
+	sendPriority       string
+	sesClient          *ses.Client
+	arns               sendingArns
+}
+
+func newTenant(ctx context.Context, awsCfg aws.Config, u UserConfig) *tenant {
+	t := &tenant{sendPriority: u.SendPriority}
+
+	if u.ConfigurationSet != "" {
+		t.configSet = &u.ConfigurationSet
+	}
+
+	if len(u.AllowedFromDomains) > 0 {
+		t.allowedFromDomains = map[string]bool{}
+		for _, d := range u.AllowedFromDomains {
+			t.allowedFromDomains[strings.ToLower(d)] = true
+		}
+	}
+
+	if u.MaxSendRate > 0 {
+		t.sendLimiter = newSendLimiter(u.MaxSendRate, 0, 0, nil)
+	}
+
+	if u.CrossAccountRole != "" {
+		t.sesClient = makeSesClient(ctx, awsCfg, u.CrossAccountRole, nil)
+	}
+
+	t.arns = sendingArns{
+		source:     optionalString(u.SourceArn),
+		from:       optionalString(u.FromArn),
+		returnPath: optionalString(u.ReturnPathArn),
+	}
+
+	return t
+}
+
+// optionalString returns nil for an empty string, which SES treats as unset
+func optionalString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// allowsFrom reports whether the user may send from addr
+func (t *tenant) allowsFrom(addr string) bool {
+	if len(t.allowedFromDomains) == 0 {
+		return true
+	}
+	return t.allowedFromDomains[addressDomain(addr)]
+}
+
+// hasArns reports whether the user sends with sending authorization, from
+// identities of another account than the one of its SES client
+func (t *tenant) hasArns() bool {
+	return t.arns != (sendingArns{})
+}
+
+// domainSet returns the set of the lower cased domains, or nil if there are
+// none
+func domainSet(domains []string) map[string]bool {
+	if len(domains) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		set[strings.ToLower(strings.TrimSpace(d))] = true
+	}
+	return set
+}
+
+// addressDomain returns the lower cased domain part of an email address
+func addressDomain(addr string) string {
+	return strings.ToLower(addr[strings.LastIndex(addr, "@")+1:])
+}
@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func TestUserSettings(t *testing.T) {
+	cfg := testConfig()
+	cfg.ConfigurationSetName = "global"
+	cfg.Authenticator = staticAuthenticator{"alice": "alice-pass", "bob": "bob-pass"}
+	cfg.Users = map[string]UserConfig{
+		"alice": {ConfigurationSet: "alice-set", AllowedFromDomains: []string{"alice.example.com"}},
+		"bob":   {ConfigurationSet: "bob-set", AllowedFromDomains: []string{"bob.example.com"}},
+	}
+	_, addr := startServer(t, cfg)
+
+	tests := []struct {
+		user          string
+		from          string
+		wantCode      int
+		wantConfigSet string
+	}{
+		{"alice", "app@alice.example.com", 250, "alice-set"},
+		{"alice", "app@ALICE.example.com", 250, "alice-set"},
+		{"alice", "app@bob.example.com", 553, ""},
+		{"bob", "app@bob.example.com", 250, "bob-set"},
+		{"bob", "app@alice.example.com", 553, ""},
+		{"bob", "app@example.com", 553, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.user+" "+tt.from, func(t *testing.T) {
+			cfg.Mailbox.Clear()
+
+			c := dial(t, addr)
+			if err := login(c, tt.user, tt.user+"-pass"); err != nil {
+				t.Fatalf("AUTH: %v", err)
+			}
+
+			_, err := sendMessage(c, tt.from, []string{"rcpt@example.com"}, message("Hello", "From: "+tt.from, "Subject: Test"))
+			code := 250
+			if err != nil {
+				code = replyCode(err)
+			}
+			if code != tt.wantCode {
+				t.Fatalf("send reply %d (%v), want %d", code, err, tt.wantCode)
+			}
+
+			msgs := cfg.Mailbox.List()
+			if tt.wantCode != 250 {
+				if len(msgs) != 0 {
+					t.Errorf("rejected sender delivered %d messages", len(msgs))
+				}
+				return
+			}
+			if len(msgs) != 1 {
+				t.Fatalf("delivered %d messages, want 1", len(msgs))
+			}
+			if got := msgs[0].ConfigurationSet; got != tt.wantConfigSet {
+				t.Errorf("configuration set %q, want %q", got, tt.wantConfigSet)
+			}
+		})
+	}
+}
+
+func TestUnlistedUserUsesGlobalSettings(t *testing.T) {
+	cfg := testConfig()
+	cfg.ConfigurationSetName = "global"
+	cfg.Authenticator = staticAuthenticator{"alice": "alice-pass", "carol": "carol-pass"}
+	cfg.Users = map[string]UserConfig{
+		"alice": {ConfigurationSet: "alice-set", AllowedFromDomains: []string{"alice.example.com"}},
+	}
+	_, addr := startServer(t, cfg)
+
+	c := dial(t, addr)
+	if err := login(c, "carol", "carol-pass"); err != nil {
+		t.Fatalf("AUTH: %v", err)
+	}
+	if _, err := sendMessage(c, "app@bob.example.com", []string{"rcpt@example.com"}, message("Hello", "Subject: Test")); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	msgs := cfg.Mailbox.List()
+	if len(msgs) != 1 || msgs[0].ConfigurationSet != "global" {
+		t.Fatalf("delivered %+v, want one message with the global configuration set", msgs)
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// rateTracker measures the send rate over a sliding window using one bucket
+// per second of the window, and remembers the highest rate it has seen
+type rateTracker struct {
+	mu      sync.Mutex
+	counts  []int
+	seconds []int64
+	peak    float64
+}
+
+// newRateTracker creates a tracker with a window rounded to whole seconds and
+// registers its current and peak rate gauges with reg
+func newRateTracker(window time.Duration, reg prometheus.Registerer) *rateTracker {
+	n := max(1, int(window/time.Second))
+	t := &rateTracker{
+		counts:  make([]int, n),
+		seconds: make([]int64, n),
+	}
+
+	f := promauto.With(reg)
+	f.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "smtpd",
+		Name:      "current_send_rate",
+		Help:      "Messages sent per second over the send rate window",
+	}, func() float64 {
+		return t.rate(time.Now())
+	})
+	f.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "smtpd",
+		Name:      "peak_send_rate",
+		Help:      "Highest send rate observed since startup in messages per second",
+	}, func() float64 {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return t.peak
+	})
+
+	return t
+}
+
+// record counts a message sent at now
+func (t *rateTracker) record(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sec := now.Unix()
+	i := int(sec % int64(len(t.counts)))
+	if t.seconds[i] != sec {
+		t.seconds[i] = sec
+		t.counts[i] = 0
+	}
+	t.counts[i]++
+
+	t.peak = max(t.peak, t.rateLocked(sec))
+}
+
+// rate returns the send rate over the window ending at now
+func (t *rateTracker) rate(now time.Time) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.rateLocked(now.Unix())
+}
+
+func (t *rateTracker) rateLocked(sec int64) float64 {
+	n := int64(len(t.counts))
+	total := 0
+	for i, s := range t.seconds {
+		if sec-s < n {
+			total += t.counts[i]
+		}
+	}
+	return float64(total) / float64(n)
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLSCertificate is a certificate offered to STARTTLS clients that ask for
+// one of its domains with SNI
+type TLSCertificate struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	// Domains the certificate is selected for, a leading "*." matches any
+	// single label. If empty the DNS names of the certificate are used.
+	Domains []string `json:"domains"`
+}
+
+// certSelector picks the certificate for a TLS handshake by the server name
+// the client asked for
+type certSelector struct {
+	byName map[string]*tls.Certificate
+	def    *tls.Certificate
+}
+
+// newCertSelector loads certs. The first is the default, used for clients
+// that don't send SNI or ask for a name none of the certificates cover.
+func newCertSelector(certs []TLSCertificate) (*certSelector, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("no TLS certificates configured")
+	}
+
+	c := &certSelector{byName: map[string]*tls.Certificate{}}
+	for i, tc := range certs {
+		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS certificate %s: %w", tc.CertFile, err)
+		}
+		if cert.Leaf == nil {
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return nil, fmt.Errorf("parsing TLS certificate %s: %w", tc.CertFile, err)
+			}
+		}
+
+		domains := tc.Domains
+		if len(domains) == 0 {
+			domains = cert.Leaf.DNSNames
+		}
+		for _, d := range domains {
+			d = strings.ToLower(strings.TrimSuffix(d, "."))
+			if _, ok := c.byName[d]; ok {
+				return nil, fmt.Errorf("TLS certificate %s: domain %s is already used by another certificate", tc.CertFile, d)
+			}
+			c.byName[d] = &cert
+		}
+
+		if i == 0 {
+			c.def = &cert
+		}
+	}
+
+	return c, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *certSelector) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return c.def, nil
+	}
+
+	if cert, ok := c.byName[name]; ok {
+		return cert, nil
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := c.byName["*."+parent]; ok {
+			return cert, nil
+		}
+	}
+
+	return c.def, nil
+}
+
+// loadClientCAs loads the PEM encoded certificates of the authorities that
+// sign client certificates from path
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS client CAs: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("loading TLS client CAs: no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// certIdentity returns the name a client certificate authenticates: its
+// common name or, if it has none, its first DNS or email subject alternative
+// name
+func certIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	}
+	return ""
+}
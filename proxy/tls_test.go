@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// writeCert writes a self-signed certificate for the DNS names, with common
+// name cn, and its key to dir and returns them as a TLSCertificate
+func writeCert(t testing.TB, dir, cn string, dnsNames ...string) TLSCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tc := TLSCertificate{CertFile: filepath.Join(dir, cn+".crt"), KeyFile: filepath.Join(dir, cn+".key")}
+	if err := os.WriteFile(tc.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tc.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+// brandCerts writes a default certificate and one for each of two brands
+func brandCerts(t testing.TB) []TLSCertificate {
+	dir := t.TempDir()
+	brandB := writeCert(t, dir, "brand-b", "smtp.brand-b.com")
+	brandB.Domains = []string{"smtp.brand-b.com", "*.mail.brand-b.com"}
+	return []TLSCertificate{
+		writeCert(t, dir, "default", "mail.example.com"),
+		writeCert(t, dir, "brand-a", "smtp.brand-a.com"),
+		brandB,
+	}
+}
+
+func TestCertSelector(t *testing.T) {
+	certs, err := newCertSelector(brandCerts(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"", "default"},
+		{"mail.example.com", "default"},
+		{"smtp.brand-a.com", "brand-a"},
+		{"SMTP.Brand-A.com.", "brand-a"},
+		{"smtp.brand-b.com", "brand-b"},
+		{"eu.mail.brand-b.com", "brand-b"},
+		{"a.eu.mail.brand-b.com", "default"},
+		{"other.brand-a.com", "default"},
+	}
+
+	for _, tt := range tests {
+		cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cert.Leaf.Subject.CommonName; got != tt.want {
+			t.Errorf("certificate for %q is %s, want %s", tt.serverName, got, tt.want)
+		}
+	}
+}
+
+func TestCertSelectorDuplicateDomain(t *testing.T) {
+	dir := t.TempDir()
+	certs := []TLSCertificate{
+		writeCert(t, dir, "first", "smtp.example.com"),
+		writeCert(t, dir, "second", "smtp.example.com"),
+	}
+	if _, err := newCertSelector(certs); err == nil {
+		t.Error("newCertSelector accepted two certificates for the same domain")
+	}
+}
+
+func TestStartTLSServerName(t *testing.T) {
+	cfg := testConfig()
+	cfg.TLSCertificates = brandCerts(t)
+	_, addr := startServer(t, cfg)
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"smtp.brand-a.com", "brand-a"},
+		{"smtp.brand-b.com", "brand-b"},
+		{"unknown.example.net", "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			c, err := smtp.DialStartTLS(addr, &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true})
+			if err != nil {
+				t.Fatalf("STARTTLS: %v", err)
+			}
+			defer c.Close()
+
+			// The handshake happens with the first command after STARTTLS
+			if err := c.Noop(); err != nil {
+				t.Fatalf("NOOP: %v", err)
+			}
+			state, ok := c.TLSConnectionState()
+			if !ok {
+				t.Fatal("connection is not using TLS")
+			}
+			if got := state.PeerCertificates[0].Subject.CommonName; got != tt.want {
+				t.Errorf("server presented %s certificate, want %s", got, tt.want)
+			}
+
+			// The session goes on over TLS
+			if _, err := sendMessage(c, "sender@example.com", []string{"rcpt@example.com"}, message("Hello", "Subject: Test")); err != nil {
+				t.Errorf("send: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// Transform rewrites a raw message before it is sent. Transforms are applied
+// in the order they are configured, each to the output of the previous one.
+type Transform interface {
+	Transform(data []byte) ([]byte, error)
+}
+
+// TransformConfig configures one step of the transformation pipeline. The
+// fields that apply depend on the type of the step.
+type TransformConfig struct {
+	// Type is the name of the transform, one of the keys of transformTypes
+	Type string `json:"type"`
+
+	// Header is the name of the header field for "strip-header" and
+	// "inject-header"
+	Header string `json:"header,omitempty"`
+
+	// Value is the value of the header for "inject-header" and the new From
+	// address for "rewrite-from"
+	Value string `json:"value,omitempty"`
+}
+
+// transformTypes is the registry of transforms by name
+var transformTypes = map[string]func(TransformConfig) (Transform, error){
+	"strip-header":  newStripHeader,
+	"inject-header": newInjectHeader,
+	"rewrite-from":  newRewriteFrom,
+}
+
+// newTransforms builds the transformation pipeline described by cfgs
+func newTransforms(cfgs []TransformConfig) ([]Transform, error) {
+	pipeline := make([]Transform, 0, len(cfgs))
+	for i, c := range cfgs {
+		newTransform, ok := transformTypes[c.Type]
+		if !ok {
+			return nil, fmt.Errorf("transform %d: unknown type %q", i+1, c.Type)
+		}
+
+		t, err := newTransform(c)
+		if err != nil {
+			return nil, fmt.Errorf("transform %d (%s): %w", i+1, c.Type, err)
+		}
+		pipeline = append(pipeline, t)
+	}
+
+	return pipeline, nil
+}
+
+func validateHeaderName(name string) error {
+	if name == "" || strings.ContainsAny(name, ": \t\r\n") {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	return nil
+}
+
+func validateHeaderValue(value string) error {
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("header value may not contain line breaks")
+	}
+	return nil
+}
+
+// stripHeader removes every occurrence of a header field
+type stripHeader struct {
+	name string
+}
+
+func newStripHeader(c TransformConfig) (Transform, error) {
+	if err := validateHeaderName(c.Header); err != nil {
+		return nil, err
+	}
+	return &stripHeader{name: c.Header}, nil
+}
+
+func (t *stripHeader) Transform(data []byte) ([]byte, error) {
+	rawHeader, body, _ := splitEntity(data)
+	return append(removeHeader(rawHeader, t.name), body...), nil
+}
+
+// injectHeader sets a header field, replacing any existing occurrences
+type injectHeader struct {
+	name, value string
+}
+
+func newInjectHeader(c TransformConfig) (Transform, error) {
+	if err := validateHeaderName(c.Header); err != nil {
+		return nil, err
+	}
+	if err := validateHeaderValue(c.Value); err != nil {
+		return nil, err
+	}
+	return &injectHeader{name: c.Header, value: c.Value}, nil
+}
+
+func (t *injectHeader) Transform(data []byte) ([]byte, error) {
+	rawHeader, body, eol := splitEntity(data)
+	return append(setHeader(rawHeader, t.name, t.value, eol), body...), nil
+}
+
+// rewriteFrom replaces the From header with a fixed address, keeping the
+// display name of the original sender
+type rewriteFrom struct {
+	addr string
+}
+
+func newRewriteFrom(c TransformConfig) (Transform, error) {
+	addr, err := mail.ParseAddress(c.Value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid From address %q: %w", c.Value, err)
+	}
+	return &rewriteFrom{addr: addr.Address}, nil
+}
+
+func (t *rewriteFrom) Transform(data []byte) ([]byte, error) {
+	rawHeader, body, eol := splitEntity(data)
+
+	from := &mail.Address{Address: t.addr}
+	if msg, err := mail.ReadMessage(bytes.NewReader(rawHeader)); err == nil {
+		if orig, err := msg.Header.AddressList("From"); err == nil && len(orig) == 1 {
+			from.Name = orig[0].Name
+		}
+	}
+
+	return append(setHeader(rawHeader, "From", from.String(), eol), body...), nil
+}
+
+// addMissingFrom adds a From header with from to a message that has none, or
+// only an empty one, and reports whether it did
+func addMissingFrom(data []byte, from string) ([]byte, bool, error) {
+	rawHeader, body, eol := splitEntity(data)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(rawHeader))
+	if err != nil {
+		return data, false, err
+	}
+	if strings.TrimSpace(msg.Header.Get("From")) != "" {
+		return data, false, nil
+	}
+
+	return append(setHeader(rawHeader, "From", from, eol), body...), true, nil
+}
+
+// forceFrom replaces the address of the From header of data with addr,
+// keeping the display name, unless it already is addr or is in one of the
+// keep domains. The original header is kept in X-Original-From. It reports
+// whether the header was replaced; messages without a From header are
+// returned as they are.
+func forceFrom(data []byte, addr string, keep map[string]bool) ([]byte, bool, error) {
+	rawHeader, body, eol := splitEntity(data)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(rawHeader))
+	if err != nil {
+		return data, false, err
+	}
+	orig := strings.TrimSpace(msg.Header.Get("From"))
+	if orig == "" {
+		return data, false, nil
+	}
+
+	from := &mail.Address{Address: addr}
+	if list, err := msg.Header.AddressList("From"); err == nil && len(list) == 1 {
+		if strings.EqualFold(list[0].Address, addr) || keep[addressDomain(list[0].Address)] {
+			return data, false, nil
+		}
+		from.Name = list[0].Name
+	}
+
+	rawHeader = setHeader(rawHeader, "X-Original-From", orig, eol)
+	return append(setHeader(rawHeader, "From", from.String(), eol), body...), true, nil
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bytes"
+	"net/mail"
+	"testing"
+)
+
+func TestAddMissingFrom(t *testing.T) {
+	tests := []struct {
+		name      string
+		msg       string
+		wantFrom  string
+		wantAdded bool
+	}{
+		{"missing", message("Hello", "Subject: Test"), "noreply@example.com", true},
+		{"empty", message("Hello", "From: ", "Subject: Test"), "noreply@example.com", true},
+		{"present", message("Hello", "From: app@example.com", "Subject: Test"), "app@example.com", false},
+		{"present in other case", message("Hello", "FROM: app@example.com", "Subject: Test"), "app@example.com", false},
+		{"headers only", "Subject: Test\r\n", "noreply@example.com", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, added, err := addMissingFrom([]byte(tt.msg), "noreply@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if added != tt.wantAdded {
+				t.Errorf("added %t, want %t", added, tt.wantAdded)
+			}
+
+			msg, err := mail.ReadMessage(bytes.NewReader(out))
+			if err != nil {
+				t.Fatalf("result is not a valid message: %v\n%s", err, out)
+			}
+			if got := msg.Header.Get("From"); got != tt.wantFrom {
+				t.Errorf("From %q, want %q", got, tt.wantFrom)
+			}
+			if got := msg.Header.Get("Subject"); got != "Test" {
+				t.Errorf("Subject %q, want it kept", got)
+			}
+		})
+	}
+}
+
+func TestDataDefaultFrom(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaultFrom string
+		fields      []string
+		wantFrom    string
+		wantAdded   float64
+	}{
+		{"address", `"Monitoring" <noreply@example.com>`, []string{"Subject: Alert"}, `"Monitoring" <noreply@example.com>`, 1},
+		{"envelope", "envelope", []string{"Subject: Alert"}, "sender@example.com", 1},
+		{"existing From kept", "noreply@example.com", []string{"From: app@example.com", "Subject: Alert"}, "app@example.com", 0},
+		{"disabled", "", []string{"Subject: Alert"}, "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.DefaultFrom = tt.defaultFrom
+			_, addr := startServer(t, cfg)
+
+			c := dial(t, addr)
+			if _, err := sendMessage(c, "sender@example.com", []string{"rcpt@example.com"}, message("Hello", tt.fields...)); err != nil {
+				t.Fatalf("send: %v", err)
+			}
+
+			msg, err := mail.ReadMessage(bytes.NewReader(cfg.Mailbox.List()[0].Data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := msg.Header.Get("From"); got != tt.wantFrom {
+				t.Errorf("From %q, want %q", got, tt.wantFrom)
+			}
+			if v := metricValue(t, cfg.Registerer, "smtpd_from_headers_added_total", nil); v != tt.wantAdded {
+				t.Errorf("counted %g added From headers, want %g", v, tt.wantAdded)
+			}
+		})
+	}
+}
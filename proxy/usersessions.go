@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// userSessions tracks the number of active sessions of each authenticated
+// user so that no user can hold more than their share of the connections
+type userSessions struct {
+	mu     sync.Mutex
+	active map[string]int
+
+	defaultMax int
+	max        map[string]int
+	known      map[string]struct{}
+	gauge      *prometheus.GaugeVec
+}
+
+// newUserSessions creates a tracker that allows each user defaultMax sessions
+// unless overridden in users, zero means no limit. Only the users that are
+// configured get their own gauge, so that clients can't create arbitrary
+// label values, the rest are counted together as "other".
+func newUserSessions(defaultMax int, users map[string]UserConfig, gauge *prometheus.GaugeVec) *userSessions {
+	u := &userSessions{
+		active:     map[string]int{},
+		defaultMax: defaultMax,
+		max:        map[string]int{},
+		known:      map[string]struct{}{},
+		gauge:      gauge,
+	}
+
+	for name, cfg := range users {
+		u.known[name] = struct{}{}
+		if cfg.MaxSessions > 0 {
+			u.max[name] = cfg.MaxSessions
+		}
+		gauge.With(prometheus.Labels{"user": name}).Set(0)
+	}
+
+	return u
+}
+
+// acquire records a new session for user and reports whether it is within
+// the user's limit. Sessions that aren't allowed aren't recorded.
+func (u *userSessions) acquire(user string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	limit, ok := u.max[user]
+	if !ok {
+		limit = u.defaultMax
+	}
+	if limit > 0 && u.active[user] >= limit {
+		return false
+	}
+
+	u.active[user]++
+	u.gauge.With(prometheus.Labels{"user": u.label(user)}).Inc()
+	return true
+}
+
+// release records the end of a session acquired for user
+func (u *userSessions) release(user string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.active[user]--; u.active[user] <= 0 {
+		delete(u.active, user)
+	}
+	u.gauge.With(prometheus.Labels{"user": u.label(user)}).Dec()
+}
+
+func (u *userSessions) label(user string) string {
+	if _, ok := u.known[user]; ok {
+		return user
+	}
+	return "other"
+}
@@ -0,0 +1,141 @@
+package suppression
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// List is a concurrency-safe set of recipient addresses that should not be
+// sent to, typically because they recently hard bounced. Entries expire after
+// the list TTL. If a path is configured the list is persisted there so it
+// survives restarts.
+type List struct {
+	mu      sync.RWMutex
+	ttl     time.Duration
+	path    string
+	entries map[string]time.Time
+
+	suppressedRecipient prometheus.Counter
+	suppressionEntries  prometheus.Gauge
+}
+
+// New creates a suppression list with the given entry TTL and registers its
+// metrics with reg. If path is not empty any previously persisted entries are
+// loaded from it; a missing file is not an error.
+func New(ttl time.Duration, path string, reg prometheus.Registerer) (*List, error) {
+	f := promauto.With(reg)
+	l := &List{
+		ttl:     ttl,
+		path:    path,
+		entries: map[string]time.Time{},
+		suppressedRecipient: f.NewCounter(prometheus.CounterOpts{
+			Namespace: "smtpd",
+			Name:      "local_suppression_drop_total",
+			Help:      "Total number of recipients rejected by the local suppression list",
+		}),
+		suppressionEntries: f.NewGauge(prometheus.GaugeOpts{
+			Namespace: "smtpd",
+			Name:      "local_suppression_entries",
+			Help:      "Number of addresses currently in the local suppression list",
+		}),
+	}
+
+	if path == "" {
+		return l, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &l.entries); err != nil {
+		return nil, fmt.Errorf("unable to parse suppression list %s: %w", path, err)
+	}
+	l.prune(time.Now())
+
+	return l, nil
+}
+
+func normalize(addr string) string {
+	return strings.ToLower(strings.TrimSpace(addr))
+}
+
+// Add suppresses addr for the list TTL, persisting the list if a path was
+// configured. It is the entry point for bounce feedback.
+func (l *List) Add(addr string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.entries[normalize(addr)] = now.Add(l.ttl)
+	l.prune(now)
+
+	return l.save()
+}
+
+// Contains reports whether addr is currently suppressed
+func (l *List) Contains(addr string) bool {
+	l.mu.RLock()
+	expires, ok := l.entries[normalize(addr)]
+	l.mu.RUnlock()
+
+	return ok && time.Now().Before(expires)
+}
+
+// Dropped counts a recipient rejected because it is suppressed
+func (l *List) Dropped() {
+	l.suppressedRecipient.Inc()
+}
+
+// prune removes expired entries, the caller must hold the write lock
+func (l *List) prune(now time.Time) {
+	for addr, expires := range l.entries {
+		if !now.Before(expires) {
+			delete(l.entries, addr)
+		}
+	}
+	l.suppressionEntries.Set(float64(len(l.entries)))
+}
+
+// save writes the list to disk, the caller must hold the lock. The file is
+// written to a temporary file first and renamed so a crash can't leave a
+// partially written list behind.
+func (l *List) save() error {
+	if l.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(l.entries)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), ".suppression-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), l.path)
+}
@@ -0,0 +1,59 @@
+// Package systemd implements the receiving side of systemd socket activation
+// so the proxy can serve on sockets that systemd opened for it.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd
+const listenFdsStart = 3
+
+// Listeners returns the listening sockets passed to the process by systemd
+// keyed by their FileDescriptorName= from the socket unit. Sockets without a
+// name are keyed "unknown", as systemd does. If the process was not socket
+// activated the returned map is empty. The activation environment variables
+// are removed so they aren't inherited by child processes.
+func Listeners() (map[string]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := map[string]net.Listener{}
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %w", err)
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := range n {
+		fd := listenFdsStart + i
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		if _, ok := listeners[name]; ok {
+			return nil, fmt.Errorf("more than one socket named %q", name)
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %q (fd %d) is not a listening socket: %w", name, fd, err)
+		}
+		listeners[name] = l
+	}
+
+	return listeners, nil
+}